@@ -15,7 +15,7 @@ func main() {
 }
 
 func trapSignals() <-chan os.Signal {
-	sigTrap := make(chan os.Signal)
+	sigTrap := make(chan os.Signal, 1)
 	signal.Notify(sigTrap, syscall.SIGTERM)
 	signal.Notify(sigTrap, syscall.SIGINT)
 	signal.Notify(sigTrap, syscall.SIGQUIT)
@@ -0,0 +1,398 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/routines"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	archiveDefaultDays = 7
+	archiveDefaultPoll = 5 * time.Minute
+)
+
+// archiveTiers maps lower case tier names to the RestoreObject tiers
+var archiveTiers = map[string]string{
+	"standard":  s3.TierStandard,
+	"bulk":      s3.TierBulk,
+	"expedited": s3.TierExpedited,
+}
+
+// splunkBucketRe matches the Splunk bucket prefix of a SmartStore key
+var splunkBucketRe = regexp.MustCompile(`^(.*/[^/]+/[0-9A-Fa-f]{2}/[0-9A-Fa-f]{2}/[^/]+)/`)
+
+// archiveObject is an object version which has been surfaced by a restore but is stored in an archive tier. With
+// Receipt set it is the delete marker of a receipt.json instead, withheld until the bucket's data files are readable.
+type archiveObject struct {
+	Key       string
+	VersionId string
+	Receipt   bool
+}
+
+// stateLine formats obj as a line of the state file, "<key> <versionId>" followed by "receipt" for withheld markers
+func (o archiveObject) stateLine() string {
+	if o.Receipt {
+		return fmt.Sprintf("%s %s receipt\n", o.Key, o.VersionId)
+	}
+	return fmt.Sprintf("%s %s\n", o.Key, o.VersionId)
+}
+
+// archiveState records objects with a pending archive restore. It is appended to during a restore and
+// rewritten by archivewait so an interrupted wait can be resumed.
+type archiveState struct {
+	path string
+	mu   *sync.Mutex
+}
+
+func newArchiveState(fpath string) *archiveState {
+	return &archiveState{path: fpath, mu: &sync.Mutex{}}
+}
+
+// Add appends a pending object to the state file
+func (a *archiveState) Add(obj archiveObject) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fh, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fh.WriteString(obj.stateLine())
+	if err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// Load reads all pending objects from the state file
+func (a *archiveState) Load() ([]archiveObject, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fh, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	seen := map[archiveObject]bool{}
+	objs := []archiveObject{}
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		obj := archiveObject{Key: fields[0]}
+		if len(fields) > 1 {
+			obj.VersionId = fields[1]
+		}
+		obj.Receipt = len(fields) > 2 && fields[2] == "receipt"
+		if !seen[obj] {
+			seen[obj] = true
+			objs = append(objs, obj)
+		}
+	}
+	return objs, scanner.Err()
+}
+
+// Save atomically replaces the state file with objs
+func (a *archiveState) Save(objs []archiveObject) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fh, err := ioutil.TempFile(filepath.Dir(a.path), filepath.Base(a.path)+".*")
+	if err != nil {
+		return err
+	}
+	for _, obj := range objs {
+		if _, err := fh.WriteString(obj.stateLine()); err != nil {
+			fh.Close()
+			os.Remove(fh.Name())
+			return err
+		}
+	}
+	if err := fh.Close(); err != nil {
+		os.Remove(fh.Name())
+		return err
+	}
+	return os.Rename(fh.Name(), a.path)
+}
+
+// archiveStatus describes whether an object version can be read or needs a restore from an archive tier
+type archiveStatus int
+
+const (
+	archiveReadable archiveStatus = iota
+	archiveArchived
+	archiveRestoring
+)
+
+// classifyArchive determines the archive status from the storage class, Restore and x-amz-archive-status headers
+func classifyArchive(storageClass, restore, archiveStatusHdr string) archiveStatus {
+	switch {
+	case strings.Contains(restore, `ongoing-request="true"`):
+		return archiveRestoring
+	case strings.Contains(restore, `ongoing-request="false"`):
+		return archiveReadable
+	case storageClass == s3.StorageClassGlacier, storageClass == s3.StorageClassDeepArchive:
+		return archiveArchived
+	case storageClass == s3.StorageClassIntelligentTiering && archiveStatusHdr != "":
+		return archiveArchived
+	}
+	return archiveReadable
+}
+
+// headArchive fetches the archive status of an object version. S3 rejects SSE-C headers for objects which are not
+// encrypted with SSE-C, so the --sse-customer-key is only sent again after a HEAD without it fails with 400.
+func (s *S3) headArchive(svc *s3.S3, obj archiveObject) (archiveStatus, string, error) {
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(s.Config.S3bucket),
+		Key:    aws.String(obj.Key),
+	}
+	if obj.VersionId != "" {
+		input.VersionId = aws.String(obj.VersionId)
+	}
+	req, output := svc.HeadObjectRequest(input)
+	err := req.Send()
+	if err != nil && s.Config.SSECustomerKey != "" && req.HTTPResponse != nil && req.HTTPResponse.StatusCode == 400 {
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(s.Config.SSECustomerKey)
+		req, output = svc.HeadObjectRequest(input)
+		err = req.Send()
+	}
+	if err != nil {
+		return archiveReadable, "", err
+	}
+	// The SDK does not model the Intelligent-Tiering archive status
+	archiveHdr := req.HTTPResponse.Header.Get("x-amz-archive-status")
+	storageClass := aws.StringValue(output.StorageClass)
+	return classifyArchive(storageClass, aws.StringValue(output.Restore), archiveHdr), storageClass, nil
+}
+
+// archiveTier returns the retrieval tier to use for storageClass. Expedited retrievals are only offered for
+// GLACIER, DEEP_ARCHIVE and the Intelligent-Tiering archive tiers fall back to Standard.
+func archiveTier(tier, storageClass string) string {
+	if tier == s3.TierExpedited && (storageClass == s3.StorageClassDeepArchive || storageClass == s3.StorageClassIntelligentTiering) {
+		return s3.TierStandard
+	}
+	return tier
+}
+
+// restoreArchive requests a temporary copy of an archived object version
+func (s *S3) restoreArchive(svc *s3.S3, obj archiveObject, storageClass string) error {
+	tier := archiveTier(s.Config.ArchiveTier, storageClass)
+	if tier != s.Config.ArchiveTier {
+		log.Printf("restore action=archive pid=%d status=info msg=\"%s retrieval not available, using %s\" key=%s storageclass=%s",
+			s.State.Pid(), s.Config.ArchiveTier, tier, obj.Key, storageClass)
+	}
+	request := &s3.RestoreRequest{
+		GlacierJobParameters: &s3.GlacierJobParameters{
+			Tier: aws.String(tier),
+		},
+	}
+	// Intelligent-Tiering moves the object back to the access tier, a restore period is not allowed
+	if storageClass != s3.StorageClassIntelligentTiering {
+		request.Days = aws.Int64(s.Config.ArchiveDays)
+	}
+	input := &s3.RestoreObjectInput{
+		Bucket:         aws.String(s.Config.S3bucket),
+		Key:            aws.String(obj.Key),
+		RestoreRequest: request,
+	}
+	if obj.VersionId != "" {
+		input.VersionId = aws.String(obj.VersionId)
+	}
+	_, err := svc.RestoreObject(input)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "RestoreAlreadyInProgress" {
+		return nil
+	}
+	return err
+}
+
+// actionArchive issues archive restores for keys which have been surfaced by removing their delete markers
+func (s *S3) actionArchive() func(id *routines.Id, batch []interface{}) {
+	svc := s.GetClient()
+	archiveFunc := func(id *routines.Id, batch []interface{}) {
+		for _, item := range batch {
+			key, ok := item.(string)
+			if !ok {
+				log.Printf("ERROR: Expecting a key of type string. skipping")
+				continue
+			}
+			obj := archiveObject{Key: key}
+			status, storageClass, err := s.headArchive(svc, obj)
+			if err != nil {
+				log.Printf("restore action=archive pid=%d status=error key=%s err=\"%v\"", s.State.Pid(), key, err)
+				continue
+			}
+			if status == archiveReadable {
+				continue
+			}
+			if status == archiveArchived {
+				err = s.restoreArchive(svc, obj, storageClass)
+				if err != nil {
+					log.Printf("restore action=archive pid=%d status=error key=%s storageclass=%s err=\"%v\"", s.State.Pid(), key, storageClass, err)
+					continue
+				}
+			}
+			if err := s.archive.Add(obj); err != nil {
+				log.Printf("restore action=archive pid=%d status=error msg=\"can not record pending restore\" key=%s err=\"%v\"", s.State.Pid(), key, err)
+			}
+			log.Printf("restore action=archive pid=%d status=pending key=%s storageclass=%s tier=%s state=%s", s.State.Pid(), key, storageClass, s.Config.ArchiveTier, s.Config.ArchiveState)
+		}
+	}
+	return archiveFunc
+}
+
+// WaitArchive polls pending archive restores until every object is readable. The withheld receipt.json markers of
+// a bucket are removed once all of its data files are readable, the bucket is then reported as ready.
+func (s *S3) WaitArchive(stop func() bool) error {
+	svc := s.GetClient()
+	pending, err := s.archive.Load()
+	if err != nil {
+		return err
+	}
+	for len(pending) > 0 {
+		stillPending := []archiveObject{}
+		for i, obj := range pending {
+			if stop() {
+				return s.archive.Save(append(stillPending, pending[i:]...))
+			}
+			if obj.Receipt {
+				stillPending = append(stillPending, obj)
+				continue
+			}
+			status, storageClass, err := s.headArchive(svc, obj)
+			if err != nil {
+				log.Printf("restore action=archivewait pid=%d status=error key=%s err=\"%v\"", s.State.Pid(), obj.Key, err)
+				stillPending = append(stillPending, obj)
+				continue
+			}
+			if status == archiveArchived {
+				// A restore which expired or was never issued
+				if err := s.restoreArchive(svc, obj, storageClass); err != nil {
+					log.Printf("restore action=archivewait pid=%d status=error key=%s err=\"%v\"", s.State.Pid(), obj.Key, err)
+				}
+			}
+			if status != archiveReadable {
+				stillPending = append(stillPending, obj)
+				continue
+			}
+			if s.Config.Verbose {
+				log.Printf("restore action=archivewait pid=%d status=readable key=%s", s.State.Pid(), obj.Key)
+			}
+		}
+		stillPending = s.releaseReceipts(svc, stillPending)
+		for _, bucket := range readyBuckets(pending, stillPending) {
+			log.Printf("restore action=archivewait pid=%d status=ready bucket=%s", s.State.Pid(), bucket)
+		}
+		if err := s.archive.Save(stillPending); err != nil {
+			return err
+		}
+		pending = stillPending
+		if len(pending) == 0 {
+			break
+		}
+		log.Printf("restore action=archivewait pid=%d status=waiting pending=%d poll=%s", s.State.Pid(), len(pending), s.Config.PollInterval)
+		deadline := time.Now().Add(s.Config.PollInterval)
+		for time.Now().Before(deadline) {
+			if stop() {
+				return nil
+			}
+			time.Sleep(time.Second)
+		}
+	}
+	return nil
+}
+
+// releaseReceipts removes the withheld receipt.json markers of buckets without pending data files and returns the
+// objects which are still pending. Markers which could not be removed stay pending and are retried on the next pass.
+func (s *S3) releaseReceipts(svc *s3.S3, pending []archiveObject) []archiveObject {
+	waiting := map[string]bool{}
+	for _, obj := range pending {
+		if !obj.Receipt {
+			waiting[splunkBucketOfKey(obj.Key)] = true
+		}
+	}
+	stillPending := []archiveObject{}
+	var release []*s3.ObjectIdentifier
+	for _, obj := range pending {
+		if !obj.Receipt || waiting[splunkBucketOfKey(obj.Key)] {
+			stillPending = append(stillPending, obj)
+			continue
+		}
+		release = append(release, &s3.ObjectIdentifier{Key: aws.String(obj.Key), VersionId: aws.String(obj.VersionId)})
+	}
+	var restored []interface{}
+	for start := 0; start < len(release); start += deleteObjectsMax {
+		end := start + deleteObjectsMax
+		if end > len(release) {
+			end = len(release)
+		}
+		output, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Config.S3bucket),
+			Delete: &s3.Delete{Objects: release[start:end], Quiet: aws.Bool(false)},
+		})
+		if err != nil {
+			log.Printf("restore action=archivewait pid=%d status=error msg=\"can not remove receipt markers\" err=\"%v\"", s.State.Pid(), err)
+			for _, obj := range release[start:end] {
+				stillPending = append(stillPending, archiveObject{Key: *obj.Key, VersionId: *obj.VersionId, Receipt: true})
+			}
+			continue
+		}
+		for _, deleted := range output.Deleted {
+			log.Printf("restore action=archivewait pid=%d status=restored key=%s version=%s", s.State.Pid(), aws.StringValue(deleted.Key), aws.StringValue(deleted.VersionId))
+			restored = append(restored, aws.StringValue(deleted.Key))
+		}
+		for _, e := range output.Errors {
+			log.Printf("restore action=archivewait pid=%d status=error msg=\"can not remove receipt marker\" key=%s version=%s code=%s",
+				s.State.Pid(), aws.StringValue(e.Key), aws.StringValue(e.VersionId), aws.StringValue(e.Code))
+			stillPending = append(stillPending, archiveObject{Key: aws.StringValue(e.Key), VersionId: aws.StringValue(e.VersionId), Receipt: true})
+		}
+	}
+	// Reset frozen_in_cluster to 0
+	if s.Config.ZeroFrozen && len(restored) > 0 {
+		s.actionFixUp()(nil, restored)
+	}
+	return stillPending
+}
+
+// readyBuckets returns the Splunk buckets which had objects in before but have none left in after
+func readyBuckets(before, after []archiveObject) []string {
+	remaining := map[string]bool{}
+	for _, obj := range after {
+		remaining[splunkBucketOfKey(obj.Key)] = true
+	}
+	ready := map[string]bool{}
+	for _, obj := range before {
+		bucket := splunkBucketOfKey(obj.Key)
+		if !remaining[bucket] {
+			ready[bucket] = true
+		}
+	}
+	buckets := []string{}
+	for bucket := range ready {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// splunkBucketOfKey returns the Splunk bucket prefix of a key, or its directory if it is not a SmartStore key
+func splunkBucketOfKey(key string) string {
+	if m := splunkBucketRe.FindStringSubmatch(key); m != nil {
+		return m[1]
+	}
+	return path.Dir(key)
+}
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestClassifyArchive(t *testing.T) {
+	tests := []struct {
+		storageClass string
+		restore      string
+		archiveHdr   string
+		expect       archiveStatus
+	}{
+		{"STANDARD", "", "", archiveReadable},
+		{"GLACIER", "", "", archiveArchived},
+		{"DEEP_ARCHIVE", `ongoing-request="true"`, "", archiveRestoring},
+		{"GLACIER", `ongoing-request="false", expiry-date="Fri, 21 Dec 2012 00:00:00 GMT"`, "", archiveReadable},
+		{"INTELLIGENT_TIERING", "", "ARCHIVE_ACCESS", archiveArchived},
+		{"INTELLIGENT_TIERING", "", "", archiveReadable},
+	}
+	for _, test := range tests {
+		if got := classifyArchive(test.storageClass, test.restore, test.archiveHdr); got != test.expect {
+			t.Errorf("classifyArchive(%s, %s, %s) expected %d got %d", test.storageClass, test.restore, test.archiveHdr, test.expect, got)
+		}
+	}
+}
+
+func TestArchiveTier(t *testing.T) {
+	for _, test := range []struct {
+		tier, storageClass, expect string
+	}{
+		{"Expedited", "GLACIER", "Expedited"},
+		{"Expedited", "DEEP_ARCHIVE", "Standard"},
+		{"Expedited", "INTELLIGENT_TIERING", "Standard"},
+		{"Bulk", "DEEP_ARCHIVE", "Bulk"},
+		{"Bulk", "INTELLIGENT_TIERING", "Bulk"},
+	} {
+		if got := archiveTier(test.tier, test.storageClass); got != test.expect {
+			t.Errorf("archiveTier(%s, %s) expected %s got %s", test.tier, test.storageClass, test.expect, got)
+		}
+	}
+}
+
+func TestS3_headArchive_sseC(t *testing.T) {
+	sseC := map[string]bool{"ssec": true}
+	var heads []string
+	svc := stubS3Client(t, func(r *request.Request) (int, string) {
+		key := r.HTTPRequest.URL.Path
+		withKey := r.HTTPRequest.Header.Get("x-amz-server-side-encryption-customer-key") != ""
+		heads = append(heads, key)
+		// S3 answers a HEAD with the wrong encryption headers with a 400 without a body
+		if withKey != sseC[key[len("/bucket/"):]] {
+			return 400, ""
+		}
+		return 200, ""
+	})
+	svc.Handlers.Send.PushBack(func(r *request.Request) {
+		r.HTTPResponse.Header.Set("x-amz-storage-class", "GLACIER")
+	})
+	s := &S3{Config: &ConfigType{S3bucket: "bucket", SSECustomerKey: "01234567890123456789012345678901"}, State: &State}
+	for _, key := range []string{"plain", "ssec"} {
+		status, storageClass, err := s.headArchive(svc, archiveObject{Key: key})
+		if err != nil || status != archiveArchived || storageClass != "GLACIER" {
+			t.Errorf("%s: unexpected status %d %s %v", key, status, storageClass, err)
+		}
+	}
+	if len(heads) != 3 {
+		t.Errorf("expected the SSE-C key only to be sent after a 400, got %v", heads)
+	}
+}
+
+func TestArchiveState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splunks3restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	state := newArchiveState(filepath.Join(dir, "archive.state"))
+	a := archiveObject{Key: "path/main/db/AB/CD/1~GUID/guidSplunk-GUID/rawdata/journal.gz", VersionId: "v1"}
+	b := archiveObject{Key: "path/main/db/AB/CD/1~GUID/receipt.json", VersionId: "v2", Receipt: true}
+	c := archiveObject{Key: "path/main/db/12/34/2~GUID/receipt.json"}
+	for _, obj := range []archiveObject{a, b, a, c} {
+		if err := state.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending, err := state.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 3 {
+		t.Fatalf("expected 3 unique pending objects got %d", len(pending))
+	}
+	ready := readyBuckets(pending, []archiveObject{b})
+	if len(ready) != 1 || ready[0] != "path/main/db/12/34/2~GUID" {
+		t.Errorf("unexpected ready buckets %v", ready)
+	}
+	if err := state.Save([]archiveObject{b}); err != nil {
+		t.Fatal(err)
+	}
+	pending, _ = state.Load()
+	if len(pending) != 1 || pending[0] != b {
+		t.Errorf("expected only %v to be pending got %v", b, pending)
+	}
+}
+
+func TestS3_WaitArchive_releasesReceipts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splunks3restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ready := "path/main/db/AB/CD/1~GUID/"
+	archived := "path/main/db/12/34/2~GUID/"
+	state := newArchiveState(filepath.Join(dir, "archive.state"))
+	for _, obj := range []archiveObject{
+		{Key: ready + "guidSplunk-GUID/rawdata/journal.gz", VersionId: "v1"},
+		{Key: ready + "receipt.json", VersionId: "dm1", Receipt: true},
+		{Key: archived + "guidSplunk-GUID/rawdata/journal.gz", VersionId: "v2"},
+		{Key: archived + "receipt.json", VersionId: "dm2", Receipt: true},
+	} {
+		if err := state.Add(obj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var released []string
+	sess := stubSession(t, func(r *request.Request) (int, string) {
+		switch r.Operation.Name {
+		case "HeadObject":
+			return 200, ""
+		case "DeleteObjects":
+			body := "<DeleteResult>"
+			for _, obj := range r.Params.(*s3.DeleteObjectsInput).Delete.Objects {
+				released = append(released, aws.StringValue(obj.Key)+" "+aws.StringValue(obj.VersionId))
+				body += "<Deleted><Key>" + aws.StringValue(obj.Key) + "</Key><VersionId>" + aws.StringValue(obj.VersionId) + "</VersionId></Deleted>"
+			}
+			return 200, body + "</DeleteResult>"
+		}
+		t.Errorf("unexpected %s request", r.Operation.Name)
+		return 500, ""
+	})
+	sess.Handlers.Send.PushBack(func(r *request.Request) {
+		if input, ok := r.Params.(*s3.HeadObjectInput); ok && aws.StringValue(input.VersionId) == "v2" {
+			r.HTTPResponse.Header.Set("x-amz-storage-class", "GLACIER")
+			r.HTTPResponse.Header.Set("x-amz-restore", `ongoing-request="true"`)
+		}
+	})
+	s := &S3{Config: &ConfigType{S3bucket: "bucket"}, State: &State, archive: state, sess: sess, sessOnce: &sync.Once{}}
+	s.sessOnce.Do(func() {})
+	passes := 0
+	err = s.WaitArchive(func() bool {
+		// stop during the wait after the first pass
+		passes++
+		return passes > 4
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(released) != 1 || released[0] != ready+"receipt.json dm1" {
+		t.Errorf("expected only the receipt of the readable bucket to be restored, got %v", released)
+	}
+	pending, err := state.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].Key != archived+"guidSplunk-GUID/rawdata/journal.gz" || !pending[1].Receipt {
+		t.Errorf("expected the archived bucket to stay pending, got %v", pending)
+	}
+}
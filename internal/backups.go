@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/routines"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// backupTimeFormat is the timestamp suffix of receipt.json backups
+const backupTimeFormat = "20060102150405"
+
+var backupKeyRe = regexp.MustCompile(`^(.*/receipt\.json)\.(\d{14})$`)
+
+// receiptBackup is a backup copy of a receipt.json
+type receiptBackup struct {
+	Key     string // key of the backup
+	Receipt string // key of the receipt.json it is a copy of
+	Stamp   string // YYYYmmddHHMMSS suffix
+	Created time.Time
+	Size    int64
+}
+
+// backupKey returns the key of a backup of the receipt.json key. Backups are siblings of the receipt unless
+// --backup-prefix moves them outside the SmartStore tree.
+func (s *S3) backupKey(key, stamp string) string {
+	backup := key + "." + stamp
+	if s.Config.BackupPrefix == "" {
+		return backup
+	}
+	return strings.Trim(s.Config.BackupPrefix, "/") + "/" + backup
+}
+
+// parseBackupKey returns the backup described by key or false if key is not a receipt.json backup
+func (s *S3) parseBackupKey(key string) (receiptBackup, bool) {
+	rel := key
+	if prefix := strings.Trim(s.Config.BackupPrefix, "/"); prefix != "" {
+		if !strings.HasPrefix(key, prefix+"/") {
+			return receiptBackup{}, false
+		}
+		rel = strings.TrimPrefix(key, prefix+"/")
+	}
+	m := backupKeyRe.FindStringSubmatch(rel)
+	if m == nil {
+		return receiptBackup{}, false
+	}
+	created, err := time.ParseInLocation(backupTimeFormat, m[2], time.Local)
+	if err != nil {
+		return receiptBackup{}, false
+	}
+	return receiptBackup{Key: key, Receipt: m[1], Stamp: m[2], Created: created}, true
+}
+
+// listBackups returns the backups of the receipts under prefix grouped by receipt key, oldest first
+func (s *S3) listBackups(svc *s3.S3, prefix string) (map[string][]receiptBackup, error) {
+	listPrefix := prefix
+	if bp := strings.Trim(s.Config.BackupPrefix, "/"); bp != "" {
+		listPrefix = bp + "/" + prefix
+	}
+	backups := map[string][]receiptBackup{}
+	err := svc.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(s.Config.S3bucket),
+		Prefix: aws.String(listPrefix),
+	}, func(output *s3.ListObjectsOutput, last bool) bool {
+		for _, obj := range output.Contents {
+			backup, ok := s.parseBackupKey(aws.StringValue(obj.Key))
+			if !ok {
+				continue
+			}
+			backup.Size = aws.Int64Value(obj.Size)
+			backups[backup.Receipt] = append(backups[backup.Receipt], backup)
+		}
+		return true
+	})
+	for _, list := range backups {
+		sort.Slice(list, func(i, j int) bool { return list[i].Stamp < list[j].Stamp })
+	}
+	return backups, err
+}
+
+// scanBackupsFunc lists, reverts or prunes the receipt backups of each prefix
+func (s *S3) scanBackupsFunc() func(id *routines.Id, batch []interface{}) {
+	svc := s.GetClient()
+	backupsFunc := func(id *routines.Id, batch []interface{}) {
+		for _, item := range batch {
+			prefix, ok := item.(string)
+			if !ok {
+				log.Printf("ERROR: Expecting a prefix of type string. skipping")
+				continue
+			}
+			backups, err := s.listBackups(svc, prefix)
+			if err != nil {
+				log.Printf("restore action=backups pid=%d status=error msg=\"can not list backups\" prefix=%s err=\"%v\"", s.State.Pid(), prefix, err)
+				continue
+			}
+			var keys []string
+			for key := range backups {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				atomic.AddInt64(&s.stats.receipts, 1)
+				switch s.Config.BackupAction {
+				case "list":
+					s.logBackups(key, backups[key])
+				case "revert":
+					s.revertBackup(svc, key, backups[key])
+				case "prune":
+					s.pruneBackups(svc, backups[key])
+				}
+			}
+		}
+	}
+	return backupsFunc
+}
+
+// logBackups logs the backups of the receipt.json key
+func (s *S3) logBackups(key string, backups []receiptBackup) {
+	for _, backup := range backups {
+		log.Printf("restore action=backups status=list pid=%d key=%s backup=%s created=\"%s\" size=%d",
+			s.State.Pid(), key, backup.Key, backup.Created.Format(time.RFC3339), backup.Size)
+	}
+}
+
+// revertBackup copies the chosen backup of key back on top of it if the backup has a valid content_hash
+func (s *S3) revertBackup(svc *s3.S3, key string, backups []receiptBackup) {
+	var chosen *receiptBackup
+	for i := range backups {
+		if s.Config.BackupStamp == "latest" || backups[i].Stamp == s.Config.BackupStamp {
+			chosen = &backups[i]
+		}
+	}
+	if chosen == nil {
+		if s.Config.Verbose {
+			log.Printf("restore action=revert pid=%d status=skip msg=\"no matching backup\" key=%s backup=%s", s.State.Pid(), key, s.Config.BackupStamp)
+		}
+		return
+	}
+	rcpt, attrs, err := s.downloadReceipt(svc, chosen.Key, "")
+	if err != nil {
+		log.Printf("restore action=revert pid=%d status=error msg=\"download error\" key=%s backup=%s err=\"%v\"", s.State.Pid(), key, chosen.Key, err)
+		return
+	}
+	if !rcpt.HashesMatch() {
+		log.Printf("restore action=revert pid=%d status=error msg=\"backup has an invalid content_hash\" key=%s backup=%s", s.State.Pid(), key, chosen.Key)
+		return
+	}
+	atomic.AddInt64(&s.stats.changed, 1)
+	if s.Config.DryRun {
+		log.Printf("restore action=revert status=dryrun pid=%d key=%s backup=%s", s.State.Pid(), key, chosen.Key)
+		return
+	}
+	_, err = svc.CopyObject(s.copyObjectInput(chosen.Key, key, attrs))
+	if err != nil {
+		log.Printf("restore action=revert pid=%d status=error msg=\"can not copy backup\" key=%s backup=%s err=\"%v\"", s.State.Pid(), key, chosen.Key, err)
+		return
+	}
+	log.Printf("restore action=revert pid=%d status=ok key=%s backup=%s", s.State.Pid(), key, chosen.Key)
+}
+
+// pruneBackups deletes every version of the backups created before the retention period. SmartStore buckets are
+// versioned, deleting a backup by key would only hide it behind a delete marker that a restore can remove.
+func (s *S3) pruneBackups(svc *s3.S3, backups []receiptBackup) {
+	var objects []*s3.ObjectIdentifier
+	for _, backup := range backups {
+		if !backup.Created.Before(s.Config.PruneBefore) {
+			continue
+		}
+		if s.Config.DryRun {
+			log.Printf("restore action=prune status=dryrun pid=%d backup=%s created=\"%s\"", s.State.Pid(), backup.Key, backup.Created.Format(time.RFC3339))
+			atomic.AddInt64(&s.stats.changed, 1)
+			continue
+		}
+		versions, err := s.keyVersions(svc, backup.Key)
+		if err != nil {
+			log.Printf("restore action=prune pid=%d status=error msg=\"can not list backup versions\" backup=%s err=\"%v\"", s.State.Pid(), backup.Key, err)
+			continue
+		}
+		objects = append(objects, versions...)
+	}
+	failed := map[string]bool{}
+	deleted := map[string]bool{}
+	for start := 0; start < len(objects); start += deleteObjectsMax {
+		end := start + deleteObjectsMax
+		if end > len(objects) {
+			end = len(objects)
+		}
+		output, err := svc.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s.Config.S3bucket),
+			Delete: &s3.Delete{Objects: objects[start:end]},
+		})
+		if err != nil {
+			log.Printf("restore action=prune pid=%d status=error msg=\"can not delete backups\" err=\"%v\"", s.State.Pid(), err)
+			for _, obj := range objects[start:end] {
+				failed[aws.StringValue(obj.Key)] = true
+			}
+			continue
+		}
+		for _, d := range output.Deleted {
+			deleted[aws.StringValue(d.Key)] = true
+			if s.Config.Verbose {
+				log.Printf("restore action=prune pid=%d status=info msg=\"deleted backup version\" backup=%s version=%s", s.State.Pid(), aws.StringValue(d.Key), aws.StringValue(d.VersionId))
+			}
+		}
+		for _, e := range output.Errors {
+			failed[aws.StringValue(e.Key)] = true
+			log.Printf("restore action=prune pid=%d status=error backup=%s version=%s err=\"%s\"", s.State.Pid(), aws.StringValue(e.Key), aws.StringValue(e.VersionId), aws.StringValue(e.Message))
+		}
+	}
+	var keys []string
+	for key := range deleted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if failed[key] {
+			continue
+		}
+		atomic.AddInt64(&s.stats.changed, 1)
+		log.Printf("restore action=prune pid=%d status=ok backup=%s", s.State.Pid(), key)
+	}
+}
+
+// keyVersions returns the object versions and delete markers of key
+func (s *S3) keyVersions(svc *s3.S3, key string) ([]*s3.ObjectIdentifier, error) {
+	var versions []*s3.ObjectIdentifier
+	err := svc.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.Config.S3bucket),
+		Prefix: aws.String(key),
+	}, func(output *s3.ListObjectVersionsOutput, last bool) bool {
+		for _, ver := range output.Versions {
+			if aws.StringValue(ver.Key) == key {
+				versions = append(versions, &s3.ObjectIdentifier{Key: ver.Key, VersionId: ver.VersionId})
+			}
+		}
+		for _, marker := range output.DeleteMarkers {
+			if aws.StringValue(marker.Key) == key {
+				versions = append(versions, &s3.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId})
+			}
+		}
+		return true
+	})
+	return versions, err
+}
@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"testing"
+	"time"
+)
+
+func TestS3_backupKey(t *testing.T) {
+	key := "main/db/AB/CD/1~GUID/receipt.json"
+	for _, prefix := range []string{"", "/receipt-backups/"} {
+		s := &S3{Config: &ConfigType{BackupPrefix: prefix}}
+		backup := s.backupKey(key, "20200102030405")
+		parsed, ok := s.parseBackupKey(backup)
+		if !ok || parsed.Receipt != key || parsed.Stamp != "20200102030405" || parsed.Key != backup {
+			t.Errorf("prefix %q: unexpected backup %+v of %s", prefix, parsed, backup)
+		}
+		if parsed.Created.Year() != 2020 || parsed.Created.Month() != time.January || parsed.Created.Second() != 5 {
+			t.Errorf("unexpected created time %s", parsed.Created)
+		}
+		if _, ok := s.parseBackupKey(key); ok {
+			t.Errorf("a receipt.json is not a backup")
+		}
+	}
+	s := &S3{Config: &ConfigType{BackupPrefix: "receipt-backups"}}
+	if b := s.backupKey(key, "20200102030405"); b != "receipt-backups/"+key+".20200102030405" {
+		t.Errorf("unexpected backup key %s", b)
+	}
+	if _, ok := s.parseBackupKey(key + ".20200102030405"); ok {
+		t.Errorf("sibling backups are outside --backup-prefix")
+	}
+}
+
+func TestS3_pruneBackups_versions(t *testing.T) {
+	key := "main/db/AB/CD/1~GUID/receipt.json"
+	s := &S3{Config: &ConfigType{S3bucket: "bucket", PruneBefore: time.Date(2020, 6, 1, 0, 0, 0, 0, time.Local)}, State: &State, stats: &fixupStats{}}
+	old, _ := s.parseBackupKey(key + ".20200102030405")
+	recent, _ := s.parseBackupKey(key + ".20200702030405")
+	var deletes []*s3.ObjectIdentifier
+	svc := stubS3Client(t, func(r *request.Request) (int, string) {
+		switch r.Operation.Name {
+		case "ListObjectVersions":
+			prefix := aws.StringValue(r.Params.(*s3.ListObjectVersionsInput).Prefix)
+			if prefix != old.Key {
+				t.Errorf("unexpected listing of %s", prefix)
+			}
+			return 200, "<ListVersionsResult><IsTruncated>false</IsTruncated>" +
+				"<Version><Key>" + old.Key + "</Key><VersionId>v2</VersionId></Version>" +
+				"<Version><Key>" + old.Key + "</Key><VersionId>v1</VersionId></Version>" +
+				"<Version><Key>" + old.Key + ".other</Key><VersionId>v9</VersionId></Version>" +
+				"<DeleteMarker><Key>" + old.Key + "</Key><VersionId>dm1</VersionId></DeleteMarker>" +
+				"</ListVersionsResult>"
+		case "DeleteObjects":
+			deletes = append(deletes, r.Params.(*s3.DeleteObjectsInput).Delete.Objects...)
+			body := "<DeleteResult>"
+			for _, obj := range deletes {
+				body += "<Deleted><Key>" + aws.StringValue(obj.Key) + "</Key><VersionId>" + aws.StringValue(obj.VersionId) + "</VersionId></Deleted>"
+			}
+			return 200, body + "</DeleteResult>"
+		}
+		t.Errorf("unexpected %s request", r.Operation.Name)
+		return 500, ""
+	})
+	s.pruneBackups(svc, []receiptBackup{old, recent})
+	var versions []string
+	for _, obj := range deletes {
+		if aws.StringValue(obj.Key) != old.Key {
+			t.Errorf("unexpected delete of %s", aws.StringValue(obj.Key))
+		}
+		versions = append(versions, aws.StringValue(obj.VersionId))
+	}
+	if len(versions) != 3 || versions[0] != "v2" || versions[1] != "v1" || versions[2] != "dm1" {
+		t.Errorf("expected every version of the old backup to be deleted by version id, got %v", versions)
+	}
+	if s.stats.changed != 1 {
+		t.Errorf("expected one pruned backup, got %d", s.stats.changed)
+	}
+}
+
+func TestGetUsage_backups(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"backups", "prune", "--retention", "30d", "--dryrun", "--s3bucket", "splunks3restore", "--region", "us-west-2", "--index", "main"}
+	opts := GetUsage(args, "1.0.0")
+	if !opts.Config.Backups || opts.Config.BackupAction != "prune" || !opts.Config.DryRun {
+		t.Errorf("expected a backups prune dry run")
+	}
+	if age := time.Since(opts.Config.PruneBefore); age < 29*24*time.Hour || age > 31*24*time.Hour {
+		t.Errorf("unexpected retention cutoff %s", opts.Config.PruneBefore)
+	}
+	args = []string{"backups", "revert", "--backup", "latest", "--s3bucket", "splunks3restore", "--region", "us-west-2", "--backup-prefix", "bk", "index~ID1"}
+	opts = GetUsage(args, "1.0.0")
+	if opts.Config.BackupAction != "revert" || opts.Config.BackupStamp != "latest" || opts.Config.BackupPrefix != "bk" {
+		t.Errorf("unexpected backups revert config %+v", opts.Config)
+	}
+}
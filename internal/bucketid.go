@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+var (
+	bucketIndexRe = regexp.MustCompile(`^[a-z0-9_][a-z0-9_-]*$`)
+	bucketIDRe    = regexp.MustCompile(`^[0-9]+$`)
+	bucketGUIDRe  = regexp.MustCompile(`^[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}$`)
+	bucketHashRe  = regexp.MustCompile(`^[0-9A-F]{2}$`)
+)
+
+// SmartStore trees holding data of a bucket below the index
+const (
+	BucketTypeDB      = "db"      // raw data and index files
+	BucketTypeDMA     = "dma"     // data model acceleration summaries
+	BucketTypeSummary = "summary" // report acceleration summaries
+)
+
+// BucketTypes are the trees selected by --bucket-type=all
+var BucketTypes = []string{BucketTypeDB, BucketTypeDMA, BucketTypeSummary}
+
+// ParseBucketTypes parses a --bucket-type value of db, dma, summary, all or a comma separated list of them
+func ParseBucketTypes(value string) ([]string, error) {
+	if value == "" {
+		return []string{BucketTypeDB}, nil
+	}
+	var types []string
+	seen := map[string]bool{}
+	for _, t := range strings.Split(value, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		var add []string
+		switch t {
+		case "all":
+			add = BucketTypes
+		case BucketTypeDB, BucketTypeDMA, BucketTypeSummary:
+			add = []string{t}
+		default:
+			return nil, fmt.Errorf("unknown bucket type %q, expecting db, dma, summary or all", t)
+		}
+		for _, a := range add {
+			if !seen[a] {
+				seen[a] = true
+				types = append(types, a)
+			}
+		}
+	}
+	return types, nil
+}
+
+func isBucketType(tree string) bool {
+	for _, t := range BucketTypes {
+		if t == tree {
+			return true
+		}
+	}
+	return false
+}
+
+// BucketID identifies a Splunk bucket as index~localid~guid
+type BucketID struct {
+	index   string
+	localID string
+	guid    string
+}
+
+// ParseBucketID parses and validates a bucket id of the form index~localid~guid
+func ParseBucketID(bid string) (BucketID, error) {
+	parts := strings.Split(strings.TrimSpace(bid), "~")
+	if len(parts) != 3 {
+		return BucketID{}, fmt.Errorf("bucket id %q is not of the form index~localid~guid", bid)
+	}
+	return NewBucketID(parts[0], parts[1], parts[2])
+}
+
+// ParseBucketDir parses a Splunk on-disk bucket directory name of the form db_<latest>_<earliest>_<localid>_<guid>
+// or rb_<latest>_<earliest>_<localid>_<guid> belonging to index
+func ParseBucketDir(index, dir string) (BucketID, error) {
+	parts := strings.Split(path.Base(dir), "_")
+	if len(parts) != 5 || (parts[0] != "db" && parts[0] != "rb") {
+		return BucketID{}, fmt.Errorf("bucket directory %q is not of the form db_<latest>_<earliest>_<localid>_<guid>", dir)
+	}
+	if !bucketIDRe.MatchString(parts[1]) || !bucketIDRe.MatchString(parts[2]) {
+		return BucketID{}, fmt.Errorf("bucket directory %q has invalid latest or earliest times", dir)
+	}
+	return NewBucketID(index, parts[3], parts[4])
+}
+
+// ParseBucketKey returns the bucket id of a SmartStore key below pth, e.g.
+// <pth>/<index>/db/XX/YY/<localid>~<guid>/receipt.json. Keys of the dma and summary trees are accepted.
+func ParseBucketKey(pth, key string) (BucketID, error) {
+	b, _, err := SplitBucketKey(pth, key)
+	return b, err
+}
+
+// SplitBucketKey is like ParseBucketKey and also returns the path of the key inside the bucket directory, e.g.
+// rawdata/journal.gz
+func SplitBucketKey(pth, key string) (BucketID, string, error) {
+	rel := key
+	if pth = strings.Trim(pth, "/"); pth != "" {
+		if !strings.HasPrefix(key, pth+"/") {
+			return BucketID{}, "", fmt.Errorf("key %s is not below %s", key, pth)
+		}
+		rel = strings.TrimPrefix(key, pth+"/")
+	}
+	parts := strings.SplitN(rel, "/", 6)
+	if len(parts) < 5 || !isBucketType(parts[1]) {
+		return BucketID{}, "", fmt.Errorf("key %s is not a SmartStore bucket key", key)
+	}
+	bucket := strings.Split(parts[4], "~")
+	if len(bucket) != 2 {
+		return BucketID{}, "", fmt.Errorf("key %s has an invalid bucket directory %s", key, parts[4])
+	}
+	b, err := NewBucketID(parts[0], bucket[0], bucket[1])
+	if err != nil {
+		return BucketID{}, "", err
+	}
+	if !bucketHashRe.MatchString(parts[2]) || !bucketHashRe.MatchString(parts[3]) || b.PrefixOf(parts[1]) != path.Join(parts[:5]...) {
+		return BucketID{}, "", fmt.Errorf("key %s does not match the SmartStore prefix of %s", key, b)
+	}
+	file := ""
+	if len(parts) == 6 {
+		file = parts[5]
+	}
+	return b, file, nil
+}
+
+// NewBucketID validates the parts of a bucket id
+func NewBucketID(index, localID, guid string) (BucketID, error) {
+	if !bucketIndexRe.MatchString(index) {
+		return BucketID{}, fmt.Errorf("invalid index name %q", index)
+	}
+	if !bucketIDRe.MatchString(localID) {
+		return BucketID{}, fmt.Errorf("invalid bucket local id %q, expecting a number", localID)
+	}
+	if !bucketGUIDRe.MatchString(guid) {
+		return BucketID{}, fmt.Errorf("invalid bucket guid %q", guid)
+	}
+	return BucketID{index: index, localID: localID, guid: guid}, nil
+}
+
+// Index returns the index name
+func (b BucketID) Index() string { return b.index }
+
+// LocalID returns the bucket number local to the originating indexer
+func (b BucketID) LocalID() string { return b.localID }
+
+// GUID returns the GUID of the originating indexer
+func (b BucketID) GUID() string { return b.guid }
+
+// IsZero returns true for the zero value
+func (b BucketID) IsZero() bool { return b == BucketID{} }
+
+// String returns the bucket id as index~localid~guid
+func (b BucketID) String() string {
+	return strings.Join([]string{b.index, b.localID, b.guid}, "~")
+}
+
+// Bucket returns the SmartStore bucket directory localid~guid
+func (b BucketID) Bucket() string {
+	return b.localID + "~" + b.guid
+}
+
+// Prefix returns the SmartStore prefix of the bucket, <index>/db/XX/YY/<localid>~<guid> where XXYY are the first
+// four hex digits of the SHA1 of the bucket directory
+func (b BucketID) Prefix() string {
+	return b.PrefixOf(BucketTypeDB)
+}
+
+// PrefixOf returns the prefix of the bucket in the db, dma or summary tree of its index
+func (b BucketID) PrefixOf(bucketType string) string {
+	sum := fmt.Sprintf("%X", sha1.Sum([]byte(b.Bucket())))
+	return strings.Join([]string{b.index, bucketType, sum[0:2], sum[2:4], b.Bucket()}, "/")
+}
+
+// PrefixIn returns the SmartStore prefix of the bucket below pth
+func (b BucketID) PrefixIn(pth string) string {
+	return strings.TrimPrefix(path.Join(pth, b.Prefix()), "/")
+}
+
+// PrefixesIn returns the prefixes of the bucket below pth for each of bucketTypes
+func (b BucketID) PrefixesIn(pth string, bucketTypes []string) []string {
+	var prefixes []string
+	for _, t := range bucketTypes {
+		prefixes = append(prefixes, strings.TrimPrefix(path.Join(pth, b.PrefixOf(t)), "/"))
+	}
+	return prefixes
+}
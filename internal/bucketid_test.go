@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBucketID(t *testing.T) {
+	b, err := ParseBucketID("_internal~753~B7F6C781-615D-4C57-B63E-69477156E71B")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if b.Index() != "_internal" || b.LocalID() != "753" || b.GUID() != "B7F6C781-615D-4C57-B63E-69477156E71B" {
+		t.Errorf("unexpected bucket id parts %s %s %s", b.Index(), b.LocalID(), b.GUID())
+	}
+	if b.String() != "_internal~753~B7F6C781-615D-4C57-B63E-69477156E71B" {
+		t.Errorf("unexpected bucket id %s", b)
+	}
+	for _, invalid := range []string{"", "_internal", "_internal~753", "Main~1~B7F6C781-615D-4C57-B63E-69477156E71B",
+		"main~x~B7F6C781-615D-4C57-B63E-69477156E71B", "main~1~GUID", "main~1~B7F6C781-615D-4C57-B63E-69477156E71B~2"} {
+		if _, err := ParseBucketID(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestBucketID_Prefix(t *testing.T) {
+	b, _ := ParseBucketID("_internal~275~609B1724-5A77-4C70-81DC-8444B5014D0D")
+	prefix := b.Prefix()
+	if prefix != "_internal/db/0C/F7/275~609B1724-5A77-4C70-81DC-8444B5014D0D" {
+		t.Errorf("unexpected prefix %s", prefix)
+	}
+	if p := b.PrefixIn(""); p != prefix {
+		t.Errorf("unexpected prefix without a path %s", p)
+	}
+	key := b.PrefixIn("/s3/path/") + "/receipt.json"
+	if key != "s3/path/"+prefix+"/receipt.json" {
+		t.Errorf("unexpected key %s", key)
+	}
+	parsed, err := ParseBucketKey("s3/path", key)
+	if err != nil || parsed != b {
+		t.Errorf("expected %s from %s, got %s: %v", b, key, parsed, err)
+	}
+	for _, invalid := range []string{"s3/path/_internal/db/00/00/275~609B1724-5A77-4C70-81DC-8444B5014D0D/receipt.json",
+		"other/" + prefix + "/receipt.json", "s3/path/_internal/db/6F/48"} {
+		if _, err := ParseBucketKey("s3/path", invalid); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestParseBucketDir(t *testing.T) {
+	for _, dir := range []string{"db_1519706363_1519700702_275_609B1724-5A77-4C70-81DC-8444B5014D0D",
+		"/opt/splunk/var/lib/splunk/_internaldb/db/rb_1519706363_1519700702_275_609B1724-5A77-4C70-81DC-8444B5014D0D"} {
+		b, err := ParseBucketDir("_internal", dir)
+		if err != nil || b.String() != "_internal~275~609B1724-5A77-4C70-81DC-8444B5014D0D" {
+			t.Errorf("unexpected bucket id %s from %s: %v", b, dir, err)
+		}
+	}
+	for _, invalid := range []string{"hot_v1_12", "db_1519706363_1519700702_275", "xb_1_2_275_609B1724-5A77-4C70-81DC-8444B5014D0D"} {
+		if _, err := ParseBucketDir("main", invalid); err == nil {
+			t.Errorf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestParseBucketTypes(t *testing.T) {
+	for value, want := range map[string]string{"": "db", "dma": "dma", "all": "db,dma,summary", "summary, DB,db": "summary,db"} {
+		types, err := ParseBucketTypes(value)
+		if err != nil || strings.Join(types, ",") != want {
+			t.Errorf("%q: expected %s, got %v: %v", value, want, types, err)
+		}
+	}
+	if _, err := ParseBucketTypes("colddb"); err == nil {
+		t.Errorf("expected an unknown bucket type to be rejected")
+	}
+}
+
+func TestBucketID_PrefixesIn(t *testing.T) {
+	b, _ := ParseBucketID("_internal~275~609B1724-5A77-4C70-81DC-8444B5014D0D")
+	prefixes := b.PrefixesIn("s3/path", BucketTypes)
+	want := []string{
+		"s3/path/_internal/db/0C/F7/275~609B1724-5A77-4C70-81DC-8444B5014D0D",
+		"s3/path/_internal/dma/0C/F7/275~609B1724-5A77-4C70-81DC-8444B5014D0D",
+		"s3/path/_internal/summary/0C/F7/275~609B1724-5A77-4C70-81DC-8444B5014D0D",
+	}
+	if strings.Join(prefixes, " ") != strings.Join(want, " ") {
+		t.Errorf("unexpected prefixes %v", prefixes)
+	}
+	parsed, err := ParseBucketKey("s3/path", prefixes[1]+"/some_summary/guidSplunk-GUID/file.tsidx")
+	if err != nil || parsed != b {
+		t.Errorf("expected %s from a dma key, got %s: %v", b, parsed, err)
+	}
+}
@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/routines"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// deleteObjectsMax is the most keys a DeleteObjects request accepts
+const deleteObjectsMax = 1000
+
+// Outcomes of a bucket restore
+const (
+	bucketComplete = "complete"
+	bucketPartial  = "partial"
+	bucketFailed   = "failed"
+)
+
+// bucketRestore holds the selected delete markers of one Splunk bucket directory. Keys outside a bucket directory
+// are restored on their own.
+type bucketRestore struct {
+	Dir     string
+	Markers []*s3.DeleteMarkerEntry
+}
+
+// split returns the markers of the data files and of receipt.json
+func (b *bucketRestore) split() (data, receipts []*s3.DeleteMarkerEntry) {
+	for _, marker := range b.Markers {
+		if strings.HasSuffix(aws.StringValue(marker.Key), "receipt.json") {
+			receipts = append(receipts, marker)
+		} else {
+			data = append(data, marker)
+		}
+	}
+	return data, receipts
+}
+
+// restoreStats counts bucket restores by outcome
+type restoreStats struct {
+	complete int64
+	partial  int64
+	failed   int64
+}
+
+// bucketGrouper collects the delete markers of one prefix listing by bucket directory. Listings are in key order so
+// the keys of a bucket directory are contiguous and a bucket is complete once the listing has moved past it.
+type bucketGrouper struct {
+	path   string
+	order  []string
+	groups map[string]*bucketRestore
+	submit func(*bucketRestore)
+}
+
+func newBucketGrouper(pth string, submit func(*bucketRestore)) *bucketGrouper {
+	return &bucketGrouper{path: pth, groups: map[string]*bucketRestore{}, submit: submit}
+}
+
+// bucketDir returns the bucket directory of key, key itself if it is not inside one
+func bucketDir(pth, key string) string {
+	_, file, err := SplitBucketKey(pth, key)
+	if err != nil || file == "" {
+		return key
+	}
+	return strings.TrimSuffix(key, file)
+}
+
+// Add adds a marker to the group of its bucket directory
+func (g *bucketGrouper) Add(marker *s3.DeleteMarkerEntry) {
+	dir := bucketDir(g.path, aws.StringValue(marker.Key))
+	group, ok := g.groups[dir]
+	if !ok {
+		group = &bucketRestore{Dir: dir}
+		g.groups[dir] = group
+		g.order = append(g.order, dir)
+	}
+	group.Markers = append(group.Markers, marker)
+}
+
+// Flush submits every group except the one next may still add to. An empty next submits all groups.
+func (g *bucketGrouper) Flush(next string) {
+	keep := ""
+	if next != "" {
+		keep = bucketDir(g.path, next)
+	}
+	var order []string
+	for _, dir := range g.order {
+		if dir == keep {
+			order = append(order, dir)
+			continue
+		}
+		g.submit(g.groups[dir])
+		delete(g.groups, dir)
+	}
+	g.order = order
+}
+
+// Pending returns the groups which have not been submitted
+func (g *bucketGrouper) Pending() []*bucketRestore {
+	var pending []*bucketRestore
+	for _, dir := range g.order {
+		pending = append(pending, g.groups[dir])
+	}
+	return pending
+}
+
+// bucketPrefixScan lists each prefix and queues the delete markers passing selectMarker to rtRestore, one job per
+// bucket directory. selectMarker is also given the version the marker hides when it is on the same page. The buckets
+// still open when a listing fails are left alone, their remaining markers are unknown.
+func (s *S3) bucketPrefixScan(selectMarker func(marker *s3.DeleteMarkerEntry, hidden *s3.ObjectVersion) bool) func(id *routines.Id, batch []interface{}) {
+	svc := s.GetClient()
+	return func(id *routines.Id, batch []interface{}) {
+		for _, item := range batch {
+			prefix, ok := item.(string)
+			if !ok {
+				log.Printf("ERROR: Expecting a prefix of type string. skipping")
+				continue
+			}
+			grouper := newBucketGrouper(s.Config.Path, func(group *bucketRestore) {
+				s.rtRestore.AddJob(group)
+			})
+			err := svc.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+				Bucket: aws.String(s.Config.S3bucket),
+				Prefix: aws.String(prefix),
+			}, func(output *s3.ListObjectVersionsOutput, lastPage bool) bool {
+				versions := newPageVersions(output)
+				for _, marker := range output.DeleteMarkers {
+					if selectMarker(marker, versions.hidden(marker)) {
+						grouper.Add(marker)
+					}
+				}
+				if next := aws.StringValue(output.NextKeyMarker); !lastPage && next != "" {
+					grouper.Flush(next)
+				}
+				return true
+			})
+			if err != nil {
+				log.Println(err.Error())
+				for _, group := range grouper.Pending() {
+					s.logBucketRestore(bucketFailed, "", group, 0, 0, len(group.Markers), "listing failed")
+				}
+				continue
+			}
+			grouper.Flush("")
+		}
+	}
+}
+
+// actionRmDm restores one bucket directory at a time. The data files are restored first, receipt.json only once
+// every other marker of the bucket was removed, so Splunk never sees a receipt whose files are still deleted.
+func (s *S3) actionRmDm() func(id *routines.Id, batch []interface{}) {
+	client := s.GetClient()
+	removeDmFunc := func(id *routines.Id, batch []interface{}) {
+		for _, item := range batch {
+			group, ok := item.(*bucketRestore)
+			if !ok {
+				log.Printf("ERROR: Expecting type *bucketRestore, skipping")
+				continue
+			}
+			s.restoreBucket(client, group)
+		}
+	}
+	return removeDmFunc
+}
+
+// restoreBucket removes the delete markers of group and reports its outcome. With --archive-tier the data files may
+// still be archived, so the receipt.json markers are recorded in the archive state for archivewait to remove.
+func (s *S3) restoreBucket(client *s3.S3, group *bucketRestore) {
+	batchid := Genuuid()
+	data, receipts := group.split()
+	restored, failed := s.removeMarkers(client, batchid, data)
+	skipped := 0
+	msg := ""
+	switch {
+	case failed > 0:
+		skipped = len(receipts)
+		msg = "receipt.json withheld, data files failed"
+	case s.Config.ArchiveTier != "" && len(receipts) > 0:
+		withheld, f := s.withholdReceipts(receipts)
+		skipped = withheld
+		failed += f
+		msg = "receipt.json withheld until archive restores complete, run archivewait"
+	default:
+		r, f := s.removeMarkers(client, batchid, receipts)
+		restored += r
+		failed += f
+	}
+	outcome := bucketComplete
+	switch {
+	case restored == 0:
+		outcome = bucketFailed
+	case failed > 0 || skipped > 0:
+		outcome = bucketPartial
+	}
+	s.logBucketRestore(outcome, batchid, group, restored, failed, skipped, msg)
+}
+
+// withholdReceipts records receipt.json markers in the archive state and returns the number recorded and failed
+func (s *S3) withholdReceipts(receipts []*s3.DeleteMarkerEntry) (int, int) {
+	withheld, failed := 0, 0
+	for _, marker := range receipts {
+		obj := archiveObject{Key: aws.StringValue(marker.Key), VersionId: aws.StringValue(marker.VersionId), Receipt: true}
+		if err := s.archive.Add(obj); err != nil {
+			log.Printf("restore action=archive pid=%d status=error msg=\"can not record withheld receipt\" key=%s err=\"%v\"", s.State.Pid(), obj.Key, err)
+			failed++
+			continue
+		}
+		withheld++
+	}
+	return withheld, failed
+}
+
+// removeMarkers removes markers in DeleteObjects requests and returns the number removed and failed
+func (s *S3) removeMarkers(client *s3.S3, batchid string, markers []*s3.DeleteMarkerEntry) (int, int) {
+	restored, failed := 0, 0
+	for start := 0; start < len(markers); start += deleteObjectsMax {
+		end := start + deleteObjectsMax
+		if end > len(markers) {
+			end = len(markers)
+		}
+		var restoreList []*s3.ObjectIdentifier
+		for _, marker := range markers[start:end] {
+			restoreList = append(restoreList, &s3.ObjectIdentifier{
+				Key:       marker.Key,
+				VersionId: marker.VersionId,
+			})
+		}
+		deleteOutputs, err := client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: &s.Config.S3bucket,
+			Delete: &s3.Delete{
+				Objects: restoreList,
+				Quiet:   aws.Bool(false),
+			},
+		})
+		s.logRestoreResults(err, batchid, deleteOutputs)
+		if err != nil || deleteOutputs == nil {
+			failed += len(restoreList)
+			continue
+		}
+		restored += len(deleteOutputs.Deleted)
+		failed += len(deleteOutputs.Errors)
+		// Restore surfaced versions stored in archive tiers
+		if s.Config.ArchiveTier != "" {
+			for _, obj := range deleteOutputs.Deleted {
+				s.rtArchive.AddJob(*obj.Key)
+			}
+		}
+		// Reset frozen_in_cluster to 0
+		if s.Config.ZeroFrozen {
+			for _, obj := range deleteOutputs.Deleted {
+				if strings.HasSuffix(*obj.Key, "receipt.json") {
+					s.rtFixup.AddJob(*obj.Key)
+				}
+			}
+		}
+	}
+	return restored, failed
+}
+
+func (s *S3) logBucketRestore(outcome, batchid string, group *bucketRestore, restored, failed, skipped int, msg string) {
+	switch outcome {
+	case bucketComplete:
+		atomic.AddInt64(&s.restores.complete, 1)
+	case bucketPartial:
+		atomic.AddInt64(&s.restores.partial, 1)
+	default:
+		atomic.AddInt64(&s.restores.failed, 1)
+	}
+	log.Printf("restore action=bucket status=%s batchid=%s pid=%d dir=%s markers=%d restored=%d failed=%d skipped=%d msg=\"%s\"\n",
+		outcome, batchid, s.State.Pid(), group.Dir, len(group.Markers), restored, failed, skipped, msg)
+}
+
+// LogRestoreSummary logs the number of buckets by restore outcome
+func (s *S3) LogRestoreSummary(action string) {
+	log.Printf("restore action=%s status=summary pid=%d buckets_complete=%d buckets_partial=%d buckets_failed=%d\n",
+		action, s.State.Pid(), atomic.LoadInt64(&s.restores.complete), atomic.LoadInt64(&s.restores.partial), atomic.LoadInt64(&s.restores.failed))
+}
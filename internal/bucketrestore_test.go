@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/routines"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBucketGrouper(t *testing.T) {
+	dir := "s3/path/_internal/db/0C/F7/275~609B1724-5A77-4C70-81DC-8444B5014D0D/"
+	other := "s3/path/main/db/0C/F7/275~609B1724-5A77-4C70-81DC-8444B5014D0D/"
+	var submitted []*bucketRestore
+	g := newBucketGrouper("s3/path", func(group *bucketRestore) {
+		submitted = append(submitted, group)
+	})
+	marker := func(key string) *s3.DeleteMarkerEntry {
+		return &s3.DeleteMarkerEntry{Key: aws.String(key), VersionId: aws.String("v")}
+	}
+	g.Add(marker("s3/path/README"))
+	g.Add(marker(dir + "guidSplunk-609B1724-5A77-4C70-81DC-8444B5014D0D/rawdata/journal.gz"))
+	g.Add(marker(dir + "receipt.json"))
+	// the next page continues in the bucket directory, so it stays open
+	g.Flush(dir + "receipt.json")
+	if len(submitted) != 1 || submitted[0].Dir != "s3/path/README" {
+		t.Fatalf("expected only the key outside a bucket to be submitted, got %v", submitted)
+	}
+	g.Add(marker(dir + "receipt.json"))
+	g.Add(marker(other + "receipt.json"))
+	g.Flush(other + "receipt.json")
+	if len(submitted) != 2 || submitted[1].Dir != dir || len(submitted[1].Markers) != 3 {
+		t.Fatalf("expected the bucket to be submitted once the listing moved past it, got %v", submitted)
+	}
+	data, receipts := submitted[1].split()
+	if len(data) != 1 || len(receipts) != 2 {
+		t.Errorf("expected receipt.json to be split from the data files, got %d and %d", len(data), len(receipts))
+	}
+	if pending := g.Pending(); len(pending) != 1 || pending[0].Dir != other {
+		t.Errorf("unexpected pending groups %v", pending)
+	}
+	g.Flush("")
+	if len(submitted) != 3 || len(g.Pending()) != 0 {
+		t.Errorf("expected every group to be submitted at the end of the listing")
+	}
+}
+
+func TestS3_restoreBucket_withholdsReceipt(t *testing.T) {
+	dir := "s3/path/main/db/0C/F7/275~609B1724-5A77-4C70-81DC-8444B5014D0D/"
+	group := &bucketRestore{Dir: dir}
+	for _, name := range []string{"guidSplunk-1/bloomfilter", "guidSplunk-1/rawdata/journal.gz", "receipt.json"} {
+		group.Markers = append(group.Markers, &s3.DeleteMarkerEntry{Key: aws.String(dir + name), VersionId: aws.String("dm")})
+	}
+	var deleted []string
+	svc := stubS3Client(t, func(r *request.Request) (int, string) {
+		if r.Operation.Name != "DeleteObjects" {
+			t.Errorf("unexpected %s request", r.Operation.Name)
+			return 500, ""
+		}
+		body := "<DeleteResult>"
+		for _, obj := range r.Params.(*s3.DeleteObjectsInput).Delete.Objects {
+			key := aws.StringValue(obj.Key)
+			if strings.HasSuffix(key, "journal.gz") {
+				body += "<Error><Key>" + key + "</Key><VersionId>dm</VersionId><Code>AccessDenied</Code><Message>Access Denied</Message></Error>"
+				continue
+			}
+			deleted = append(deleted, key)
+			body += "<Deleted><Key>" + key + "</Key><VersionId>dm</VersionId></Deleted>"
+		}
+		return 200, body + "</DeleteResult>"
+	})
+	s := &S3{Config: &ConfigType{S3bucket: "bucket"}, State: &State, restores: &restoreStats{}, wg: &sync.WaitGroup{}}
+	s.restoreBucket(svc, group)
+	s.wg.Wait()
+	if len(deleted) != 1 || deleted[0] != dir+"guidSplunk-1/bloomfilter" {
+		t.Errorf("expected receipt.json to be withheld when a data file fails, deleted %v", deleted)
+	}
+	if s.restores.partial != 1 || s.restores.complete != 0 || s.restores.failed != 0 {
+		t.Errorf("expected a partial restore, got %+v", *s.restores)
+	}
+}
+
+func TestS3_restoreBucket_archiveTier(t *testing.T) {
+	dir := "s3/path/main/db/0C/F7/275~609B1724-5A77-4C70-81DC-8444B5014D0D/"
+	group := &bucketRestore{Dir: dir}
+	for _, name := range []string{"guidSplunk-1/rawdata/journal.gz", "receipt.json"} {
+		group.Markers = append(group.Markers, &s3.DeleteMarkerEntry{Key: aws.String(dir + name), VersionId: aws.String("dm")})
+	}
+	var deleted []string
+	svc := stubS3Client(t, func(r *request.Request) (int, string) {
+		if r.Operation.Name != "DeleteObjects" {
+			t.Errorf("unexpected %s request", r.Operation.Name)
+			return 500, ""
+		}
+		body := "<DeleteResult>"
+		for _, obj := range r.Params.(*s3.DeleteObjectsInput).Delete.Objects {
+			deleted = append(deleted, aws.StringValue(obj.Key))
+			body += "<Deleted><Key>" + aws.StringValue(obj.Key) + "</Key><VersionId>dm</VersionId></Deleted>"
+		}
+		return 200, body + "</DeleteResult>"
+	})
+	tmp, err := ioutil.TempDir("", "splunks3restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	s := &S3{Config: &ConfigType{S3bucket: "bucket", ArchiveTier: "Bulk"}, State: &State, restores: &restoreStats{}, wg: &sync.WaitGroup{},
+		archive: newArchiveState(filepath.Join(tmp, "archive.state")), rtArchive: routines.New("archive", 1, 1, 16)}
+	s.restoreBucket(svc, group)
+	s.wg.Wait()
+	if len(deleted) != 1 || deleted[0] != dir+"guidSplunk-1/rawdata/journal.gz" {
+		t.Errorf("expected receipt.json to be withheld for archivewait, deleted %v", deleted)
+	}
+	pending, err := s.archive.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0] != (archiveObject{Key: dir + "receipt.json", VersionId: "dm", Receipt: true}) {
+		t.Errorf("expected the receipt marker to be recorded, got %v", pending)
+	}
+	if s.restores.partial != 1 {
+		t.Errorf("expected a partial restore, got %+v", *s.restores)
+	}
+}
@@ -12,11 +12,79 @@ import (
 var Usage = `Restore Splunk files stored on S3 
 
 Usage:
-    splunks3restore restore [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--start=<sdate>] [--end=<edate>] --s3bucket=<s3bucket> [--path=<path>] <bucketid>...
-    splunks3restore restore [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--start=<sdate>] [--end=<edate>] --s3bucket=<s3bucket> [--path=<path>] --bucketids=<bucketids>
-    splunks3restore listver [--verbose] [--rate=<actions>] [--start=<sdate>] [--end=<edate>] --s3bucket=<s3bucket> [--path=<path>] <bucketid>...
-    splunks3restore listver [--verbose] [--rate=<actions>] [--start=<sdate>] [--end=<edate>] --s3bucket=<s3bucket> [--path=<path>] --bucketids=<bucketids>
-    splunks3restore --dateformat
+    splunks3restore restore [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--start=<sdate>] [--end=<edate>] [--tz=<tz>] (--s3bucket=<s3bucket> [--path=<path>] | --splunk-conf=<dir>) [--bucket-type=<type>] [--where=<expr>]
+                            [--include-index=<glob>...] [--exclude-index=<glob>...] [--include-file=<glob>...] [--exclude-file=<glob>...]
+                            [--dryrun] [--zero-frozen] [--sse-c-key=<keyfile>] [--workdir=<dir>] [--backup-prefix=<prefix>] [--archive-tier=<tier> [--archive-days=<days>] [--archive-state=<file>]]
+                            [--max-restores=<n>] [--max-window=<window>] [--yes]
+                            [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                            [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>] <bucketid>...
+    splunks3restore restore [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--start=<sdate>] [--end=<edate>] [--tz=<tz>] (--s3bucket=<s3bucket> [--path=<path>] | --splunk-conf=<dir>) [--bucket-type=<type>] [--where=<expr>]
+                            [--include-index=<glob>...] [--exclude-index=<glob>...] [--include-file=<glob>...] [--exclude-file=<glob>...]
+                            [--dryrun] [--zero-frozen] [--sse-c-key=<keyfile>] [--workdir=<dir>] [--backup-prefix=<prefix>] [--archive-tier=<tier> [--archive-days=<days>] [--archive-state=<file>]]
+                            [--max-restores=<n>] [--max-window=<window>] [--yes]
+                            [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                            [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>] --bucketids=<bucketids>
+    splunks3restore restore --from-trail=<dir> [--principal=<principal>...] [--source-ip=<ip>...] [--user-agent=<agent>...] [--request-id=<id>...] [--include-splunk-deletes]
+                            [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--start=<sdate>] [--end=<edate>] [--tz=<tz>]
+                            (--s3bucket=<s3bucket> [--path=<path>] | --splunk-conf=<dir>) [--where=<expr>]
+                            [--include-index=<glob>...] [--exclude-index=<glob>...] [--include-file=<glob>...] [--exclude-file=<glob>...]
+                            [--dryrun] [--zero-frozen] [--sse-c-key=<keyfile>] [--workdir=<dir>] [--backup-prefix=<prefix>] [--archive-tier=<tier> [--archive-days=<days>] [--archive-state=<file>]]
+                            [--max-restores=<n>] [--max-window=<window>] [--yes]
+                            [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                            [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>]
+    splunks3restore listver [--verbose] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--start=<sdate>] [--end=<edate>] [--tz=<tz>] (--s3bucket=<s3bucket> [--path=<path>] | --splunk-conf=<dir>) [--bucket-type=<type>] [--where=<expr>]
+                            [--include-index=<glob>...] [--exclude-index=<glob>...] [--include-file=<glob>...] [--exclude-file=<glob>...]
+                            [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                            [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>] <bucketid>...
+    splunks3restore listver [--verbose] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--start=<sdate>] [--end=<edate>] [--tz=<tz>] (--s3bucket=<s3bucket> [--path=<path>] | --splunk-conf=<dir>) [--bucket-type=<type>] [--where=<expr>]
+                            [--include-index=<glob>...] [--exclude-index=<glob>...] [--include-file=<glob>...] [--exclude-file=<glob>...]
+                            [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                            [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>] --bucketids=<bucketids>
+    splunks3restore timeline [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--start=<sdate>] [--end=<edate>] [--tz=<tz>] [--resolution=<res>] [--burst-factor=<n>]
+                             (--s3bucket=<s3bucket> [--path=<path>] | --splunk-conf=<dir>) [--bucket-type=<type>] [--where=<expr>]
+                             [--include-index=<glob>...] [--exclude-index=<glob>...] [--include-file=<glob>...] [--exclude-file=<glob>...]
+                             [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                             [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>]
+                             (<bucketid>... | --bucketids=<bucketids> | (--index=<index>)...)
+    splunks3restore fixup [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--dryrun] [--zero-frozen] [--sse-c-key=<keyfile>] [--workdir=<dir>] [--backup-prefix=<prefix>] --s3bucket=<s3bucket> [--path=<path>]
+                          [--set=<assignment>...] [--remove-object=<name>...] [--repair [--rehash]]
+                          [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                          [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>] <bucketid>...
+    splunks3restore fixup [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--dryrun] [--zero-frozen] [--sse-c-key=<keyfile>] [--workdir=<dir>] [--backup-prefix=<prefix>] --s3bucket=<s3bucket> [--path=<path>]
+                          [--set=<assignment>...] [--remove-object=<name>...] [--repair [--rehash]]
+                          [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                          [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>] --bucketids=<bucketids>
+    splunks3restore freeze [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--dryrun] [--sse-c-key=<keyfile>] [--workdir=<dir>] [--backup-prefix=<prefix>] --s3bucket=<s3bucket> [--path=<path>]
+                           [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                           [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>]
+                           (<bucketid>... | --bucketids=<bucketids> | (--index=<index>)...)
+    splunks3restore backups list [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--sse-c-key=<keyfile>] [--backup-prefix=<prefix>] --s3bucket=<s3bucket> [--path=<path>]
+                                     [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                                     [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>]
+                                     (<bucketid>... | --bucketids=<bucketids> | (--index=<index>)...)
+    splunks3restore backups revert --backup=<timestamp> [--dryrun] [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--sse-c-key=<keyfile>] [--backup-prefix=<prefix>] --s3bucket=<s3bucket> [--path=<path>]
+                                     [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                                     [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>]
+                                     (<bucketid>... | --bucketids=<bucketids> | (--index=<index>)...)
+    splunks3restore backups prune --retention=<age> [--dryrun] [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--sse-c-key=<keyfile>] [--backup-prefix=<prefix>] --s3bucket=<s3bucket> [--path=<path>]
+                                     [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                                     [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>]
+                                     (<bucketid>... | --bucketids=<bucketids> | (--index=<index>)...)
+    splunks3restore archivewait [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--poll=<seconds>] [--zero-frozen] [--sse-c-key=<keyfile>] --s3bucket=<s3bucket>
+                                [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                                [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>] --archive-state=<file>
+    splunks3restore receipt-scan [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--sse-c-key=<keyfile>] [--bidfile=<file>] --s3bucket=<s3bucket> [--path=<path>]
+                                 [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                                 [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>] (--index=<index>)...
+    splunks3restore receipt (check|fix|unfreeze) [--outdir=<dir>] <path>...
+    splunks3restore receipt rebuild [--apply] [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--sse-c-key=<keyfile>] [--workdir=<dir>] [--backup-prefix=<prefix>] --s3bucket=<s3bucket> [--path=<path>]
+                                    [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                                    [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>] <bucketid>...
+    splunks3restore receipt rebuild [--apply] [--verbose] [--log=<logfile>] [--logsyslog] [--rate=<actions>] [--op-rate=<budgets>] [--prefix-rate=<budgets>] [--sse-c-key=<keyfile>] [--workdir=<dir>] [--backup-prefix=<prefix>] --s3bucket=<s3bucket> [--path=<path>]
+                                    [--endpoint=<url>] [--region=<region>] [--force-path-style] [--disable-ssl]
+                                    [--aws-profile=<profile>] [--role-arn=<arn> [--external-id=<id>] [--role-session-name=<name>]] [--expected-bucket-owner=<account>] --bucketids=<bucketids>
+    splunks3restore receipt set (--set=<assignment> | --remove-object=<name>)... [--outdir=<dir>] <path>...
+    splunks3restore --dateformat [--start=<sdate>] [--end=<edate>] [--tz=<tz>]
 
 Options:
     -h --help                           Print help
@@ -24,31 +92,177 @@ Options:
     -f --dateformat                     Print help on date formats
     -b --bucketids=<bucketids>          File containing a list of bucket ids
     -p --path=<path>                    Optional path to bucket location
+    --splunk-conf=<dir>                 Splunk home, etc or app directory, or an indexes.conf file. The S3 bucket, path,
+                                        endpoint and region of each index are resolved from its remotePath and volume
+    --bucket-type=<type>                SmartStore trees to restore for each bucket id: db for raw buckets, dma for data
+                                        model acceleration, summary for report acceleration or all. Defaults to db
+    --where=<expr>                      Only select versions and delete markers matching <expr>, e.g.
+                                        'name != "bloomfilter" && size > 0'. Delete markers take size and
+                                        storage_class from the version they hide. See the README for the variables
+    --include-index=<glob>              Only restore or list buckets of indexes matching <glob>, may be repeated
+    --exclude-index=<glob>              Skip buckets of indexes matching <glob>, e.g. _internal, may be repeated
+    --include-file=<glob>               Only restore or list files matching <glob>. Globs with a / match the path
+                                        inside the bucket directory, e.g. rawdata/journal.gz, others the file name
+    --exclude-file=<glob>               Skip files matching <glob>, e.g. bloomfilter, may be repeated
     <bucketid>                          Splunk bucket id(s)
+    <path>                              receipt.json file or a directory which is searched for receipt.json files
+    --outdir=<dir>                      Write fixed receipt.json copies to <dir>, mirroring the original path.
+                                        Without --outdir the receipt command only reports
     -r --rate=<actions>                 Rate limit AWS s3Client calls to <actions> per second.
                                         -1 will disable rate limiting.
                                         0 will set to the default which is 256.
+    --op-rate=<budgets>                 Rate limit per operation class, e.g. list=100,read=500,write=200,delete=200.
+                                        Classes which are not listed are limited by --rate. -1 disables the class limit.
+    --prefix-rate=<budgets>             Additional rate limit per operation class and index/db/XX, dma/XX or
+                                        summary/XX key prefix, e.g. read=5500,write=3500,delete=3500. S3 scales its
+                                        limits per prefix.
     -s --logsyslog                      Log to syslog
     -l --log=<logfile>                  Log to a logfile
     --verbose                           Verbose output
-    -b --start=<sdate>                  Start date
-    -e --end=<edate>                    End date
+    -b --start=<sdate>                  Start date. An absolute date, epoch seconds or a Splunk time modifier,
+                                        e.g. -7d@d, @w1 or -1d@d+8h. See --dateformat
+    -e --end=<edate>                    End date. Defaults to now
+    --tz=<tz>                           Timezone of dates without a zone and of snapping, e.g. UTC or
+                                        America/New_York. Defaults to the local timezone
+    --endpoint=<url>                    Custom S3 endpoint, e.g. https://minio.example.com:9000 for S3-compatible stores
+    --region=<region>                   S3 bucket region. Skips the bucket location lookup
+    --force-path-style                  Use path-style addressing (endpoint/bucket/key) instead of virtual hosted-style
+    --disable-ssl                       Connect to the endpoint over plain HTTP
+    --set=<assignment>                  Set a manifest field, e.g. --set=origin_site=site2. Accepted fields are
+                                        id, path, raw_size, event_count, host_count, source_count, sourcetype_count,
+                                        size_on_disk, modtime, frozen_in_cluster, origin_site, tsidx_minified and
+                                        journal_size. content_hash is recomputed
+    --remove-object=<name>              Remove entries matching the name or glob from the receipt objects list,
+                                        e.g. --remove-object='./guidSplunk-*/bloomfilter'
+    --from-trail=<dir>                  Restore the delete markers created by the deletes recorded in the CloudTrail
+                                        JSON files (.json, .json.gz) and S3 server access logs below <dir>
+    --principal=<principal>             Only restore deletes by principals matching the wildcard, e.g.
+                                        'arn:aws:sts::123456789012:assumed-role/cleanup/*'. May be repeated
+    --source-ip=<ip>                    Only restore deletes from the IP address or CIDR, may be repeated
+    --user-agent=<agent>                Only restore deletes with a user agent matching the wildcard, may be repeated
+    --request-id=<id>                   Only restore deletes of the request ID, may be repeated
+    --include-splunk-deletes            Also restore trail deletes with a Splunk/ user agent, which are SmartStore
+                                        evictions and freezing and are skipped by default
+    --index=<index>                     Index to scan, freeze or manage backups of, may be repeated
+    --resolution=<res>                  Width of the timeline histogram slots, e.g. 15m, 1h or 1d. Defaults to 1h
+    --burst-factor=<n>                  Flag timeline slots with more delete markers than the median plus <n> median
+                                        absolute deviations as bursts. Defaults to 5
+    --bidfile=<file>                    Write the bucket ids of receipts which need fixing to <file>, for use with --bucketids
+    --backup-prefix=<prefix>            Write receipt.json backups under <prefix>/<key>.<YYYYmmddHHMMSS> instead of next to
+                                        the receipt inside the SmartStore tree. backups reads them from the same place
+    --backup=<timestamp>                Backup to revert to, the YYYYmmddHHMMSS suffix of the backup or latest.
+                                        The backup must have a valid content_hash
+    --retention=<age>                   Prune backups older than <age>, e.g. 30d or 12h
+    --apply                             Upload the receipts rebuilt by receipt rebuild. Without --apply it is a dry run
+    --repair                            Revert receipt.json files with an invalid content_hash to the most recent
+                                        version which has a valid hash and whose objects are all in S3
+    --rehash                            Recompute content_hash when --repair finds no good version
+    --max-restores=<n>                  Abort a restore whose pre-scan finds more than <n> delete markers unless --yes
+                                        is given
+    --max-window=<window>               Reject a restore whose --start to --end window is longer than <window>, e.g.
+                                        7d or 36h
+    --yes                               Restore without asking for confirmation after the pre-scan and without
+                                        checking --max-restores. The confirmation is only asked on a terminal
+    --dryrun                            Show what would be restored or fixed without making changes. Receipt
+                                        fixups print a field level diff of each receipt which would change
+    --zero-frozen                       Reset frozen_in_cluster to 0 in restored or fixed receipt.json files
+    --workdir=<dir>                     Keep local copies of the original and fixed receipt.json files in a
+                                        directory unique to the run inside <dir>. Fixups are done in memory
+                                        and nothing is written locally unless --workdir is set
+    --sse-c-key=<keyfile>               File containing the SSE-C key of the receipt.json objects, raw or base64 encoded
+    --archive-tier=<tier>               Restore surfaced versions stored in GLACIER, DEEP_ARCHIVE or Intelligent-Tiering
+                                        archive tiers using the Standard, Bulk or Expedited retrieval tier. Expedited
+                                        is only offered for GLACIER, other classes fall back to Standard
+    --archive-days=<days>               Number of days to keep restored archive copies. Defaults to 7
+    --archive-state=<file>              File recording pending archive restores. Used by archivewait to resume
+                                        waiting. Defaults to a file in $TMPDIR
+    --poll=<seconds>                    Seconds between checks of pending archive restores. Defaults to 300
+    --aws-profile=<profile>             Use a named profile from the shared AWS config and credentials files
+    --role-arn=<arn>                    Assume this IAM role. Credentials are refreshed automatically before they expire
+    --external-id=<id>                  External ID passed when assuming --role-arn
+    --role-session-name=<name>          Session name used when assuming --role-arn. Defaults to splunks3restore
+    --expected-bucket-owner=<account>   AWS account ID that must own the S3 bucket. Sent on every request
 `
 
 type OptUsage struct {
 	Restore       bool     `docopt:"restore"`
 	ListVer       bool     `docopt:"listver"`
+	Timeline      bool     `docopt:"timeline"`
+	Resolution    string   `docopt:"--resolution"`
+	BurstFactor   string   `docopt:"--burst-factor"`
+	Fixup         bool     `docopt:"fixup"`
+	ArchiveWait   bool     `docopt:"archivewait"`
+	Receipt       bool     `docopt:"receipt"`
+	Check         bool     `docopt:"check"`
+	Fix           bool     `docopt:"fix"`
+	Unfreeze      bool     `docopt:"unfreeze"`
+	Set           bool     `docopt:"set"`
+	Rebuild       bool     `docopt:"rebuild"`
+	Freeze        bool     `docopt:"freeze"`
+	Backups       bool     `docopt:"backups"`
+	List          bool     `docopt:"list"`
+	Revert        bool     `docopt:"revert"`
+	Prune         bool     `docopt:"prune"`
+	BackupPrefix  string   `docopt:"--backup-prefix"`
+	BackupStamp   string   `docopt:"--backup"`
+	Retention     string   `docopt:"--retention"`
+	ReceiptScan   bool     `docopt:"receipt-scan"`
+	Indexes       []string `docopt:"--index"`
+	BidFile       string   `docopt:"--bidfile"`
+	Apply         bool     `docopt:"--apply"`
+	Assignments   []string `docopt:"--set"`
+	RemoveObjects []string `docopt:"--remove-object"`
+	ReceiptPaths  []string `docopt:"<path>"`
+	OutDir        string   `docopt:"--outdir"`
+	ArchiveTier   string   `docopt:"--archive-tier"`
+	ArchiveDays   int64    `docopt:"--archive-days"`
+	ArchiveState  string   `docopt:"--archive-state"`
+	Poll          int64    `docopt:"--poll"`
+	ZeroFrozen    bool     `docopt:"--zero-frozen"`
+	DryRun        bool     `docopt:"--dryrun"`
+	Repair        bool     `docopt:"--repair"`
+	Rehash        bool     `docopt:"--rehash"`
+	SSECKeyFile   string   `docopt:"--sse-c-key"`
+	WorkDir       string   `docopt:"--workdir"`
 	Path          string   `docopt:"--path"`
+	SplunkConf    string   `docopt:"--splunk-conf"`
+	FromTrail     string   `docopt:"--from-trail"`
+	MaxRestores   string   `docopt:"--max-restores"`
+	MaxWindow     string   `docopt:"--max-window"`
+	Yes           bool     `docopt:"--yes"`
+	Principals    []string `docopt:"--principal"`
+	SourceIPs     []string `docopt:"--source-ip"`
+	UserAgents    []string `docopt:"--user-agent"`
+	RequestIDs    []string `docopt:"--request-id"`
+	SplunkDeletes bool     `docopt:"--include-splunk-deletes"`
+	BucketType    string   `docopt:"--bucket-type"`
+	Where         string   `docopt:"--where"`
+	IncludeIdx    []string `docopt:"--include-index"`
+	ExcludeIdx    []string `docopt:"--exclude-index"`
+	IncludeFiles  []string `docopt:"--include-file"`
+	ExcludeFiles  []string `docopt:"--exclude-file"`
 	BucketIdsFile string   `docopt:"--bucketids"`
 	BucketIds     []string `docopt:"<bucketid>"`
 	Datehelp      bool     `docopt:"--dateformat"`
 	Verbose       bool     `docopt:"--verbose"`
 	Logfile       string   `docopt:"--log"`
 	RateLimit     float64  `docopt:"--rate"`
+	OpRate        string   `docopt:"--op-rate"`
+	PrefixRate    string   `docopt:"--prefix-rate"`
 	S3bucket      string   `docopt:"--s3bucket"`
 	Syslog        bool     `docopt:"--logsyslog"`
 	Fromdate      string   `docopt:"--start"`
 	Todate        string   `docopt:"--end"`
+	TZ            string   `docopt:"--tz"`
+	Endpoint      string   `docopt:"--endpoint"`
+	Region        string   `docopt:"--region"`
+	PathStyle     bool     `docopt:"--force-path-style"`
+	DisableSSL    bool     `docopt:"--disable-ssl"`
+	Profile       string   `docopt:"--aws-profile"`
+	RoleArn       string   `docopt:"--role-arn"`
+	ExternalID    string   `docopt:"--external-id"`
+	RoleSession   string   `docopt:"--role-session-name"`
+	BucketOwner   string   `docopt:"--expected-bucket-owner"`
 }
 
 func GetUsage(args []string, version string) *Runner {
@@ -2,8 +2,15 @@ package internal
 
 import (
 	"testing"
+	"time"
 )
 
+// withTestingMode makes Exit panic instead of exiting the test binary, the returned func restores the mode
+func withTestingMode() func() {
+	Mode = Ttesting
+	return func() { Mode = Tnone }
+}
+
 func TestGetUsage_restore_1(t *testing.T) {
 	args := []string{"restore", "--log", "/var/log/restore.log", "--rate", "256", "--start", "now-1hr", "--end", "now", "--s3bucket", "splunks3restore", "--path", "some/path", "index~ID1", "index~ID2"}
 	opts := GetUsage(args, "1.0.0")
@@ -30,4 +37,87 @@ func TestGetUsage_restore_1(t *testing.T) {
 	if minutes != 60 {
 		t.Fail()
 	}
-}
\ No newline at end of file
+}
+
+func TestGetUsage_endpoint(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"listver", "--start", "-1h", "--end", "now", "--s3bucket", "splunks3restore", "--endpoint", "http://127.0.0.1:9000", "--region", "us-west-2", "--force-path-style", "--disable-ssl", "index~ID1"}
+	opts := GetUsage(args, "1.0.0")
+	if opts.Config.Endpoint != "http://127.0.0.1:9000" {
+		t.Errorf("unexpected endpoint %s", opts.Config.Endpoint)
+	}
+	if opts.Config.GetBucketRegion() != "us-west-2" {
+		t.Errorf("expected --region to skip the bucket location lookup")
+	}
+	config := opts.Config.AWSConfig(opts.Config.GetBucketRegion())
+	if !*config.S3ForcePathStyle || !*config.DisableSSL || *config.Endpoint != "http://127.0.0.1:9000" {
+		t.Errorf("endpoint settings were not applied to the aws config")
+	}
+}
+
+func TestGetUsage_repair(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"fixup", "--s3bucket", "splunks3restore", "--region", "us-west-2", "--repair", "--rehash", "--dryrun", "index~ID1"}
+	opts := GetUsage(args, "1.0.0")
+	if !opts.Config.Fixup || !opts.Config.Repair || !opts.Config.Rehash || !opts.Config.DryRun {
+		t.Errorf("expected fixup --repair --rehash --dryrun to be set")
+	}
+}
+
+func TestGetUsage_freeze(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"freeze", "--s3bucket", "splunks3restore", "--region", "us-west-2", "--index", "main"}
+	opts := GetUsage(args, "1.0.0")
+	if !opts.Config.Freeze || !opts.Config.Fixup || len(opts.Config.Indexes) != 1 {
+		t.Errorf("expected freeze to run as a fixup over --index")
+	}
+}
+
+func TestGetUsage_window(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"listver", "--start", "2020-01-02", "--end", "2020-01-03", "--tz", "UTC", "--s3bucket", "splunks3restore", "index~ID1"}
+	opts := GetUsage(args, "1.0.0")
+	if opts.Config.FromDate.Format(time.RFC3339) != "2020-01-02T00:00:00Z" || opts.Config.ToDate.Format(time.RFC3339) != "2020-01-03T00:00:00Z" {
+		t.Errorf("unexpected window %s", opts.Config.Window())
+	}
+	for _, args := range [][]string{
+		{"listver", "--start", "2020-01-03", "--end", "2020-01-02", "--s3bucket", "splunks3restore", "index~ID1"},
+		{"listver", "--start", "yesterday", "--s3bucket", "splunks3restore", "index~ID1"},
+		{"listver", "--s3bucket", "splunks3restore", "index~ID1"},
+		{"listver", "--start", "-1d", "--tz", "Nowhere/Special", "--s3bucket", "splunks3restore", "index~ID1"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected %v to be rejected", args)
+				}
+			}()
+			GetUsage(args, "1.0.0")
+		}()
+	}
+}
+
+func TestGetUsage_where(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"restore", "--start", "-1d", "--s3bucket", "splunks3restore", "--where", `name != "bloomfilter" && size > 0`, "index~ID1"}
+	opts := GetUsage(args, "1.0.0")
+	if opts.Config.Where == nil || opts.Config.Where.String() != `name != "bloomfilter" && size > 0` {
+		t.Errorf("expected --where to be compiled")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected an invalid --where to be rejected")
+		}
+	}()
+	GetUsage([]string{"listver", "--start", "-1d", "--s3bucket", "splunks3restore", "--where", "size > \"big\"", "index~ID1"}, "1.0.0")
+}
+
+func TestGetUsage_scope(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"restore", "--start", "-1d", "--s3bucket", "splunks3restore", "--exclude-index", "_internal,_audit",
+		"--include-file", "receipt.json", "--include-file", "rawdata/journal.gz", "index~ID1"}
+	opts := GetUsage(args, "1.0.0")
+	if len(opts.Config.ExcludeIndexes) != 2 || len(opts.Config.IncludeFiles) != 2 || len(opts.Config.IncludeIndexes) != 0 {
+		t.Errorf("unexpected scope %v %v", opts.Config.ExcludeIndexes, opts.Config.IncludeFiles)
+	}
+}
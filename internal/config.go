@@ -1,14 +1,24 @@
 package internal
 
 import (
+	"encoding/base64"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/receipt"
+	"github.com/crosseyed/splunks3restore/internal/where"
+	"github.com/karrick/tparse"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,32 +33,134 @@ type ConfigType struct {
 	RestoreListFile string
 	S3bucket        string
 	Path            string
+	Endpoint        string
+	Region          string
+	Profile         string
+	RoleArn         string
+	ExternalID      string
+	RoleSession     string
+	BucketOwner     string
+	SSECustomerKey  string
+	ArchiveTier     string
+	ArchiveState    string
+	WorkDir         string
+	ReceiptAction   string
+	OutDir          string
+	ReceiptPaths    []string
+	Indexes         []string
+	BucketTypes     []string
+	IncludeIndexes  []string
+	ExcludeIndexes  []string
+	IncludeFiles    []string
+	ExcludeFiles    []string
+	BidFile         string
+	BackupAction    string
+	BackupPrefix    string
+	BackupStamp     string
+	Edits           []receipt.Edit
 	bucketRegion    string
 	BucketIds       []string
 	DateHelp        bool
+	DisableSSL      bool
 	DryRun          bool
 	Fixup           bool
 	Restore         bool
 	ListVer         bool
+	Timeline        bool
+	PathStyle       bool
 	Syslog          bool
 	Verbose         bool
 	ZeroFrozen      bool
+	Repair          bool
+	Rehash          bool
+	Rebuild         bool
+	Freeze          bool
+	Backups         bool
+	ReceiptScan     bool
+	ArchiveWait     bool
+	Receipt         bool
 	RateLimit       float64
+	OpRates         map[OpClass]float64
+	PrefixRates     map[OpClass]float64
+	ArchiveDays     int64
+	PruneBefore     time.Time
+	PollInterval    time.Duration
+	Resolution      time.Duration
+	BurstFactor     float64
+	Location        *time.Location
+	Where           *where.Expr
+	SplunkConf      string
+	FromTrail       string
+	TrailFilter     trailFilter
+	SplunkDeletes   bool
+	MaxRestores     int64
+	MaxWindow       time.Duration
+	Yes             bool
+	IndexLocations  map[string]IndexLocation
 }
 
 func (c *ConfigType) Load(opts *OptUsage) {
-	from, err := ParseTime(opts.Fromdate)
+	c.loadWindow(opts)
+	var err error
+	if opts.SSECKeyFile != "" {
+		key, err := readSSECustomerKey(opts.SSECKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can not read SSE-C key from %s: %v\n", opts.SSECKeyFile, err)
+			Exit(-1)
+		}
+		c.SSECustomerKey = key
+	}
+	c.loadArchive(opts)
+	c.OpRates, err = ParseRateBudgets(opts.OpRate)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unrecognised <fromdate> format %s", opts.Fromdate)
+		fmt.Fprintf(os.Stderr, "Unrecognised --op-rate: %v\n", err)
+		Exit(-1)
 	}
-	to, err := ParseTime(opts.Todate)
+	c.PrefixRates, err = ParseRateBudgets(opts.PrefixRate)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unrecognised <todate> format %s", opts.Todate)
+		fmt.Fprintf(os.Stderr, "Unrecognised --prefix-rate: %v\n", err)
+		Exit(-1)
 	}
 	c.Verbose = opts.Verbose
 	c.DateHelp = opts.Datehelp
-	c.FromDate = from
 	c.ListVer = opts.ListVer
+	c.loadTimeline(opts)
+	c.Fixup = opts.Fixup
+	c.WorkDir = opts.WorkDir
+	c.Receipt = opts.Receipt
+	c.ReceiptPaths = opts.ReceiptPaths
+	c.OutDir = opts.OutDir
+	switch {
+	case opts.Check:
+		c.ReceiptAction = "check"
+	case opts.Fix:
+		c.ReceiptAction = "fix"
+	case opts.Unfreeze:
+		c.ReceiptAction = "unfreeze"
+	case opts.Set:
+		c.ReceiptAction = "set"
+	}
+	c.loadEdits(opts)
+	c.ZeroFrozen = opts.ZeroFrozen
+	c.DryRun = opts.DryRun
+	c.Repair = opts.Repair
+	c.Rehash = opts.Rehash
+	c.ReceiptScan = opts.ReceiptScan
+	c.Indexes = opts.Indexes
+	c.BidFile = opts.BidFile
+	c.Freeze = opts.Freeze
+	if c.Freeze {
+		// freeze uses the fixup backup-then-upload path
+		c.Fixup = true
+	}
+	c.loadBackups(opts)
+	c.Rebuild = opts.Rebuild
+	if c.Rebuild {
+		// receipt rebuild needs S3 and runs through the fixup workers, dry run unless --apply is given
+		c.Receipt = false
+		c.Fixup = true
+		c.DryRun = !opts.Apply
+	}
 	c.LogFile = opts.Logfile
 	c.BucketIdsFile = opts.BucketIdsFile
 	c.BucketIds = opts.BucketIds
@@ -56,20 +168,373 @@ func (c *ConfigType) Load(opts *OptUsage) {
 	c.Restore = opts.Restore
 	c.S3bucket = opts.S3bucket
 	c.Path = opts.Path
+	c.BucketTypes, err = ParseBucketTypes(opts.BucketType)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unrecognised --bucket-type: %v\n", err)
+		Exit(-1)
+	}
+	c.loadScope(opts)
+	c.Where = nil
+	if opts.Where != "" {
+		c.Where, err = compileWhere(opts.Where, c.Location)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unrecognised --where %s: %v\n", opts.Where, err)
+			Exit(-1)
+		}
+	}
+	c.loadSplunkConf(opts)
+	c.FromTrail = opts.FromTrail
+	c.SplunkDeletes = opts.SplunkDeletes
+	c.TrailFilter, err = parseTrailFilter(opts.Principals, opts.SourceIPs, opts.UserAgents, opts.RequestIDs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unrecognised %v\n", err)
+		Exit(-1)
+	}
+	c.loadSafeguards(opts)
+	c.Endpoint = opts.Endpoint
+	c.Region = opts.Region
+	c.PathStyle = opts.PathStyle
+	c.DisableSSL = opts.DisableSSL
+	c.Profile = opts.Profile
+	c.RoleArn = opts.RoleArn
+	c.ExternalID = opts.ExternalID
+	c.RoleSession = opts.RoleSession
+	c.BucketOwner = opts.BucketOwner
+}
+
+// loadWindow resolves --start and --end in the --tz location. --end defaults to now. Commands which select
+// versions by date need a valid --start before --end.
+func (c *ConfigType) loadWindow(opts *OptUsage) {
+	c.Location = time.Local
+	if opts.TZ != "" {
+		loc, err := time.LoadLocation(opts.TZ)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unrecognised --tz %s: %v\n", opts.TZ, err)
+			Exit(-1)
+		}
+		c.Location = loc
+	}
+	now := time.Now()
+	c.FromDate = time.Time{}
+	if opts.Fromdate == "" && (opts.Restore && opts.FromTrail == "" || opts.ListVer || opts.Timeline) {
+		fmt.Fprintf(os.Stderr, "--start is required\n")
+		Exit(-1)
+	}
+	if opts.Fromdate != "" {
+		from, err := ParseTimeIn(opts.Fromdate, now, c.Location)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unrecognised --start %s: %v\n", opts.Fromdate, err)
+			Exit(-1)
+		}
+		c.FromDate = from
+	}
+	todate := opts.Todate
+	if todate == "" {
+		todate = "now"
+	}
+	to, err := ParseTimeIn(todate, now, c.Location)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unrecognised --end %s: %v\n", opts.Todate, err)
+		Exit(-1)
+	}
 	c.ToDate = to
+	if !c.FromDate.IsZero() && !c.FromDate.Before(c.ToDate) {
+		fmt.Fprintf(os.Stderr, "--start %s (%s) must be before --end %s (%s)\n",
+			opts.Fromdate, c.FromDate.Format(time.RFC3339), todate, c.ToDate.Format(time.RFC3339))
+		Exit(-1)
+	}
+}
+
+// loadSafeguards validates --max-restores and --max-window and rejects restore windows longer than --max-window
+func (c *ConfigType) loadSafeguards(opts *OptUsage) {
+	c.Yes = opts.Yes
+	c.MaxRestores = 0
+	if opts.MaxRestores != "" {
+		n, err := strconv.ParseInt(opts.MaxRestores, 10, 64)
+		if err != nil || n <= 0 {
+			fmt.Fprintf(os.Stderr, "Unrecognised --max-restores %s, expecting a positive number\n", opts.MaxRestores)
+			Exit(-1)
+		}
+		c.MaxRestores = n
+	}
+	c.MaxWindow = 0
+	if opts.MaxWindow == "" {
+		return
+	}
+	window, err := parseResolution(opts.MaxWindow)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unrecognised --max-window %s: %v\n", opts.MaxWindow, err)
+		Exit(-1)
+	}
+	c.MaxWindow = window
+	if opts.Restore && !c.FromDate.IsZero() && c.ToDate.Sub(c.FromDate) > c.MaxWindow {
+		fmt.Fprintf(os.Stderr, "--start %s to --end %s is longer than --max-window %s\n",
+			c.FromDate.Format(time.RFC3339), c.ToDate.Format(time.RFC3339), opts.MaxWindow)
+		Exit(-1)
+	}
+}
+
+// Window describes the resolved --start and --end for log lines
+func (c *ConfigType) Window() string {
+	return fmt.Sprintf("start=\"%s\" end=\"%s\" tz=%s",
+		c.FromDate.Format(time.RFC3339), c.ToDate.Format(time.RFC3339), c.Location)
+}
+
+// loadTimeline validates --resolution and --burst-factor. The --start and --end window may span at most
+// timelineMaxSlots slots.
+func (c *ConfigType) loadTimeline(opts *OptUsage) {
+	c.Timeline = opts.Timeline
+	resolution, err := parseResolution(opts.Resolution)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unrecognised --resolution %s: %v\n", opts.Resolution, err)
+		Exit(-1)
+	}
+	c.Resolution = resolution
+	if c.Timeline && c.ToDate.Sub(c.FromDate)/resolution > timelineMaxSlots {
+		fmt.Fprintf(os.Stderr, "--start to --end spans more than %d slots of %s, use a wider --resolution\n",
+			timelineMaxSlots, resolution)
+		Exit(-1)
+	}
+	c.BurstFactor = timelineDefaultBurstFactor
+	if opts.BurstFactor != "" {
+		factor, err := strconv.ParseFloat(opts.BurstFactor, 64)
+		if err != nil || factor <= 0 {
+			fmt.Fprintf(os.Stderr, "Unrecognised --burst-factor %s, expecting a positive number\n", opts.BurstFactor)
+			Exit(-1)
+		}
+		c.BurstFactor = factor
+	}
+}
+
+// loadScope validates the --include and --exclude globs
+func (c *ConfigType) loadScope(opts *OptUsage) {
+	for _, scope := range []struct {
+		option string
+		values []string
+		globs  *[]string
+	}{
+		{"--include-index", opts.IncludeIdx, &c.IncludeIndexes},
+		{"--exclude-index", opts.ExcludeIdx, &c.ExcludeIndexes},
+		{"--include-file", opts.IncludeFiles, &c.IncludeFiles},
+		{"--exclude-file", opts.ExcludeFiles, &c.ExcludeFiles},
+	} {
+		globs, err := parseGlobs(scope.values)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unrecognised %s %v\n", scope.option, err)
+			Exit(-1)
+		}
+		*scope.globs = globs
+	}
+}
+
+// loadSplunkConf resolves the index locations of --splunk-conf. Indexes whose remotePath can not be resolved are
+// reported and left out.
+func (c *ConfigType) loadSplunkConf(opts *OptUsage) {
+	c.SplunkConf = opts.SplunkConf
+	c.IndexLocations = nil
+	if c.SplunkConf == "" {
+		return
+	}
+	conf, err := LoadIndexesConf(c.SplunkConf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can not read --splunk-conf %s: %v\n", c.SplunkConf, err)
+		Exit(-1)
+	}
+	locations, errs := conf.IndexLocations()
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "Skipping index in --splunk-conf %s: %v\n", c.SplunkConf, err)
+	}
+	if len(locations) == 0 {
+		fmt.Fprintf(os.Stderr, "No SmartStore indexes found in --splunk-conf %s\n", c.SplunkConf)
+		Exit(-1)
+	}
+	c.IndexLocations = locations
+}
+
+// loadArchive validates and defaults the archive restore options
+func (c *ConfigType) loadArchive(opts *OptUsage) {
+	c.ArchiveWait = opts.ArchiveWait
+	if opts.ArchiveTier != "" {
+		tier, ok := archiveTiers[strings.ToLower(opts.ArchiveTier)]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "Unrecognised archive tier %s, expecting Standard, Bulk or Expedited\n", opts.ArchiveTier)
+			Exit(-1)
+		}
+		c.ArchiveTier = tier
+	}
+	c.ArchiveDays = opts.ArchiveDays
+	if c.ArchiveDays <= 0 {
+		c.ArchiveDays = archiveDefaultDays
+	}
+	c.PollInterval = time.Duration(opts.Poll) * time.Second
+	if c.PollInterval <= 0 {
+		c.PollInterval = archiveDefaultPoll
+	}
+	c.ArchiveState = opts.ArchiveState
+	if c.ArchiveState == "" && c.ArchiveTier != "" {
+		td := os.Getenv("TMPDIR")
+		if td == "" {
+			td = "/tmp"
+		}
+		c.ArchiveState = filepath.Join(td, fmt.Sprintf("splunks3restore-archive-%s.state", time.Now().Format("20060102150405")))
+	}
+}
+
+// loadBackups sets the backups action, where backups are kept and the prune retention
+func (c *ConfigType) loadBackups(opts *OptUsage) {
+	c.Backups = opts.Backups
+	c.BackupPrefix = opts.BackupPrefix
+	c.BackupStamp = opts.BackupStamp
+	c.BackupAction = ""
+	switch {
+	case !opts.Backups:
+	case opts.List:
+		c.BackupAction = "list"
+	case opts.Revert:
+		c.BackupAction = "revert"
+	case opts.Prune:
+		c.BackupAction = "prune"
+	}
+	if c.BackupStamp != "" && c.BackupStamp != "latest" {
+		if _, err := time.Parse(backupTimeFormat, c.BackupStamp); err != nil {
+			fmt.Fprintf(os.Stderr, "Unrecognised --backup %s, expecting YYYYmmddHHMMSS or latest\n", c.BackupStamp)
+			Exit(-1)
+		}
+	}
+	c.PruneBefore = time.Time{}
+	if opts.Retention != "" {
+		before, err := tparse.AddDuration(time.Now(), "-"+strings.TrimPrefix(opts.Retention, "-"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unrecognised --retention %s: %v\n", opts.Retention, err)
+			Exit(-1)
+		}
+		c.PruneBefore = before
+	}
+}
+
+// loadEdits validates the --set and --remove-object receipt edits
+func (c *ConfigType) loadEdits(opts *OptUsage) {
+	c.Edits = nil
+	for _, assignment := range opts.Assignments {
+		edit, err := receipt.ParseEdit(assignment)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --set: %v\n", err)
+			Exit(-1)
+		}
+		c.Edits = append(c.Edits, edit)
+	}
+	for _, name := range opts.RemoveObjects {
+		edit, err := receipt.RemoveObjectEdit(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --remove-object: %v\n", err)
+			Exit(-1)
+		}
+		c.Edits = append(c.Edits, edit)
+	}
+}
+
+// readSSECustomerKey reads a 256 bit SSE-C key stored either raw or base64 encoded in fpath
+func readSSECustomerKey(fpath string) (string, error) {
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return "", err
+	}
+	if len(content) == 32 {
+		return string(content), nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return "", fmt.Errorf("key is neither 32 raw bytes nor base64 encoded: %v", err)
+	}
+	if len(key) != 32 {
+		return "", fmt.Errorf("expected a 256 bit key, got %d bits", len(key)*8)
+	}
+	return string(key), nil
 }
 
+// AWSConfig returns the aws.Config used by every S3 client for the given region
+func (c *ConfigType) AWSConfig(region string) *aws.Config {
+	config := &aws.Config{
+		Region:           aws.String(region),
+		S3ForcePathStyle: aws.Bool(c.PathStyle),
+		DisableSSL:       aws.Bool(c.DisableSSL),
+	}
+	if c.Endpoint != "" {
+		config.Endpoint = aws.String(c.Endpoint)
+	}
+	return config
+}
+
+// baseSession creates an AWS session for region using the configured profile. It has none of the S3 endpoint
+// settings so STS requests for --role-arn go to STS rather than to --endpoint.
+func (c *ConfigType) baseSession(region string) (*session.Session, error) {
+	return session.NewSessionWithOptions(session.Options{
+		Config:            aws.Config{Region: aws.String(region)},
+		Profile:           c.Profile,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+}
+
+// NewSession creates an AWS session for region using the configured profile, role and bucket owner
+func (c *ConfigType) NewSession(region string) (*session.Session, error) {
+	base, err := c.baseSession(region)
+	if err != nil {
+		return nil, err
+	}
+	sess := base.Copy(c.AWSConfig(region))
+	if c.RoleArn != "" {
+		sessionName := c.RoleSession
+		if sessionName == "" {
+			sessionName = "splunks3restore"
+		}
+		// The provider re-assumes the role ExpiryWindow before the credentials expire
+		creds := stscreds.NewCredentials(base, c.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = sessionName
+			p.ExpiryWindow = 5 * time.Minute
+			if c.ExternalID != "" {
+				p.ExternalID = aws.String(c.ExternalID)
+			}
+		})
+		sess = sess.Copy(&aws.Config{Credentials: creds})
+	}
+	if c.BucketOwner != "" {
+		sess.Handlers.Build.PushBackNamed(expectedBucketOwnerHandler(c.BucketOwner))
+	}
+	return sess, nil
+}
+
+// expectedBucketOwnerHandler makes S3 reject requests against buckets that are not owned by account
+func expectedBucketOwnerHandler(account string) request.NamedHandler {
+	return request.NamedHandler{
+		Name: "splunks3restore.ExpectedBucketOwner",
+		Fn: func(r *request.Request) {
+			r.HTTPRequest.Header.Set("x-amz-expected-bucket-owner", account)
+			if r.Operation.Name == "CopyObject" {
+				r.HTTPRequest.Header.Set("x-amz-source-expected-bucket-owner", account)
+			}
+		},
+	}
+}
+
+// GetBucketRegion returns the --region setting or looks up the region of the S3 bucket
 func (c *ConfigType) GetBucketRegion() string {
 	if c.bucketRegion != "" {
 		return c.bucketRegion
 	}
+	if c.Region != "" {
+		c.bucketRegion = c.Region
+		return c.bucketRegion
+	}
 	defaultregion := os.Getenv("AWS_DEFAULT_REGION")
 	if defaultregion == "" {
 		defaultregion = "us-east-1"
 	}
-	svc := s3.New(session.New(&aws.Config{
-		Region: aws.String(defaultregion),
-	}))
+	sess, err := c.NewSession(defaultregion)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating AWS session: %v\n", err)
+		Exit(-1)
+	}
+	svc := s3.New(sess)
 	input := &s3.GetBucketLocationInput{
 		Bucket: aws.String(c.S3bucket),
 	}
@@ -82,7 +547,7 @@ func (c *ConfigType) GetBucketRegion() string {
 				fmt.Fprintf(os.Stderr, "Error while getting Bucket location for \"%s\": %v\n", c.S3bucket, aerr.Error())
 			}
 		} else {
-			fmt.Fprintf(os.Stderr, "Error while getting Bucket location for \"%s\": %v\n", c.S3bucket, aerr.Error())
+			fmt.Fprintf(os.Stderr, "Error while getting Bucket location for \"%s\": %v\n", c.S3bucket, err)
 		}
 		Exit(-1)
 	}
@@ -90,13 +555,16 @@ func (c *ConfigType) GetBucketRegion() string {
 		fmt.Fprintf(os.Stderr, "Error while getting Bucket location for \"%s\": No results returned\n", c.S3bucket)
 		Exit(-1)
 	}
-	c.bucketRegion = *result.LocationConstraint
+	// us-east-1 buckets return an empty LocationConstraint
+	c.bucketRegion = s3.NormalizeBucketLocation(aws.StringValue(result.LocationConstraint))
 	return c.bucketRegion
 }
 
 type StateStruct struct {
 	pid     int
 	tempdir string
+	rundir  string
+	mu      sync.Mutex
 }
 
 func (s *StateStruct) Pid() int {
@@ -107,16 +575,12 @@ func (s *StateStruct) Pid() int {
 	return s.pid
 }
 
-// TempDir returns path to a temporary directory
+// TempDir returns path to a temporary directory. TMPDIR is honoured.
 func (s *StateStruct) TempDir() string {
 	if s.tempdir != "" {
 		return s.tempdir
 	}
-	tmpdir := os.Getenv("TEMP")
-	if tmpdir == "" {
-		tmpdir = "/tmp"
-	}
-	dir, err := ioutil.TempDir(tmpdir, "splunks3restore")
+	dir, err := ioutil.TempDir("", "splunks3restore")
 	if err != nil {
 		log.Print(err)
 		Exit(-1)
@@ -124,3 +588,21 @@ func (s *StateStruct) TempDir() string {
 	s.tempdir = dir
 	return s.tempdir
 }
+
+// RunDir returns a directory inside base which is unique to this run so concurrent runs do not share files
+func (s *StateStruct) RunDir(base string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rundir != "" {
+		return s.rundir, nil
+	}
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", err
+	}
+	dir, err := ioutil.TempDir(base, fmt.Sprintf("splunks3restore-%s-", time.Now().Format("20060102150405")))
+	if err != nil {
+		return "", err
+	}
+	s.rundir = dir
+	return s.rundir, nil
+}
@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"strings"
+	"testing"
+)
+
+func TestConfigType_NewSession_BucketOwner(t *testing.T) {
+	c := &ConfigType{BucketOwner: "111122223333", Region: "us-west-2"}
+	sess, err := c.NewSession(c.GetBucketRegion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := s3.New(sess)
+	req, _ := svc.CopyObjectRequest(&s3.CopyObjectInput{
+		Bucket:     aws.String("bucket"),
+		CopySource: aws.String("/bucket/src"),
+		Key:        aws.String("dst"),
+	})
+	if err := req.Build(); err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range []string{"x-amz-expected-bucket-owner", "x-amz-source-expected-bucket-owner"} {
+		if got := req.HTTPRequest.Header.Get(header); got != "111122223333" {
+			t.Errorf("expected header %s to be set, got \"%s\"", header, got)
+		}
+	}
+}
+
+func TestConfigType_NewSession_endpointRole(t *testing.T) {
+	c := &ConfigType{Endpoint: "http://127.0.0.1:9000", RoleArn: "arn:aws:iam::111122223333:role/restore", Region: "us-west-2"}
+	sess, err := c.NewSession(c.GetBucketRegion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint := s3.New(sess).Endpoint; endpoint != "http://127.0.0.1:9000" {
+		t.Errorf("expected S3 requests to use --endpoint, got %s", endpoint)
+	}
+	base, err := c.baseSession(c.GetBucketRegion())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint := sts.New(base).Endpoint; !strings.Contains(endpoint, "sts") {
+		t.Errorf("expected AssumeRole to go to STS, got %s", endpoint)
+	}
+}
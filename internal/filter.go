@@ -0,0 +1,212 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/where"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// whereDecls are the variables available to --where expressions
+var whereDecls = where.Decls{
+	"key":              where.String,
+	"name":             where.String,
+	"index":            where.String,
+	"bucket":           where.String,
+	"version_id":       where.String,
+	"storage_class":    where.String,
+	"last_modified":    where.Time,
+	"size":             where.Int,
+	"is_latest":        where.Bool,
+	"is_delete_marker": where.Bool,
+}
+
+// compileWhere compiles a --where expression. Time literals accept the same formats as --start and --end.
+func compileWhere(src string, loc *time.Location) (*where.Expr, error) {
+	now := time.Now()
+	return where.Compile(src, whereDecls, where.Options{
+		ParseTime: func(ts string) (time.Time, error) { return ParseTimeIn(ts, now, loc) },
+	})
+}
+
+// pageVersions indexes the object versions of a ListObjectVersions page by key, newest first as S3 lists them
+type pageVersions map[string][]*s3.ObjectVersion
+
+func newPageVersions(output *s3.ListObjectVersionsOutput) pageVersions {
+	versions := pageVersions{}
+	for _, ver := range output.Versions {
+		key := aws.StringValue(ver.Key)
+		versions[key] = append(versions[key], ver)
+	}
+	return versions
+}
+
+// hidden returns the version a delete marker hides, the newest version of its key which is not newer than the
+// marker. It is nil if the page does not have it.
+func (p pageVersions) hidden(marker *s3.DeleteMarkerEntry) *s3.ObjectVersion {
+	var found *s3.ObjectVersion
+	for _, ver := range p[aws.StringValue(marker.Key)] {
+		if ver.LastModified.After(aws.TimeValue(marker.LastModified)) {
+			continue
+		}
+		if found == nil || ver.LastModified.After(*found.LastModified) {
+			found = ver
+		}
+	}
+	return found
+}
+
+// versionVars returns the --where variables of a *s3.ObjectVersion or *s3.DeleteMarkerEntry. index and bucket are
+// empty for keys outside a bucket tree. A delete marker takes size and storage_class from hidden, the version a
+// restore would surface. They are not set without one, so expressions using them fail instead of matching nothing.
+func versionVars(pth string, item interface{}, hidden *s3.ObjectVersion) where.Vars {
+	vars := where.Vars{"is_delete_marker": false}
+	switch v := item.(type) {
+	case *s3.ObjectVersion:
+		vars["key"] = aws.StringValue(v.Key)
+		vars["version_id"] = aws.StringValue(v.VersionId)
+		vars["last_modified"] = aws.TimeValue(v.LastModified)
+		vars["is_latest"] = aws.BoolValue(v.IsLatest)
+		vars["size"] = aws.Int64Value(v.Size)
+		vars["storage_class"] = aws.StringValue(v.StorageClass)
+	case *s3.DeleteMarkerEntry:
+		vars["key"] = aws.StringValue(v.Key)
+		vars["version_id"] = aws.StringValue(v.VersionId)
+		vars["last_modified"] = aws.TimeValue(v.LastModified)
+		vars["is_latest"] = aws.BoolValue(v.IsLatest)
+		vars["is_delete_marker"] = true
+		if hidden != nil {
+			vars["size"] = aws.Int64Value(hidden.Size)
+			vars["storage_class"] = aws.StringValue(hidden.StorageClass)
+		}
+	}
+	key, _ := vars["key"].(string)
+	vars["key"] = key
+	vars["name"] = path.Base(key)
+	vars["index"], vars["bucket"] = "", ""
+	if bid, err := ParseBucketKey(pth, key); err == nil {
+		vars["index"], vars["bucket"] = bid.Index(), bid.String()
+	}
+	return vars
+}
+
+// IndexSelected reports whether index matches an --include-index glob, if any are given, and no --exclude-index glob
+func (c *ConfigType) IndexSelected(index string) bool {
+	return globsSelect(c.IncludeIndexes, c.ExcludeIndexes, index)
+}
+
+// FileSelected reports whether the path of a file inside a bucket directory, e.g. rawdata/journal.gz, matches an
+// --include-file glob, if any are given, and no --exclude-file glob. Globs without a / match the file name.
+func (c *ConfigType) FileSelected(file string) bool {
+	return globsSelect(c.IncludeFiles, c.ExcludeFiles, file)
+}
+
+// KeySelected applies the index and file globs to a key below pth. Keys outside a bucket tree are only selected
+// when no include globs are given.
+func (c *ConfigType) KeySelected(key string) bool {
+	b, file, err := SplitBucketKey(c.Path, key)
+	if err != nil {
+		return len(c.IncludeIndexes) == 0 && len(c.IncludeFiles) == 0
+	}
+	return c.IndexSelected(b.Index()) && c.FileSelected(file)
+}
+
+// globsSelect reports whether name matches one of include, or include is empty, and none of exclude
+func globsSelect(include, exclude []string, name string) bool {
+	for _, glob := range exclude {
+		if globMatch(glob, name) {
+			return false
+		}
+	}
+	if len(include) == 0 {
+		return true
+	}
+	for _, glob := range include {
+		if globMatch(glob, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func globMatch(glob, name string) bool {
+	if !strings.Contains(glob, "/") {
+		name = path.Base(name)
+	}
+	ok, _ := path.Match(glob, name)
+	return ok
+}
+
+// parseGlobs validates globs given to a repeatable option, each value may also be a comma separated list.
+// Duplicates are dropped, docopt repeats the values of repeated options.
+func parseGlobs(values []string) ([]string, error) {
+	var globs []string
+	seen := map[string]bool{}
+	for _, value := range values {
+		for _, glob := range strings.Split(value, ",") {
+			if glob = strings.TrimSpace(glob); glob == "" || seen[glob] {
+				continue
+			}
+			seen[glob] = true
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("%s: %v", glob, err)
+			}
+			globs = append(globs, glob)
+		}
+	}
+	return globs, nil
+}
+
+// selectVersion reports whether a version or delete marker is the latest version, was modified inside the --start
+// and --end window and matches the --include/--exclude globs and --where. hidden is the version a delete marker
+// hides, if it is known.
+func (s *S3) selectVersion(item interface{}, hidden *s3.ObjectVersion) bool {
+	var lastModified *time.Time
+	var isLatest *bool
+	switch v := item.(type) {
+	case *s3.ObjectVersion:
+		lastModified, isLatest = v.LastModified, v.IsLatest
+	case *s3.DeleteMarkerEntry:
+		lastModified, isLatest = v.LastModified, v.IsLatest
+	}
+	if lastModified == nil || isLatest == nil {
+		return false
+	}
+	if !(s.Config.FromDate.Before(*lastModified) && s.Config.ToDate.After(*lastModified) && *isLatest) {
+		return false
+	}
+	return s.matchVersion(item, hidden)
+}
+
+// matchVersion reports whether a version or delete marker matches the --include/--exclude globs and --where. Versions
+// which can not be evaluated are logged and not selected. The version a delete marker hides is listed if it was not
+// on the marker's page.
+func (s *S3) matchVersion(item interface{}, hidden *s3.ObjectVersion) bool {
+	var key *string
+	switch v := item.(type) {
+	case *s3.ObjectVersion:
+		key = v.Key
+	case *s3.DeleteMarkerEntry:
+		key = v.Key
+	}
+	if !s.Config.KeySelected(aws.StringValue(key)) {
+		return false
+	}
+	if s.Config.Where == nil {
+		return true
+	}
+	if marker, ok := item.(*s3.DeleteMarkerEntry); ok && hidden == nil {
+		hidden, _ = s.hiddenVersion(s.GetClient(), marker)
+	}
+	vars := versionVars(s.Config.Path, item, hidden)
+	ok, err := s.Config.Where.Eval(vars)
+	if err != nil {
+		log.Printf("restore action=where status=error pid=%d key=%s msg=\"%v\"", s.State.Pid(), vars["key"], err)
+		return false
+	}
+	return ok
+}
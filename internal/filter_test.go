@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestS3_selectVersion(t *testing.T) {
+	now := time.Date(2020, time.May, 13, 12, 0, 0, 0, time.UTC)
+	key := "splunk/main/db/0C/F7/275~609B1724-5A77-4C70-81DC-8444B5014D0D/guidSplunk-609B1724/bloomfilter"
+	ver := &s3.ObjectVersion{
+		Key:          aws.String(key),
+		VersionId:    aws.String("v1"),
+		LastModified: aws.Time(now),
+		IsLatest:     aws.Bool(true),
+		Size:         aws.Int64(42),
+		StorageClass: aws.String("STANDARD"),
+	}
+	dm := &s3.DeleteMarkerEntry{
+		Key:          aws.String(key),
+		VersionId:    aws.String("v2"),
+		LastModified: aws.Time(now),
+		IsLatest:     aws.Bool(true),
+	}
+	// the version dm hides
+	hidden := &s3.ObjectVersion{
+		Key:          aws.String(key),
+		VersionId:    aws.String("v0"),
+		LastModified: aws.Time(now.Add(-time.Minute)),
+		IsLatest:     aws.Bool(false),
+		Size:         aws.Int64(7),
+		StorageClass: aws.String("GLACIER"),
+	}
+	for src, want := range map[string][2]bool{
+		``:                                  {true, true},
+		`name != "bloomfilter" && size > 0`: {false, false},
+		`size > 0`:                          {true, true},
+		`size > 10`:                         {true, false},
+		`is_delete_marker`:                  {false, true},
+		`index == "main" && bucket == "main~275~609B1724-5A77-4C70-81DC-8444B5014D0D"`: {true, true},
+		`storage_class == "STANDARD" && version_id == "v1"`:                            {true, false},
+		`storage_class == "GLACIER" && is_delete_marker`:                               {false, true},
+		`last_modified < "2020-05-13T11:00:00"`:                                        {false, false},
+	} {
+		config := &ConfigType{Path: "splunk", FromDate: now.Add(-time.Hour), ToDate: now.Add(time.Hour), Location: time.UTC}
+		if src != "" {
+			expr, err := compileWhere(src, time.UTC)
+			if err != nil {
+				t.Fatalf("%s: %v", src, err)
+			}
+			config.Where = expr
+		}
+		s := &S3{Config: config, State: &State}
+		if got := [2]bool{s.selectVersion(ver, nil), s.selectVersion(dm, hidden)}; got != want {
+			t.Errorf("%q: expected %v, got %v", src, want, got)
+		}
+	}
+	s := &S3{Config: &ConfigType{FromDate: now, ToDate: now.Add(time.Hour)}, State: &State}
+	if s.selectVersion(ver, nil) {
+		t.Errorf("expected versions outside the window to be skipped")
+	}
+}
+
+func TestS3_matchVersion_hiddenElsewhere(t *testing.T) {
+	key := "splunk/main/db/0C/F7/275~GUID/rawdata/journal.gz"
+	dm := &s3.DeleteMarkerEntry{
+		Key:          aws.String(key),
+		VersionId:    aws.String("dm"),
+		LastModified: aws.Time(time.Date(2020, time.May, 13, 12, 0, 0, 0, time.UTC)),
+		IsLatest:     aws.Bool(true),
+	}
+	lists := 0
+	sess := stubSession(t, func(r *request.Request) (int, string) {
+		if r.Operation.Name != "ListObjectVersions" {
+			t.Errorf("unexpected %s request", r.Operation.Name)
+			return 500, ""
+		}
+		lists++
+		return 200, "<ListVersionsResult><IsTruncated>false</IsTruncated>" +
+			"<DeleteMarker><Key>" + key + "</Key><VersionId>dm</VersionId><LastModified>2020-05-13T12:00:00.000Z</LastModified></DeleteMarker>" +
+			"<Version><Key>" + key + "</Key><VersionId>v1</VersionId><LastModified>2020-05-13T11:00:00.000Z</LastModified>" +
+			"<Size>42</Size><StorageClass>STANDARD</StorageClass></Version></ListVersionsResult>"
+	})
+	expr, err := compileWhere(`size == 42`, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &S3{Config: &ConfigType{S3bucket: "bucket", Path: "splunk", Where: expr}, State: &State, sess: sess, sessOnce: &sync.Once{}}
+	s.sessOnce.Do(func() {})
+	if !s.matchVersion(dm, nil) || lists != 1 {
+		t.Errorf("expected the version hidden on another page to be listed, %d listings", lists)
+	}
+}
+
+func TestPageVersions_hidden(t *testing.T) {
+	at := func(minute int) *time.Time {
+		return aws.Time(time.Date(2020, time.May, 13, 12, minute, 0, 0, time.UTC))
+	}
+	versions := newPageVersions(&s3.ListObjectVersionsOutput{Versions: []*s3.ObjectVersion{
+		{Key: aws.String("a"), VersionId: aws.String("a3"), LastModified: at(3)},
+		{Key: aws.String("a"), VersionId: aws.String("a1"), LastModified: at(1)},
+		{Key: aws.String("b"), VersionId: aws.String("b2"), LastModified: at(2)},
+	}})
+	for _, test := range []struct {
+		key    string
+		minute int
+		want   string
+	}{
+		{"a", 2, "a1"},
+		{"a", 4, "a3"},
+		{"a", 0, ""},
+		{"b", 2, "b2"},
+		{"c", 5, ""},
+	} {
+		got := versions.hidden(&s3.DeleteMarkerEntry{Key: aws.String(test.key), LastModified: at(test.minute)})
+		id := ""
+		if got != nil {
+			id = aws.StringValue(got.VersionId)
+		}
+		if id != test.want {
+			t.Errorf("%s at %d: expected %q, got %q", test.key, test.minute, test.want, id)
+		}
+	}
+}
+
+func TestConfigType_KeySelected(t *testing.T) {
+	prefix := "splunk/_internal/db/0C/F7/275~609B1724-5A77-4C70-81DC-8444B5014D0D/"
+	c := &ConfigType{Path: "splunk", ExcludeIndexes: []string{"_internal", "_audit"}}
+	if c.KeySelected(prefix+"receipt.json") || !c.IndexSelected("main") {
+		t.Errorf("expected --exclude-index to skip _internal only")
+	}
+	c = &ConfigType{Path: "splunk", IncludeFiles: []string{"receipt.json", "rawdata/journal.gz"}, ExcludeFiles: []string{"bloom*"}}
+	for file, want := range map[string]bool{
+		"receipt.json":                     true,
+		"rawdata/journal.gz":               true,
+		"rawdata/slicesv2.dat":             false,
+		"guidSplunk-1/bloomfilter":         false,
+		"guidSplunk-1/rawdata/journal.gz":  false,
+		"guidSplunk-1/nested/receipt.json": true,
+	} {
+		if got := c.KeySelected(prefix + file); got != want {
+			t.Errorf("%s: expected %v, got %v", file, want, got)
+		}
+	}
+	if c.KeySelected("splunk/not/a/bucket") {
+		t.Errorf("expected keys outside a bucket to be skipped with --include-file")
+	}
+	if _, err := parseGlobs([]string{"main,[_"}); err == nil {
+		t.Errorf("expected an invalid glob to be rejected")
+	}
+}
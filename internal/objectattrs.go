@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"net/url"
+)
+
+// objectAttrs holds the attributes of a downloaded object which have to survive a re-upload
+type objectAttrs struct {
+	ETag                 *string
+	VersionId            *string
+	CacheControl         *string
+	ContentDisposition   *string
+	ContentEncoding      *string
+	ContentLanguage      *string
+	ContentType          *string
+	StorageClass         *string
+	ServerSideEncryption *string
+	SSEKMSKeyId          *string
+	SSECustomerAlgorithm *string
+	Metadata             map[string]*string
+	Tagging              *string
+}
+
+// sseCustomerAlgorithm is the only algorithm S3 supports for customer provided keys
+const sseCustomerAlgorithm = "AES256"
+
+// getObjectInput returns a GetObjectInput which decrypts SSE-C objects when a customer key is configured.
+// The latest version is read if versionId is empty.
+func (s *S3) getObjectInput(key, versionId string) *s3.GetObjectInput {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.Config.S3bucket),
+		Key:    aws.String(key),
+	}
+	if versionId != "" {
+		input.VersionId = aws.String(versionId)
+	}
+	if s.Config.SSECustomerKey != "" {
+		input.SSECustomerAlgorithm = aws.String(sseCustomerAlgorithm)
+		input.SSECustomerKey = aws.String(s.Config.SSECustomerKey)
+	}
+	return input
+}
+
+// getObjectAttrs collects the attributes of a downloaded object including its tags
+func (s *S3) getObjectAttrs(svc *s3.S3, key string, output *s3.GetObjectOutput) (*objectAttrs, error) {
+	attrs := &objectAttrs{
+		ETag:                 output.ETag,
+		VersionId:            output.VersionId,
+		CacheControl:         output.CacheControl,
+		ContentDisposition:   output.ContentDisposition,
+		ContentEncoding:      output.ContentEncoding,
+		ContentLanguage:      output.ContentLanguage,
+		ContentType:          output.ContentType,
+		StorageClass:         output.StorageClass,
+		ServerSideEncryption: output.ServerSideEncryption,
+		SSEKMSKeyId:          output.SSEKMSKeyId,
+		SSECustomerAlgorithm: output.SSECustomerAlgorithm,
+		Metadata:             output.Metadata,
+	}
+	if aws.Int64Value(output.TagCount) == 0 {
+		return attrs, nil
+	}
+	tagging, err := svc.GetObjectTagging(&s3.GetObjectTaggingInput{
+		Bucket:    aws.String(s.Config.S3bucket),
+		Key:       aws.String(key),
+		VersionId: output.VersionId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := url.Values{}
+	for _, tag := range tagging.TagSet {
+		tags.Add(aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+	}
+	attrs.Tagging = aws.String(tags.Encode())
+	return attrs, nil
+}
+
+// putObjectInput returns a PutObjectInput carrying over the content headers, metadata, tags, storage class and
+// encryption of the original object
+func (s *S3) putObjectInput(key string, attrs *objectAttrs) *s3.PutObjectInput {
+	input := &s3.PutObjectInput{
+		Bucket:             aws.String(s.Config.S3bucket),
+		Key:                aws.String(key),
+		CacheControl:       attrs.CacheControl,
+		ContentDisposition: attrs.ContentDisposition,
+		ContentEncoding:    attrs.ContentEncoding,
+		ContentLanguage:    attrs.ContentLanguage,
+		ContentType:        attrs.ContentType,
+		StorageClass:       attrs.StorageClass,
+		Metadata:           attrs.Metadata,
+		Tagging:            attrs.Tagging,
+	}
+	s.setSSE(attrs, &input.ServerSideEncryption, &input.SSEKMSKeyId, &input.SSECustomerAlgorithm, &input.SSECustomerKey)
+	return input
+}
+
+// copyObjectInput returns a CopyObjectInput which copies src to dst only if src still has the downloaded ETag.
+// Metadata and tags are copied by S3, encryption and storage class have to be set explicitly.
+func (s *S3) copyObjectInput(src, dst string, attrs *objectAttrs) *s3.CopyObjectInput {
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(s.Config.S3bucket),
+		CopySource:        aws.String(copySource(s.Config.S3bucket, src, "")),
+		Key:               aws.String(dst),
+		CopySourceIfMatch: attrs.ETag,
+		StorageClass:      attrs.StorageClass,
+	}
+	s.setSSE(attrs, &input.ServerSideEncryption, &input.SSEKMSKeyId, &input.SSECustomerAlgorithm, &input.SSECustomerKey)
+	if input.SSECustomerKey != nil {
+		input.CopySourceSSECustomerAlgorithm = input.SSECustomerAlgorithm
+		input.CopySourceSSECustomerKey = input.SSECustomerKey
+	}
+	return input
+}
+
+// setSSE sets the encryption fields of a Put or Copy input to match the original object
+func (s *S3) setSSE(attrs *objectAttrs, sse, kmsKeyId, customerAlgorithm, customerKey **string) {
+	switch {
+	case attrs.SSECustomerAlgorithm != nil:
+		*customerAlgorithm = attrs.SSECustomerAlgorithm
+		*customerKey = aws.String(s.Config.SSECustomerKey)
+	case aws.StringValue(attrs.ServerSideEncryption) == s3.ServerSideEncryptionAwsKms:
+		*sse = attrs.ServerSideEncryption
+		*kmsKeyId = attrs.SSEKMSKeyId
+	case attrs.ServerSideEncryption != nil:
+		*sse = attrs.ServerSideEncryption
+	}
+}
+
+// copySource returns an URL encoded CopySource for key, optionally pinned to versionId
+func copySource(bucket, key, versionId string) string {
+	src := (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+	if versionId != "" {
+		src += "?versionId=" + url.QueryEscape(versionId)
+	}
+	return src
+}
+
+// isPreconditionFailed returns true when a conditional request failed because the object has changed
+func isPreconditionFailed(err error) bool {
+	if aerr, ok := err.(awserr.RequestFailure); ok {
+		return aerr.StatusCode() == 412 || aerr.Code() == "PreconditionFailed" || aerr.Code() == "ConditionalRequestConflict"
+	}
+	return false
+}
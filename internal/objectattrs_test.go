@@ -0,0 +1,49 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"testing"
+)
+
+func TestS3_putObjectInput_KMS(t *testing.T) {
+	s := &S3{Config: &ConfigType{S3bucket: "bucket"}}
+	attrs := &objectAttrs{
+		ETag:                 aws.String(`"abc"`),
+		ContentType:          aws.String("application/json"),
+		StorageClass:         aws.String(s3.StorageClassStandardIa),
+		ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms),
+		SSEKMSKeyId:          aws.String("arn:aws:kms:us-west-2:111122223333:key/1"),
+		Metadata:             map[string]*string{"Owner": aws.String("splunk")},
+		Tagging:              aws.String("retention=90d"),
+	}
+	input := s.putObjectInput("idx/db/receipt.json", attrs)
+	if aws.StringValue(input.SSEKMSKeyId) != "arn:aws:kms:us-west-2:111122223333:key/1" || aws.StringValue(input.ServerSideEncryption) != s3.ServerSideEncryptionAwsKms {
+		t.Errorf("KMS settings were not carried over")
+	}
+	if input.SSECustomerKey != nil {
+		t.Errorf("SSE-C key must not be set for KMS encrypted objects")
+	}
+	if aws.StringValue(input.ContentType) != "application/json" || aws.StringValue(input.Tagging) != "retention=90d" ||
+		aws.StringValue(input.StorageClass) != s3.StorageClassStandardIa || aws.StringValue(input.Metadata["Owner"]) != "splunk" {
+		t.Errorf("object attributes were not carried over")
+	}
+}
+
+func TestS3_copyObjectInput_SSEC(t *testing.T) {
+	s := &S3{Config: &ConfigType{S3bucket: "bucket", SSECustomerKey: "01234567890123456789012345678901"}}
+	attrs := &objectAttrs{
+		ETag:                 aws.String(`"abc"`),
+		SSECustomerAlgorithm: aws.String(sseCustomerAlgorithm),
+	}
+	input := s.copyObjectInput("idx/db/my key/receipt.json", "idx/db/my key/receipt.json.20200101000000", attrs)
+	if aws.StringValue(input.CopySourceIfMatch) != `"abc"` {
+		t.Errorf("copy is not conditional on the downloaded ETag")
+	}
+	if aws.StringValue(input.CopySourceSSECustomerKey) != s.Config.SSECustomerKey || aws.StringValue(input.SSECustomerKey) != s.Config.SSECustomerKey {
+		t.Errorf("SSE-C key was not set on source and destination")
+	}
+	if aws.StringValue(input.CopySource) != "bucket/idx/db/my%20key/receipt.json" {
+		t.Errorf("unexpected copy source %s", aws.StringValue(input.CopySource))
+	}
+}
@@ -1,44 +1,177 @@
 package internal
 
 import (
-	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
-import "github.com/karrick/tparse"
 
+// absoluteLayouts are the absolute date formats accepted by --start and --end. Layouts without a zone are read in
+// the --tz location.
+var absoluteLayouts = []string{
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	"01/02/2006:15:04:05", // Splunk earliest/latest format
+	"01/02/2006",
+}
+
+// clockLayouts are times of the current day
+var clockLayouts = []string{"15:04:05", "15:04"}
+
+var (
+	epochRe    = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+	modifierRe = regexp.MustCompile(`^(?:([+-])([0-9]*)([a-z]+)|@([a-z]+[0-9]?))`)
+)
+
+// ParseTime parses ts relative to the current time in the local timezone
 func ParseTime(ts string) (time.Time, error) {
-	p := _timeparsers()
-	for _, parser := range p {
-		t, err := parser(ts)
-		if err == nil {
+	return ParseTimeIn(ts, time.Now(), time.Local)
+}
+
+// ParseTimeIn parses an absolute date, epoch seconds or a Splunk relative time modifier such as -7d@d, @w1,
+// -1d@d+8h or now-2h. Relative times are resolved against now, snapping and dates without a zone use loc.
+func ParseTimeIn(ts string, now time.Time, loc *time.Location) (time.Time, error) {
+	ts = strings.TrimSpace(ts)
+	if ts == "" {
+		return time.Time{}, fmt.Errorf("empty time")
+	}
+	if epochRe.MatchString(ts) {
+		secs, err := strconv.ParseFloat(ts, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		whole, frac := math.Modf(secs)
+		return time.Unix(int64(whole), int64(frac*1e9)).In(loc), nil
+	}
+	for _, layout := range absoluteLayouts {
+		if t, err := time.ParseInLocation(layout, ts, loc); err == nil {
 			return t, nil
 		}
 	}
-	return time.Time{}, errors.New("Unrecognised datetime string")
+	now = now.In(loc)
+	for _, layout := range clockLayouts {
+		if t, err := time.ParseInLocation(layout, ts, loc); err == nil {
+			return time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc), nil
+		}
+	}
+	return parseModifier(ts, now)
 }
 
-func _timeparsers() []func(string) (time.Time, error) {
-	return []func(string) (time.Time, error){
-		func(ts string) (time.Time, error) {
-			return time.Parse("2006-01-02T15:04:05-0700", ts)
-		},
-		func(ts string) (time.Time, error) {
-			return time.Parse("2006-01-02T15:04:05", ts)
-		},
-		func(ts string) (time.Time, error) {
-			return time.Parse("2006-01-02", ts)
-		},
-		func(ts string) (time.Time, error) {
-			return time.Parse("15:04:05", ts)
-		},
-		func(ts string) (time.Time, error) {
-			return time.Parse("15:04", ts)
-		},
-		func(ts string) (time.Time, error) {
-			return tparse.AddDuration(time.Now(), ts)
-		},
-		func(ts string) (time.Time, error) {
-			return tparse.ParseNow(time.RFC3339, ts)
-		},
+// parseModifier applies a chain of Splunk offsets and snaps to now
+func parseModifier(ts string, now time.Time) (time.Time, error) {
+	rest := strings.ToLower(ts)
+	rest = strings.TrimPrefix(rest, "now")
+	t := now
+	for rest != "" {
+		m := modifierRe.FindStringSubmatch(rest)
+		if m == nil {
+			return time.Time{}, fmt.Errorf("unrecognised time modifier %q in %q", rest, ts)
+		}
+		var err error
+		if m[4] != "" {
+			t, err = snapTime(t, m[4])
+		} else {
+			n := 1
+			if m[2] != "" {
+				n, err = strconv.Atoi(m[2])
+			}
+			if err == nil && m[1] == "-" {
+				n = -n
+			}
+			if err == nil {
+				t, err = offsetTime(t, n, m[3])
+			}
+		}
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%v in %q", err, ts)
+		}
+		rest = rest[len(m[0]):]
+	}
+	return t, nil
+}
+
+// timeUnit normalises the Splunk time unit spellings
+func timeUnit(unit string) (string, error) {
+	switch unit {
+	case "s", "sec", "secs", "second", "seconds":
+		return "s", nil
+	case "m", "min", "mins", "minute", "minutes":
+		return "m", nil
+	case "h", "hr", "hrs", "hour", "hours":
+		return "h", nil
+	case "d", "day", "days":
+		return "d", nil
+	case "w", "week", "weeks":
+		return "w", nil
+	case "mon", "month", "months":
+		return "mon", nil
+	case "q", "qtr", "qtrs", "quarter", "quarters":
+		return "q", nil
+	case "y", "yr", "yrs", "year", "years":
+		return "y", nil
+	}
+	return "", fmt.Errorf("unknown time unit %q", unit)
+}
+
+// offsetTime adds n units to t. Days and larger units follow the calendar of the location of t.
+func offsetTime(t time.Time, n int, unit string) (time.Time, error) {
+	u, err := timeUnit(unit)
+	if err != nil {
+		return t, err
+	}
+	switch u {
+	case "s":
+		return t.Add(time.Duration(n) * time.Second), nil
+	case "m":
+		return t.Add(time.Duration(n) * time.Minute), nil
+	case "h":
+		return t.Add(time.Duration(n) * time.Hour), nil
+	case "d":
+		return t.AddDate(0, 0, n), nil
+	case "w":
+		return t.AddDate(0, 0, 7*n), nil
+	case "mon":
+		return t.AddDate(0, n, 0), nil
+	case "q":
+		return t.AddDate(0, 3*n, 0), nil
+	}
+	return t.AddDate(n, 0, 0), nil
+}
+
+// snapTime rounds t down to the start of unit. @w0 to @w6 snap to the most recent Sunday to Saturday.
+func snapTime(t time.Time, unit string) (time.Time, error) {
+	if len(unit) == 2 && unit[0] == 'w' && unit[1] >= '0' && unit[1] <= '6' {
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+		back := (int(day.Weekday()) - int(unit[1]-'0') + 7) % 7
+		return day.AddDate(0, 0, -back), nil
+	}
+	u, err := timeUnit(unit)
+	if err != nil {
+		return t, err
+	}
+	y, mon, d := t.Date()
+	loc := t.Location()
+	switch u {
+	case "s":
+		return time.Date(y, mon, d, t.Hour(), t.Minute(), t.Second(), 0, loc), nil
+	case "m":
+		return time.Date(y, mon, d, t.Hour(), t.Minute(), 0, 0, loc), nil
+	case "h":
+		return time.Date(y, mon, d, t.Hour(), 0, 0, 0, loc), nil
+	case "d":
+		return time.Date(y, mon, d, 0, 0, 0, 0, loc), nil
+	case "w":
+		return snapTime(t, "w0")
+	case "mon":
+		return time.Date(y, mon, 1, 0, 0, 0, 0, loc), nil
+	case "q":
+		return time.Date(y, mon-(mon-1)%3, 1, 0, 0, 0, 0, loc), nil
 	}
+	return time.Date(y, time.January, 1, 0, 0, 0, 0, loc), nil
 }
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTimeIn(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no timezone database")
+	}
+	// Wednesday
+	now := time.Date(2020, time.May, 13, 15, 30, 45, 0, ny)
+	for ts, want := range map[string]string{
+		"now":                      "2020-05-13T15:30:45-04:00",
+		"-7d@d":                    "2020-05-06T00:00:00-04:00",
+		"-1d@d+8h":                 "2020-05-12T08:00:00-04:00",
+		"@w0":                      "2020-05-10T00:00:00-04:00",
+		"@w1":                      "2020-05-11T00:00:00-04:00",
+		"@w3":                      "2020-05-13T00:00:00-04:00",
+		"@w4":                      "2020-05-07T00:00:00-04:00",
+		"-1mon@mon":                "2020-04-01T00:00:00-04:00",
+		"@q":                       "2020-04-01T00:00:00-04:00",
+		"@y":                       "2020-01-01T00:00:00-05:00",
+		"now-1hr":                  "2020-05-13T14:30:45-04:00",
+		"now-2d-1h-3m":             "2020-05-11T14:27:45-04:00",
+		"-300m":                    "2020-05-13T10:30:45-04:00",
+		"+1h@h":                    "2020-05-13T16:00:00-04:00",
+		"2020-03-08":               "2020-03-08T00:00:00-05:00",
+		"2020-03-08T12:00:00-0700": "2020-03-08T12:00:00-07:00",
+		"03/08/2020:01:02:03":      "2020-03-08T01:02:03-05:00",
+		"09:15":                    "2020-05-13T09:15:00-04:00",
+		"1600000000":               "2020-09-13T08:26:40-04:00",
+	} {
+		got, err := ParseTimeIn(ts, now, ny)
+		if err != nil {
+			t.Errorf("%s: %v", ts, err)
+			continue
+		}
+		if got.Format(time.RFC3339) != want {
+			t.Errorf("%s: expected %s, got %s", ts, want, got.Format(time.RFC3339))
+		}
+	}
+	for _, invalid := range []string{"", "yesterday", "-7x", "@fortnight", "now-1h garbage", "2020-13-01"} {
+		if _, err := ParseTimeIn(invalid, now, ny); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestRunner_writeDatehelp(t *testing.T) {
+	r := &Runner{Config: &ConfigType{Location: time.UTC}}
+	out := &bytes.Buffer{}
+	r.writeDatehelp(out, time.Date(2020, time.May, 13, 15, 30, 45, 0, time.UTC))
+	if !strings.Contains(out.String(), "-7d@d") || !strings.Contains(out.String(), "2020-05-06T00:00:00Z") {
+		t.Errorf("unexpected date help:\n%s", out)
+	}
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/routines"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// restoreCounts counts the delete markers a restore would remove per index
+type restoreCounts struct {
+	mu      sync.Mutex
+	indexes map[string]int64
+}
+
+func newRestoreCounts() *restoreCounts {
+	return &restoreCounts{indexes: map[string]int64{}}
+}
+
+// Add counts a delete marker of index
+func (c *restoreCounts) Add(index string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.indexes[index]++
+}
+
+// Total returns the number of delete markers counted
+func (c *restoreCounts) Total() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var total int64
+	for _, n := range c.indexes {
+		total += n
+	}
+	return total
+}
+
+// WriteReport prints the delete markers per index and their total
+func (c *restoreCounts) WriteReport(out io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var indexes []string
+	var total int64
+	for index, n := range c.indexes {
+		indexes = append(indexes, index)
+		total += n
+	}
+	sort.Strings(indexes)
+	fmt.Fprintf(out, "Delete markers to restore per index:\n")
+	for _, index := range indexes {
+		fmt.Fprintf(out, "    %-30s %10d\n", index, c.indexes[index])
+	}
+	fmt.Fprintf(out, "    %-30s %10d\n", "total", total)
+}
+
+// confirm asks whether to restore total delete markers, only y or yes confirm
+func confirm(in io.Reader, out io.Writer, total int64) bool {
+	fmt.Fprintf(out, "Restore %d delete markers? [y/N] ", total)
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// isTerminal reports whether f is a terminal someone can answer a confirmation on
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// prescanDecision is what a restore does after its pre-scan
+type prescanDecision int
+
+const (
+	prescanProceed prescanDecision = iota
+	prescanConfirm
+	prescanAbort
+)
+
+// decidePreScan decides whether a restore of total delete markers proceeds, asks for confirmation or aborts, and
+// why. --yes skips every check. A count above max aborts, otherwise the restore asks on a terminal and proceeds
+// without one, e.g. under cron.
+func decidePreScan(total, max int64, yes, tty bool) (prescanDecision, string) {
+	switch {
+	case total == 0:
+		return prescanProceed, "nothing to restore"
+	case yes:
+		return prescanProceed, "confirmed by --yes"
+	case max > 0 && total > max:
+		return prescanAbort, fmt.Sprintf("%d delete markers exceed --max-restores %d, use --yes to restore them", total, max)
+	case !tty:
+		return prescanProceed, "no terminal to confirm on"
+	}
+	return prescanConfirm, ""
+}
+
+// preScan counts the delete markers the restore would remove and shows them per index, then applies decidePreScan.
+// The restore is aborted if the count exceeds --max-restores or the confirmation is declined.
+func (r *Runner) preScan(action string) {
+	for _, client := range r.clients() {
+		client.prescan = true
+		client.StartWorkers()
+	}
+	r.iterMain()
+	r.shutdown()
+	if r.sigTrap != nil {
+		log.Printf("restore action=prescan status=abort pid=%d msg=\"interrupted\"\n", r.State.Pid())
+		Exit(1)
+	}
+	for _, client := range r.clients() {
+		client.prescan = false
+		client.newRoutines()
+	}
+	counts := r.s3Client.counts
+	total := counts.Total()
+	log.Printf("restore action=prescan status=summary pid=%d markers=%d max_restores=%d\n", r.State.Pid(), total, r.Config.MaxRestores)
+	counts.WriteReport(os.Stderr)
+	decision, reason := decidePreScan(total, r.Config.MaxRestores, r.Config.Yes, isTerminal(os.Stdin))
+	switch decision {
+	case prescanAbort:
+		log.Printf("restore action=%s status=abort pid=%d msg=\"%s\"\n", action, r.State.Pid(), reason)
+		Exit(1)
+	case prescanConfirm:
+		if !confirm(os.Stdin, os.Stderr, total) {
+			log.Printf("restore action=%s status=abort pid=%d msg=\"restore declined\"\n", action, r.State.Pid())
+			Exit(1)
+		}
+		reason = "confirmed"
+	}
+	log.Printf("restore action=prescan status=proceed pid=%d markers=%d msg=\"%s\"\n", r.State.Pid(), total, reason)
+}
+
+//
+// Pre-scan functions
+//
+
+// restoreSelected reports whether the restore would remove marker, hidden is the version it hides if known
+func (s *S3) restoreSelected(marker *s3.DeleteMarkerEntry, hidden *s3.ObjectVersion) bool {
+	if s.Config.FromTrail != "" {
+		_, ok := s.trail.Match(marker)
+		return ok && s.matchVersion(marker, hidden)
+	}
+	return s.selectVersion(marker, hidden)
+}
+
+// scanCountFunc counts the delete markers the restore would remove per index
+func (s *S3) scanCountFunc() func(id *routines.Id, batch []interface{}) {
+	s3PageFunc := func(output *s3.ListObjectVersionsOutput, run bool) bool {
+		versions := newPageVersions(output)
+		for _, marker := range output.DeleteMarkers {
+			if !s.restoreSelected(marker, versions.hidden(marker)) {
+				continue
+			}
+			index := "-"
+			if bid, err := ParseBucketKey(s.Config.Path, aws.StringValue(marker.Key)); err == nil {
+				index = bid.Index()
+			}
+			s.counts.Add(index)
+		}
+		return true
+	}
+	return s.standardPrefixScan(s3PageFunc)
+}
@@ -0,0 +1,84 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreCounts(t *testing.T) {
+	counts := newRestoreCounts()
+	for _, index := range []string{"main", "_internal", "main", "-"} {
+		counts.Add(index)
+	}
+	if counts.Total() != 4 {
+		t.Errorf("expected 4 delete markers, got %d", counts.Total())
+	}
+	out := &bytes.Buffer{}
+	counts.WriteReport(out)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 || strings.Fields(lines[3])[0] != "main" || strings.Fields(lines[3])[1] != "2" || strings.Fields(lines[4])[1] != "4" {
+		t.Errorf("unexpected report\n%s", out.String())
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	for answer, want := range map[string]bool{"y\n": true, " YES \n": true, "n\n": false, "\n": false, "": false, "yep\n": false} {
+		out := &bytes.Buffer{}
+		if got := confirm(strings.NewReader(answer), out, 12); got != want {
+			t.Errorf("%q: expected %v", answer, want)
+		}
+		if !strings.Contains(out.String(), "Restore 12 delete markers?") {
+			t.Errorf("unexpected prompt %q", out.String())
+		}
+	}
+}
+
+func TestDecidePreScan(t *testing.T) {
+	for _, test := range []struct {
+		total, max int64
+		yes, tty   bool
+		expect     prescanDecision
+	}{
+		{0, 10, false, false, prescanProceed},
+		{20, 10, true, false, prescanProceed},
+		{20, 10, false, true, prescanAbort},
+		{20, 10, false, false, prescanAbort},
+		{5, 10, false, false, prescanProceed},
+		{5, 0, false, false, prescanProceed},
+		{5, 10, false, true, prescanConfirm},
+		{5, 0, false, true, prescanConfirm},
+	} {
+		got, reason := decidePreScan(test.total, test.max, test.yes, test.tty)
+		if got != test.expect {
+			t.Errorf("%+v: expected %d got %d %q", test, test.expect, got, reason)
+		}
+		if got != prescanConfirm && reason == "" {
+			t.Errorf("%+v: expected a reason", test)
+		}
+	}
+}
+
+func TestGetUsage_safeguards(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"restore", "--start", "-2d", "--s3bucket", "splunks3restore", "--max-restores", "1000", "--max-window", "7d", "--yes", "index~ID1"}
+	opts := GetUsage(args, "1.0.0")
+	if opts.Config.MaxRestores != 1000 || opts.Config.MaxWindow != 7*24*time.Hour || !opts.Config.Yes {
+		t.Errorf("unexpected safeguards %d %s %t", opts.Config.MaxRestores, opts.Config.MaxWindow, opts.Config.Yes)
+	}
+	for _, args := range [][]string{
+		{"restore", "--start", "-70d", "--s3bucket", "splunks3restore", "--max-window", "30d", "index~ID1"},
+		{"restore", "--start", "-1d", "--s3bucket", "splunks3restore", "--max-window", "1mon", "index~ID1"},
+		{"restore", "--start", "-1d", "--s3bucket", "splunks3restore", "--max-restores", "none", "index~ID1"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected %v to be rejected", args)
+				}
+			}()
+			GetUsage(args, "1.0.0")
+		}()
+	}
+}
@@ -1,35 +1,180 @@
 package internal
 
 import (
-	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"golang.org/x/time/rate"
 	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 const AWSDefaultRate = float64(256)
 
-var AWSRate *rate.Limiter
+// OpClass groups S3 operations which share a request budget
+type OpClass string
 
-func AWSRateLimit() {
-	if AWSRate != nil {
-		err := AWSRate.Wait(context.TODO())
-		if err != nil {
+const (
+	OpList   OpClass = "list"
+	OpRead   OpClass = "read"
+	OpWrite  OpClass = "write"
+	OpDelete OpClass = "delete"
+)
+
+var opClasses = []OpClass{OpList, OpRead, OpWrite, OpDelete}
+
+// prefixFanoutRe matches the index/db/XX, index/dma/XX and index/summary/XX fan-out S3 partitions SmartStore keys on
+var prefixFanoutRe = regexp.MustCompile(`^(?:.*/)?[^/]+/(?:db|dma|summary)/[0-9A-Fa-f]{2}(?:/|$)`)
+
+// RateBudgets rate limits S3 calls per operation class and optionally per operation class and key prefix
+type RateBudgets struct {
+	ops         map[OpClass]*rate.Limiter
+	prefixRates map[OpClass]float64
+	prefixes    *sync.Map
+}
+
+var AWSRate *RateBudgets
+
+// AWSRateLimit blocks until the budgets of the request's operation class and prefix allow it to be sent
+func AWSRateLimit(r *request.Request) {
+	if AWSRate == nil {
+		return
+	}
+	class := opClassOf(r.Operation.Name)
+	limiters := []*rate.Limiter{AWSRate.ops[class]}
+	if _, ok := AWSRate.prefixRates[class]; ok {
+		limiters = append(limiters, AWSRate.prefixLimiter(class, requestPrefix(r)))
+	}
+	for _, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		if err := limiter.Wait(r.Context()); err != nil {
 			log.Println(err.Error())
 		}
 	}
 }
 
+// SetupAWSRateLimit creates the operation budgets from --rate, --op-rate & --prefix-rate
 func SetupAWSRateLimit(defaultrate float64) {
-	if AWSRate == nil {
-		var l float64
-		switch {
-		case Config.RateLimit < 0:
-			AWSRate = nil
-		case Config.RateLimit == 0:
-			l = defaultrate
-		default:
-			l = Config.RateLimit
+	if AWSRate != nil {
+		return
+	}
+	AWSRate = newRateBudgets(Config.RateLimit, defaultrate, Config.OpRates, Config.PrefixRates)
+}
+
+func newRateBudgets(ratelimit, defaultrate float64, opRates, prefixRates map[OpClass]float64) *RateBudgets {
+	var l float64
+	switch {
+	case ratelimit < 0:
+		l = -1
+	case ratelimit == 0:
+		l = defaultrate
+	default:
+		l = ratelimit
+	}
+	budgets := &RateBudgets{
+		ops:         map[OpClass]*rate.Limiter{},
+		prefixRates: map[OpClass]float64{},
+		prefixes:    &sync.Map{},
+	}
+	for _, class := range opClasses {
+		classrate := l
+		if r, ok := opRates[class]; ok {
+			classrate = r
+		}
+		if classrate >= 0 {
+			budgets.ops[class] = rate.NewLimiter(rate.Limit(classrate), 512)
+		}
+	}
+	for class, r := range prefixRates {
+		if r >= 0 {
+			budgets.prefixRates[class] = r
+		}
+	}
+	return budgets
+}
+
+// prefixLimiter returns the limiter of an operation class for a key prefix. An empty prefix is not limited.
+func (b *RateBudgets) prefixLimiter(class OpClass, prefix string) *rate.Limiter {
+	if prefix == "" {
+		return nil
+	}
+	key := string(class) + ":" + prefix
+	if limiter, ok := b.prefixes.Load(key); ok {
+		return limiter.(*rate.Limiter)
+	}
+	r := b.prefixRates[class]
+	burst := int(r)
+	if burst < 1 {
+		burst = 1
+	}
+	limiter, _ := b.prefixes.LoadOrStore(key, rate.NewLimiter(rate.Limit(r), burst))
+	return limiter.(*rate.Limiter)
+}
+
+// opClassOf maps an S3 operation name to its budget
+func opClassOf(operation string) OpClass {
+	switch {
+	case strings.HasPrefix(operation, "List"):
+		return OpList
+	case strings.HasPrefix(operation, "Get"), strings.HasPrefix(operation, "Head"):
+		return OpRead
+	case strings.HasPrefix(operation, "Delete"):
+		return OpDelete
+	}
+	return OpWrite
+}
+
+// requestPrefix returns the index/db/XX fan-out of the key or prefix a request operates on
+func requestPrefix(r *request.Request) string {
+	for _, field := range []string{"Key", "Prefix", "Delete.Objects[0].Key"} {
+		values, err := awsutil.ValuesAtPath(r.Params, field)
+		if err != nil || len(values) == 0 {
+			continue
+		}
+		if key, ok := values[0].(*string); ok && key != nil {
+			return keyFanout(*key)
+		}
+	}
+	return ""
+}
+
+// keyFanout returns the index/db/XX part of a SmartStore key
+func keyFanout(key string) string {
+	return strings.TrimSuffix(prefixFanoutRe.FindString(key), "/")
+}
+
+// ParseRateBudgets parses budgets of the form "list=100,read=500,write=200,delete=200"
+func ParseRateBudgets(budgets string) (map[OpClass]float64, error) {
+	parsed := map[OpClass]float64{}
+	if strings.TrimSpace(budgets) == "" {
+		return parsed, nil
+	}
+	for _, budget := range strings.Split(budgets, ",") {
+		parts := strings.SplitN(strings.TrimSpace(budget), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("budget \"%s\" is not of the form <class>=<rate>", budget)
+		}
+		class := OpClass(strings.ToLower(parts[0]))
+		known := false
+		for _, c := range opClasses {
+			known = known || c == class
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown operation class \"%s\", expecting list, read, write or delete", parts[0])
+		}
+		r, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rate for %s: %v", class, err)
+		}
+		if r <= 0 && r != -1 {
+			return nil, fmt.Errorf("rate for %s must be positive, or -1 for no limit", class)
 		}
-		AWSRate = rate.NewLimiter(rate.Limit(l), 512)
+		parsed[class] = r
 	}
+	return parsed, nil
 }
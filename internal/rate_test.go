@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"testing"
+)
+
+func TestParseRateBudgets(t *testing.T) {
+	budgets, err := ParseRateBudgets("list=100, READ=5500,delete=-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budgets[OpList] != 100 || budgets[OpRead] != 5500 || budgets[OpDelete] != -1 {
+		t.Errorf("unexpected budgets %v", budgets)
+	}
+	if _, ok := budgets[OpWrite]; ok {
+		t.Errorf("write was not configured")
+	}
+	for _, invalid := range []string{"list", "copy=10", "read=fast", "write=0", "delete=-5"} {
+		if _, err := ParseRateBudgets(invalid); err == nil {
+			t.Errorf("expected \"%s\" to be rejected", invalid)
+		}
+	}
+}
+
+func TestNewRateBudgets(t *testing.T) {
+	b := newRateBudgets(0, AWSDefaultRate, map[OpClass]float64{OpList: 10, OpDelete: -1}, map[OpClass]float64{OpWrite: 3500})
+	if float64(b.ops[OpList].Limit()) != 10 || float64(b.ops[OpRead].Limit()) != AWSDefaultRate {
+		t.Errorf("unexpected operation limits")
+	}
+	if b.ops[OpDelete] != nil {
+		t.Errorf("delete limit should be disabled")
+	}
+	if b.prefixLimiter(OpWrite, "idx/db/AB") != b.prefixLimiter(OpWrite, "idx/db/AB") {
+		t.Errorf("expected the same limiter for the same prefix")
+	}
+	if b.prefixLimiter(OpWrite, "") != nil {
+		t.Errorf("keys without a fan-out prefix should not be limited")
+	}
+	if disabled := newRateBudgets(-1, AWSDefaultRate, nil, nil); len(disabled.ops) != 0 {
+		t.Errorf("--rate=-1 should disable rate limiting")
+	}
+}
+
+func TestRequestPrefix(t *testing.T) {
+	svc := s3.New(session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")})))
+	tests := []struct {
+		req    *request.Request
+		class  OpClass
+		prefix string
+	}{
+		{listReq(svc, "path/main/db/AB/CD/1~GUID"), OpList, "path/main/db/AB"},
+		{getReq(svc, "main/db/0F/12/1~GUID/receipt.json"), OpRead, "main/db/0F"},
+		{deleteReq(svc, "path/_internal/db/61/56/5~GUID/receipt.json"), OpDelete, "path/_internal/db/61"},
+		{listReq(svc, "path/main/db/"), OpList, ""},
+		{getReq(svc, "path/main/dma/3C/9A/1~GUID/receipt.json"), OpRead, "path/main/dma/3C"},
+		{deleteReq(svc, "main/summary/0F/12/1~GUID/receipt.json"), OpDelete, "main/summary/0F"},
+		{listReq(svc, "path/main/summary/"), OpList, ""},
+	}
+	for _, test := range tests {
+		if class := opClassOf(test.req.Operation.Name); class != test.class {
+			t.Errorf("%s: expected class %s got %s", test.req.Operation.Name, test.class, class)
+		}
+		if prefix := requestPrefix(test.req); prefix != test.prefix {
+			t.Errorf("%s: expected prefix \"%s\" got \"%s\"", test.req.Operation.Name, test.prefix, prefix)
+		}
+	}
+}
+
+func listReq(svc *s3.S3, prefix string) *request.Request {
+	req, _ := svc.ListObjectVersionsRequest(&s3.ListObjectVersionsInput{Bucket: aws.String("bucket"), Prefix: aws.String(prefix)})
+	return req
+}
+
+func getReq(svc *s3.S3, key string) *request.Request {
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key)})
+	return req
+}
+
+func deleteReq(svc *s3.S3, key string) *request.Request {
+	req, _ := svc.DeleteObjectsRequest(&s3.DeleteObjectsInput{
+		Bucket: aws.String("bucket"),
+		Delete: &s3.Delete{Objects: []*s3.ObjectIdentifier{{Key: aws.String(key)}}},
+	})
+	return req
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/receipt"
+	"path"
+	"strings"
+)
+
+// rebuildFixer returns a receiptFixer which rebuilds the receipt objects list from the objects in S3
+func (s *S3) rebuildFixer() receiptFixer {
+	svc := s.GetClient()
+	return func(key string, rcpt *receipt.ReceiptJson) (bool, error) {
+		return s.RebuildReceipt(svc, key, rcpt)
+	}
+}
+
+// RebuildReceipt lists the Splunk bucket holding the receipt.json key and rebuilds the receipt objects list,
+// journal_size and content_hash from the actual objects and sizes
+func (s *S3) RebuildReceipt(svc *s3.S3, key string, rcpt *receipt.ReceiptJson) (bool, error) {
+	objects, err := s.bucketObjects(svc, key)
+	if err != nil {
+		return false, err
+	}
+	return rcpt.RebuildObjects(receiptObjectNames(path.Dir(key), objects))
+}
+
+// receiptObjectNames converts the keys of objects below dir to receipt object names. Only objects inside a
+// guidSplunk-<guid>/ directory are listed by receipts.
+func receiptObjectNames(dir string, objects map[string]int64) map[string]int64 {
+	names := map[string]int64{}
+	for key, size := range objects {
+		rel := strings.TrimPrefix(key, dir+"/")
+		if rel == key || !strings.HasPrefix(rel, "guidSplunk-") || !strings.Contains(rel, "/") {
+			continue
+		}
+		names["./"+rel] = size
+	}
+	return names
+}
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestReceiptObjectNames(t *testing.T) {
+	dir := "main/db/AB/CD/1~GUID"
+	names := receiptObjectNames(dir, map[string]int64{
+		dir + "/receipt.json":                       100,
+		dir + "/receipt.json.20200101000000":        100,
+		dir + "/guidSplunk-GUID/bloomfilter":        10,
+		dir + "/guidSplunk-GUID/rawdata/journal.gz": 20,
+		dir + "2/guidSplunk-GUID/bloomfilter":       30,
+	})
+	if len(names) != 2 || names["./guidSplunk-GUID/bloomfilter"] != 10 || names["./guidSplunk-GUID/rawdata/journal.gz"] != 20 {
+		t.Errorf("unexpected object names %v", names)
+	}
+}
+
+func TestGetUsage_rebuild(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"receipt", "rebuild", "--s3bucket", "splunks3restore", "--region", "us-west-2", "index~ID1"}
+	opts := GetUsage(args, "1.0.0")
+	if opts.Config.Receipt || !opts.Config.Fixup || !opts.Config.Rebuild || !opts.Config.DryRun {
+		t.Errorf("expected receipt rebuild to run as a dry run fixup")
+	}
+	args = []string{"receipt", "rebuild", "--apply", "--s3bucket", "splunks3restore", "--region", "us-west-2", "--bucketids", "bids.txt"}
+	opts = GetUsage(args, "1.0.0")
+	if opts.Config.DryRun {
+		t.Errorf("expected --apply to disable the dry run")
+	}
+}
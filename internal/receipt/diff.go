@@ -0,0 +1,71 @@
+package receipt
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Change is a field level difference between two receipts
+type Change struct {
+	Field string // Section qualified field, e.g. manifest.frozen_in_cluster, or objects for object entries
+	Old   string // Empty if the field was added
+	New   string // Empty if the field was removed
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("field=%s old=\"%s\" new=\"%s\"", c.Field, c.Old, c.New)
+}
+
+// Diff returns the changes from old to new. Manifest and user_data fields are compared first, followed by
+// objects which have been added, removed or resized.
+func Diff(old, new *Receipt) []Change {
+	changes := diffFields(keyManifest, &old.Manifest.fields, &new.Manifest.fields)
+	changes = append(changes, diffFields(keyUserData, &old.UserData.fields, &new.UserData.fields)...)
+	return append(changes, diffObjects(old.Objects, new.Objects)...)
+}
+
+func diffFields(section string, old, new *fields) []Change {
+	changes := []Change{}
+	keys := old.Keys()
+	for _, key := range new.Keys() {
+		if !old.Has(key) {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		o, n := old.String(key), new.String(key)
+		if old.Has(key) == new.Has(key) && o == n {
+			continue
+		}
+		changes = append(changes, Change{Field: section + "." + key, Old: o, New: n})
+	}
+	return changes
+}
+
+func diffObjects(old, new []*Object) []Change {
+	sizes := func(objs []*Object) map[string]string {
+		m := map[string]string{}
+		for _, obj := range objs {
+			m[obj.Name] = fmt.Sprintf("%s:%d", obj.Name, obj.Size)
+		}
+		return m
+	}
+	o, n := sizes(old), sizes(new)
+	names := []string{}
+	for name := range o {
+		names = append(names, name)
+	}
+	for name := range n {
+		if _, ok := o[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	changes := []Change{}
+	for _, name := range names {
+		if o[name] != n[name] {
+			changes = append(changes, Change{Field: keyObjects, Old: o[name], New: n[name]})
+		}
+	}
+	return changes
+}
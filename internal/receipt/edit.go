@@ -0,0 +1,122 @@
+package receipt
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// fieldKind describes the values a manifest field accepts
+type fieldKind int
+
+const (
+	kindString fieldKind = iota
+	kindInt
+	kindFlag
+)
+
+// manifestSchema maps the manifest fields written by Splunk to the kind of their values
+var manifestSchema = map[string]fieldKind{
+	"id":                kindString,
+	"path":              kindString,
+	"raw_size":          kindInt,
+	"event_count":       kindInt,
+	"host_count":        kindInt,
+	"source_count":      kindInt,
+	"sourcetype_count":  kindInt,
+	"size_on_disk":      kindInt,
+	"modtime":           kindInt,
+	"frozen_in_cluster": kindFlag,
+	"origin_site":       kindString,
+	"tsidx_minified":    kindFlag,
+	"journal_size":      kindInt,
+}
+
+// Edit is a change to a receipt, either a manifest field assignment or the removal of objects
+type Edit struct {
+	Field        string // Manifest field to set
+	Value        string // New value of Field
+	RemoveObject string // Name or glob of objects to remove
+}
+
+// ParseEdit parses a manifest assignment of the form field=value or manifest.field=value
+func ParseEdit(assignment string) (Edit, error) {
+	parts := strings.SplitN(assignment, "=", 2)
+	if len(parts) != 2 {
+		return Edit{}, fmt.Errorf("\"%s\" is not of the form field=value", assignment)
+	}
+	field := strings.TrimPrefix(strings.TrimSpace(parts[0]), keyManifest+".")
+	edit := Edit{Field: field, Value: parts[1]}
+	return edit, edit.Validate()
+}
+
+// RemoveObjectEdit returns an edit removing the objects whose name matches the name or glob
+func RemoveObjectEdit(name string) (Edit, error) {
+	if _, err := path.Match(name, ""); err != nil {
+		return Edit{}, fmt.Errorf("invalid object pattern \"%s\": %v", name, err)
+	}
+	return Edit{RemoveObject: name}, nil
+}
+
+// Validate checks the field name and value against the manifest schema
+func (e Edit) Validate() error {
+	if e.RemoveObject != "" {
+		return nil
+	}
+	kind, ok := manifestSchema[e.Field]
+	if !ok {
+		return fmt.Errorf("unknown manifest field \"%s\", expecting one of %s", e.Field, strings.Join(ManifestFields, ", "))
+	}
+	switch kind {
+	case kindInt:
+		if _, err := strconv.ParseUint(e.Value, 10, 64); err != nil {
+			return fmt.Errorf("manifest field %s expects a non-negative integer, got \"%s\"", e.Field, e.Value)
+		}
+	case kindFlag:
+		if e.Value != "0" && e.Value != "1" {
+			return fmt.Errorf("manifest field %s expects 0 or 1, got \"%s\"", e.Field, e.Value)
+		}
+	}
+	return nil
+}
+
+// Apply applies edits and resets the content_hash if anything changed
+func (r *ReceiptJson) Apply(edits []Edit) (bool, error) {
+	r.mu.Lock()
+	changed := false
+	for _, edit := range edits {
+		if err := edit.Validate(); err != nil {
+			r.mu.Unlock()
+			return false, err
+		}
+		if edit.RemoveObject != "" {
+			changed = r.removeObjects(edit.RemoveObject) || changed
+			continue
+		}
+		if r.Manifest.Has(edit.Field) && r.Manifest.String(edit.Field) == edit.Value {
+			continue
+		}
+		r.addSection(keyManifest)
+		r.Manifest.SetString(edit.Field, edit.Value)
+		changed = true
+	}
+	r.mu.Unlock()
+	if !changed {
+		return false, nil
+	}
+	return true, r.ResetContentHash()
+}
+
+func (r *ReceiptJson) removeObjects(pattern string) bool {
+	kept := r.Objects[:0]
+	for _, obj := range r.Objects {
+		if matched, _ := path.Match(pattern, obj.Name); matched || obj.Name == pattern {
+			continue
+		}
+		kept = append(kept, obj)
+	}
+	removed := len(kept) != len(r.Objects)
+	r.Objects = kept
+	return removed
+}
@@ -0,0 +1,65 @@
+package receipt
+
+import (
+	"testing"
+)
+
+func TestParseEdit(t *testing.T) {
+	edit, err := ParseEdit("manifest.origin_site=site2")
+	if err != nil || edit.Field != "origin_site" || edit.Value != "site2" {
+		t.Errorf("unexpected edit %+v: %v", edit, err)
+	}
+	for _, invalid := range []string{"origin_site", "unknown=1", "modtime=yesterday", "tsidx_minified=2"} {
+		if _, err := ParseEdit(invalid); err == nil {
+			t.Errorf("expected \"%s\" to be rejected", invalid)
+		}
+	}
+}
+
+func TestReceiptJson_Apply(t *testing.T) {
+	r := mustNew(t, getPath("../../test/fixtures/testdata/receipt.json-ok"))
+	site, _ := ParseEdit("origin_site=site2")
+	modtime, _ := ParseEdit("modtime=1600000000")
+	remove, _ := RemoveObjectEdit("./guidSplunk-*/*.tsidx")
+	changed, err := r.Apply([]Edit{site, modtime, remove})
+	if err != nil || !changed {
+		t.Fatalf("expected the receipt to change: %v", err)
+	}
+	edited := mustBytes(t, r.Bytes())
+	if !edited.HashesMatch() {
+		t.Errorf("content_hash was not recomputed")
+	}
+	if edited.Manifest.OriginSite() != "site2" || edited.Manifest.ModTime() != "1600000000" {
+		t.Errorf("manifest fields were not set")
+	}
+	if len(edited.Objects) != 12 {
+		t.Errorf("expected 3 tsidx objects to be removed, %d objects left", len(edited.Objects))
+	}
+	if changed, _ := edited.Apply([]Edit{site}); changed {
+		t.Errorf("setting a field to its current value should not change the receipt")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	orig := mustNew(t, getPath("../../test/fixtures/testdata/receipt.json-ok"))
+	zeroed, err := orig.Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zeroed.ZeroFrozenInCluster(); err != nil {
+		t.Fatal(err)
+	}
+	changes := Diff(orig.Receipt, zeroed.Receipt)
+	if len(changes) != 2 {
+		t.Fatalf("expected 2 changes got %v", changes)
+	}
+	if changes[0] != (Change{Field: "manifest.frozen_in_cluster", Old: "1", New: "0"}) {
+		t.Errorf("unexpected change %v", changes[0])
+	}
+	if changes[1].Field != "user_data.content_hash" || changes[1].Old != orig.ContentHash || changes[1].New != zeroed.ContentHash {
+		t.Errorf("unexpected change %v", changes[1])
+	}
+	if len(Diff(orig.Receipt, orig.Receipt)) != 0 {
+		t.Errorf("expected no changes comparing a receipt to itself")
+	}
+}
@@ -0,0 +1,423 @@
+package receipt
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	keyObjects     = "objects"
+	keyManifest    = "manifest"
+	keyUserData    = "user_data"
+	keyContentHash = "content_hash"
+)
+
+// Receipt is the typed model of a SmartStore receipt.json.
+//
+// Members are serialized in the order they were parsed and values which have not been edited are written with
+// their original encoding, so the serialized receipt is byte-exact and its content_hash stays computable. This
+// holds for compact receipts as Splunk writes them. Whitespace between tokens is not kept, a pretty-printed
+// receipt is written compact and so gets a different body and content_hash.
+type Receipt struct {
+	Objects  []*Object
+	Manifest *Manifest
+	UserData *UserData
+	order    []string                   // top level keys in the parsed order
+	extra    map[string]json.RawMessage // top level members which are not modelled
+	trailer  []byte                     // whitespace following the receipt, not part of the content hash
+}
+
+// Object is an entry of the receipt objects list
+type Object struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	raw  json.RawMessage
+	orig struct {
+		name string
+		size int64
+	}
+}
+
+// Manifest is the receipt manifest. Values are strings as written by Splunk.
+type Manifest struct {
+	fields
+}
+
+// UserData is the receipt user_data
+type UserData struct {
+	fields
+}
+
+// ManifestFields are the manifest fields written by Splunk
+var ManifestFields = []string{
+	"id", "path", "raw_size", "event_count", "host_count", "source_count", "sourcetype_count", "size_on_disk",
+	"modtime", "frozen_in_cluster", "origin_site", "tsidx_minified", "journal_size",
+}
+
+// ID returns the bucket id of the manifest
+func (m *Manifest) ID() string { return m.String("id") }
+
+// Path returns the bucket directory name
+func (m *Manifest) Path() string { return m.String("path") }
+
+// FrozenInCluster returns "1" if the bucket is frozen
+func (m *Manifest) FrozenInCluster() string { return m.String("frozen_in_cluster") }
+
+// OriginSite returns the site which created the bucket
+func (m *Manifest) OriginSite() string { return m.String("origin_site") }
+
+// TsidxMinified returns "1" if the bucket tsidx files are minified
+func (m *Manifest) TsidxMinified() string { return m.String("tsidx_minified") }
+
+// ModTime returns the modification time as epoch seconds
+func (m *Manifest) ModTime() string { return m.String("modtime") }
+
+// JournalSize returns the size of rawdata/journal.gz
+func (m *Manifest) JournalSize() string { return m.String("journal_size") }
+
+// ContentHash returns the content_hash or an empty string if it is missing
+func (u *UserData) ContentHash() string { return u.String(keyContentHash) }
+
+// CipherBlob returns the encrypted key of the bucket
+func (u *UserData) CipherBlob() string { return u.String("cipher_blob") }
+
+// UploaderGUID returns the GUID of the indexer which uploaded the bucket
+func (u *UserData) UploaderGUID() string { return u.String("uploader_guid") }
+
+// Parse reads a receipt.json from reader. There is no limit on the size of the receipt. Values are compacted.
+func Parse(reader io.Reader) (*Receipt, error) {
+	dec := json.NewDecoder(reader)
+	r := &Receipt{
+		Manifest: &Manifest{},
+		UserData: &UserData{},
+		extra:    map[string]json.RawMessage{},
+	}
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		key, err := readKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		r.order = append(r.order, key)
+		switch key {
+		case keyObjects:
+			err = r.parseObjects(dec)
+		case keyManifest:
+			err = r.Manifest.decode(dec)
+		case keyUserData:
+			err = r.UserData.decode(dec)
+		default:
+			var raw json.RawMessage
+			if err = dec.Decode(&raw); err == nil {
+				raw, err = compact(raw)
+			}
+			r.extra[key] = raw
+		}
+		if err != nil {
+			return nil, fmt.Errorf("receipt %s: %v", key, err)
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	rest := &bytes.Buffer{}
+	if _, err := io.Copy(rest, io.MultiReader(dec.Buffered(), reader)); err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(rest.Bytes())) > 0 {
+		return nil, fmt.Errorf("unexpected content after receipt")
+	}
+	r.trailer = rest.Bytes()
+	return r, nil
+}
+
+func (r *Receipt) parseObjects(dec *json.Decoder) error {
+	if err := expectDelim(dec, '['); err != nil {
+		return err
+	}
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		raw, err := compact(raw)
+		if err != nil {
+			return err
+		}
+		obj := &Object{}
+		if err := json.Unmarshal(raw, obj); err != nil {
+			return err
+		}
+		obj.raw = raw
+		obj.orig.name, obj.orig.size = obj.Name, obj.Size
+		r.Objects = append(r.Objects, obj)
+	}
+	return expectDelim(dec, ']')
+}
+
+// WriteTo serializes the receipt to w
+func (r *Receipt) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countWriter{w: bw}
+	err := r.write(cw, false)
+	if err == nil {
+		_, err = cw.Write(r.trailer)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return cw.n, err
+}
+
+// Bytes returns the serialized receipt
+func (r *Receipt) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	r.WriteTo(buf) // nolint
+	return buf.Bytes()
+}
+
+// CalculateHash returns the SHA256 of the receipt without its content_hash as upper case hex
+func (r *Receipt) CalculateHash() string {
+	hash := sha256.New()
+	r.write(hash, true) // nolint
+	return strings.ToUpper(fmt.Sprintf("%x", hash.Sum(nil)))
+}
+
+func (r *Receipt) write(w io.Writer, skipHash bool) error {
+	ew := &errWriter{w: w}
+	ew.writeString("{")
+	for i, key := range r.order {
+		if i > 0 {
+			ew.writeString(",")
+		}
+		ew.writeKey(key)
+		switch key {
+		case keyObjects:
+			ew.writeString("[")
+			for j, obj := range r.Objects {
+				if j > 0 {
+					ew.writeString(",")
+				}
+				ew.write(obj.encode())
+			}
+			ew.writeString("]")
+		case keyManifest:
+			r.Manifest.write(ew, "")
+		case keyUserData:
+			skip := ""
+			if skipHash {
+				skip = keyContentHash
+			}
+			r.UserData.write(ew, skip)
+		default:
+			ew.write(r.extra[key])
+		}
+	}
+	ew.writeString("}")
+	return ew.err
+}
+
+// addSection makes sure a top level member is serialized, new members are appended
+func (r *Receipt) addSection(key string) {
+	for _, k := range r.order {
+		if k == key {
+			return
+		}
+	}
+	r.order = append(r.order, key)
+}
+
+// encode returns the original encoding of the object unless it has been edited
+func (o *Object) encode() []byte {
+	if o.raw != nil && o.orig.name == o.Name && o.orig.size == o.Size {
+		return o.raw
+	}
+	return []byte(fmt.Sprintf(`{"name":%s,"size":%d}`, encodeString(o.Name), o.Size))
+}
+
+// fields is a JSON object which preserves the order and encoding of its members
+type fields struct {
+	keys []string
+	vals map[string]json.RawMessage
+}
+
+func (f *fields) decode(dec *json.Decoder) error {
+	f.keys = nil
+	f.vals = map[string]json.RawMessage{}
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		key, err := readKey(dec)
+		if err != nil {
+			return err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		}
+		if raw, err = compact(raw); err != nil {
+			return err
+		}
+		if _, ok := f.vals[key]; !ok {
+			f.keys = append(f.keys, key)
+		}
+		f.vals[key] = raw
+	}
+	return expectDelim(dec, '}')
+}
+
+func (f *fields) write(ew *errWriter, skip string) {
+	ew.writeString("{")
+	first := true
+	for _, key := range f.keys {
+		if key == skip {
+			continue
+		}
+		if !first {
+			ew.writeString(",")
+		}
+		first = false
+		ew.writeKey(key)
+		ew.write(f.vals[key])
+	}
+	ew.writeString("}")
+}
+
+// Keys returns the field names in order
+func (f *fields) Keys() []string {
+	return append([]string{}, f.keys...)
+}
+
+// Has returns true if the field exists
+func (f *fields) Has(key string) bool {
+	_, ok := f.vals[key]
+	return ok
+}
+
+// String returns a field as a string. Numbers are returned in their JSON form.
+func (f *fields) String(key string) string {
+	raw, ok := f.vals[key]
+	if !ok {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return string(raw)
+}
+
+// SetString sets a field to a string value. New fields are appended.
+func (f *fields) SetString(key, value string) {
+	f.setRaw(key, encodeString(value))
+}
+
+func (f *fields) setRaw(key string, raw json.RawMessage) {
+	if f.vals == nil {
+		f.vals = map[string]json.RawMessage{}
+	}
+	if _, ok := f.vals[key]; !ok {
+		f.keys = append(f.keys, key)
+	}
+	f.vals[key] = raw
+}
+
+// Delete removes a field. Returns false if it did not exist.
+func (f *fields) Delete(key string) bool {
+	if _, ok := f.vals[key]; !ok {
+		return false
+	}
+	delete(f.vals, key)
+	for i, k := range f.keys {
+		if k == key {
+			f.keys = append(f.keys[:i], f.keys[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// encodeString encodes a JSON string without HTML escaping as Splunk does
+func encodeString(s string) []byte {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s) // nolint
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
+
+// compact removes the whitespace between the tokens of a value. Compact values are returned as they are.
+func compact(raw json.RawMessage) (json.RawMessage, error) {
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, raw); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(buf.Bytes(), raw) {
+		return raw, nil
+	}
+	return buf.Bytes(), nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected '%s' got '%v'", delim, tok)
+	}
+	return nil
+}
+
+func readKey(dec *json.Decoder) (string, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a key got '%v'", tok)
+	}
+	return key, nil
+}
+
+// errWriter remembers the first write error
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) write(b []byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(b)
+}
+
+func (e *errWriter) writeString(s string) {
+	e.write([]byte(s))
+}
+
+func (e *errWriter) writeKey(key string) {
+	e.write(encodeString(key))
+	e.writeString(":")
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,108 @@
+package receipt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParse_RoundTrip(t *testing.T) {
+	for _, p := range []string{"receipt.json-ok", "receipt.json-invalidhash", "receipt.json-nohash"} {
+		fp := getPath(filepath.Join("../../test/fixtures/testdata/", p))
+		content, err := ioutil.ReadFile(fp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := Parse(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("%s: %v", p, err)
+		}
+		if !bytes.Equal(r.Bytes(), content) {
+			t.Errorf("%s: serialized receipt differs from the original", p)
+		}
+	}
+}
+
+func TestParse_Pretty(t *testing.T) {
+	content, err := ioutil.ReadFile(getPath("../../test/fixtures/testdata/receipt.json-ok"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pretty := &bytes.Buffer{}
+	if err := json.Indent(pretty, content, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Parse(bytes.NewReader(pretty.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only compact receipts round-trip byte for byte, pretty-printed ones are written compact
+	if bytes.Equal(r.Bytes(), pretty.Bytes()) || !bytes.Equal(r.Bytes(), content) {
+		t.Errorf("expected a pretty-printed receipt to be written compact")
+	}
+}
+
+func TestParse_Typed(t *testing.T) {
+	r := mustNew(t, getPath("../../test/fixtures/testdata/receipt.json-ok"))
+	if len(r.Objects) != 15 {
+		t.Errorf("expected 15 objects got %d", len(r.Objects))
+	}
+	if r.Objects[0].Name != "./guidSplunk-164CBEAE-51DE-4196-83B0-8366DDEA9537/bloomfilter" || r.Objects[0].Size != 930223 {
+		t.Errorf("unexpected first object %+v", r.Objects[0])
+	}
+	if r.Manifest.ID() != "_internal~275~609B1724-5A77-4C70-81DC-8444B5014D0D" || r.Manifest.FrozenInCluster() != "1" {
+		t.Errorf("unexpected manifest id \"%s\" frozen \"%s\"", r.Manifest.ID(), r.Manifest.FrozenInCluster())
+	}
+	if r.UserData.UploaderGUID() != "164CBEAE-51DE-4196-83B0-8366DDEA9537" {
+		t.Errorf("unexpected uploader guid %s", r.UserData.UploaderGUID())
+	}
+	keys := r.Manifest.Keys()
+	if keys[0] != "id" || keys[len(keys)-1] != "journal_size" {
+		t.Errorf("manifest key order was not preserved: %v", keys)
+	}
+}
+
+func TestParse_Large(t *testing.T) {
+	objects := []string{}
+	for i := 0; i < 5000; i++ {
+		objects = append(objects, fmt.Sprintf(`{"name":"./guidSplunk-GUID/%d.tsidx","size":%d}`, i, i))
+	}
+	content := `{"objects":[` + strings.Join(objects, ",") + `],"manifest":{"id":"main~1~GUID","frozen_in_cluster":"1"},"user_data":{"cipher_blob":"AQID"}}`
+	if len(content) < 128*1024 {
+		t.Fatalf("test receipt is too small: %d bytes", len(content))
+	}
+	r := mustBytes(t, []byte(content))
+	if len(r.Objects) != 5000 {
+		t.Errorf("expected 5000 objects got %d", len(r.Objects))
+	}
+	if err := r.ZeroFrozenInCluster(); err != nil {
+		t.Fatal(err)
+	}
+	zeroed := mustBytes(t, r.Bytes())
+	if !zeroed.HashesMatch() || zeroed.CheckFrozenInCluster() {
+		t.Errorf("large receipt was not zeroed and re-hashed")
+	}
+	if !strings.HasSuffix(string(r.Bytes()), `"cipher_blob":"AQID","content_hash":"`+zeroed.CalculatedHash+`"}}`) {
+		t.Errorf("content_hash was not appended to user_data")
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, content := range []string{``, `{"objects":[`, `[]`, `{"manifest":{"id":"x"}} trailing`} {
+		if _, err := Parse(strings.NewReader(content)); err == nil {
+			t.Errorf("expected an error parsing \"%s\"", content)
+		}
+	}
+}
+
+func TestObject_Edit(t *testing.T) {
+	r := mustBytes(t, []byte(`{"objects":[{"name":"./a","size":1}],"manifest":{},"user_data":{}}`))
+	r.Objects[0].Size = 2
+	if got := string(r.Receipt.Bytes()); got != `{"objects":[{"name":"./a","size":2}],"manifest":{},"user_data":{}}` {
+		t.Errorf("unexpected serialization %s", got)
+	}
+}
@@ -0,0 +1,84 @@
+package receipt
+
+import (
+	"path"
+	"sort"
+	"strconv"
+)
+
+// RebuildObjects replaces the objects list with sizes, a map of object names as written in receipts
+// (./guidSplunk-<guid>/...) to their actual size. Entries which still exist keep their position, new entries are
+// appended in name order. Files Splunk is still writing, such as *.tmp, are left out. journal_size is updated if the manifest has it and the journal is listed. The
+// content_hash is reset if anything changed, other user_data such as cipher_blob is kept.
+func (r *ReceiptJson) RebuildObjects(sizes map[string]int64) (bool, error) {
+	r.mu.Lock()
+	changed := false
+	seen := map[string]bool{}
+	kept := make([]*Object, 0, len(sizes))
+	for _, obj := range r.Objects {
+		size, ok := sizes[obj.Name]
+		if !ok || seen[obj.Name] || isInFlight(obj.Name) {
+			changed = true
+			continue
+		}
+		seen[obj.Name] = true
+		if obj.Size != size {
+			obj.Size = size
+			changed = true
+		}
+		kept = append(kept, obj)
+	}
+	var added []string
+	for name := range sizes {
+		if !seen[name] && !isInFlight(name) {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		kept = append(kept, &Object{Name: name, Size: sizes[name]})
+		changed = true
+	}
+	r.Objects = kept
+	r.addSection(keyObjects)
+
+	if r.Manifest.Has("journal_size") {
+		for _, obj := range r.Objects {
+			if !isJournal(obj.Name) {
+				continue
+			}
+			size := strconv.FormatInt(obj.Size, 10)
+			if r.Manifest.JournalSize() != size {
+				r.Manifest.SetString("journal_size", size)
+				changed = true
+			}
+			break
+		}
+	}
+	r.mu.Unlock()
+	if !changed {
+		return false, nil
+	}
+	return true, r.ResetContentHash()
+}
+
+// isInFlight returns true for temporary files written while Splunk builds or uploads a bucket
+func isInFlight(name string) bool {
+	switch path.Ext(name) {
+	case ".tmp", ".lock", ".partial":
+		return true
+	}
+	return false
+}
+
+// isJournal returns true for the gzip, lz4 or zstd compressed rawdata journal of a bucket
+func isJournal(name string) bool {
+	if path.Base(path.Dir(name)) != "rawdata" {
+		return false
+	}
+	switch path.Base(name) {
+	case "journal.gz", "journal.lz4", "journal.zst":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package receipt
+
+import (
+	"testing"
+)
+
+func TestReceiptJson_RebuildObjects(t *testing.T) {
+	r := mustNew(t, getPath("../../test/fixtures/testdata/receipt.json-ok"))
+	cipher := r.UserData.CipherBlob()
+	sizes := map[string]int64{}
+	for _, obj := range r.Objects {
+		sizes[obj.Name] = obj.Size
+	}
+	if changed, err := r.RebuildObjects(sizes); changed || err != nil {
+		t.Fatalf("expected no change when the objects match: %v", err)
+	}
+
+	guid := "./guidSplunk-164CBEAE-51DE-4196-83B0-8366DDEA9537/"
+	delete(sizes, guid+"bloomfilter")
+	sizes[guid+"rawdata/journal.gz"] = 100
+	sizes[guid+"rawdata/journal.gz.tmp"] = 1
+	sizes[guid+"a.tsidx"] = 5
+	changed, err := r.RebuildObjects(sizes)
+	if err != nil || !changed {
+		t.Fatalf("expected the receipt to change: %v", err)
+	}
+	rebuilt := mustBytes(t, r.Bytes())
+	if !rebuilt.HashesMatch() {
+		t.Errorf("content_hash was not recomputed")
+	}
+	if rebuilt.Manifest.JournalSize() != "100" {
+		t.Errorf("journal_size was not updated, got %s", rebuilt.Manifest.JournalSize())
+	}
+	if rebuilt.UserData.CipherBlob() != cipher {
+		t.Errorf("cipher_blob was not preserved")
+	}
+	if len(rebuilt.Objects) != 15 {
+		t.Fatalf("expected 15 objects, got %d", len(rebuilt.Objects))
+	}
+	if rebuilt.Objects[0].Name != guid+"1519706145-1519700743-7361737351116547826.tsidx" {
+		t.Errorf("existing objects should keep their order, first is %s", rebuilt.Objects[0].Name)
+	}
+	if rebuilt.Objects[14].Name != guid+"a.tsidx" {
+		t.Errorf("new objects should be appended in name order")
+	}
+	for _, obj := range rebuilt.Objects {
+		if obj.Name == guid+"rawdata/journal.gz.tmp" {
+			t.Errorf("temporary files must not be added to the receipt")
+		}
+	}
+}
@@ -1,24 +1,16 @@
 package receipt
 
 import (
-	"bufio"
 	"bytes"
-	"crypto/sha256"
-	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
-	"regexp"
-	"strings"
 	"sync"
 )
 
-var chash1 = regexp.MustCompile(`"content_hash":\s*"([^"]+)"\s*,`)
-var chash2 = regexp.MustCompile(`,\s*"content_hash":\s*"([^"]+)"`)
-var nochash1 = regexp.MustCompile(`("cipher_blob":"[^"]+")(,?)`)
-var checkfrozen = regexp.MustCompile(`"frozen_in_cluster":(\s*)"1"`)
-
+// ReceiptJson is a receipt.json with its content and calculated hashes
 type ReceiptJson struct {
+	*Receipt
 	Path           string
 	ContentHash    string
 	CalculatedHash string
@@ -26,10 +18,47 @@ type ReceiptJson struct {
 	mu             *sync.Mutex
 }
 
-func New(fpath string) *ReceiptJson {
-	r := &ReceiptJson{mu: &sync.Mutex{}}
-	sethash(r, fpath)
-	return r
+// New reads the receipt.json file at fpath
+func New(fpath string) (*ReceiptJson, error) {
+	fh, err := os.Open(fpath)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	r, err := Read(fh)
+	if err != nil {
+		return nil, err
+	}
+	r.Path = fpath
+	return r, nil
+}
+
+// Read reads a receipt.json from reader
+func Read(reader io.Reader) (*ReceiptJson, error) {
+	model, err := Parse(reader)
+	if err != nil {
+		return nil, err
+	}
+	r := &ReceiptJson{Receipt: model, mu: &sync.Mutex{}}
+	r.refresh()
+	return r, nil
+}
+
+// NewBytes creates a receipt from the content of a receipt.json
+func NewBytes(content []byte) (*ReceiptJson, error) {
+	return Read(bytes.NewReader(content))
+}
+
+// Bytes returns the receipt.json content
+func (r *ReceiptJson) Bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Receipt.Bytes()
+}
+
+// WriteFile writes the receipt.json content to fpath
+func (r *ReceiptJson) WriteFile(fpath string) error {
+	return ioutil.WriteFile(fpath, r.Bytes(), 0644)
 }
 
 // HashesMatch returns true if the receipt.json content_hash and the calculated hash matches
@@ -39,178 +68,53 @@ func (r *ReceiptJson) HashesMatch() bool {
 
 // CheckFrozenInCluster checks to see if frozen_in_cluster has been set to 1
 func (r *ReceiptJson) CheckFrozenInCluster() bool {
-	matched := false
-	scanner := func(buf []byte) {
-		m := checkfrozen.Match(buf)
-		if m {
-			matched = m
-		}
-	}
-	scan(r.Path, scanner)
-	return matched
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Manifest.FrozenInCluster() == "1"
 }
 
-// ZeroFrozenInCluster sets the value frozen_in_cluster to 0. Returns path to receipt file.
-//
-// If update is true it will replace the existing file.
-func (r *ReceiptJson) ZeroFrozenInCluster(update bool) (string, error) {
-	var newpath string
+// ZeroFrozenInCluster sets the value frozen_in_cluster to 0 and resets the content_hash
+func (r *ReceiptJson) ZeroFrozenInCluster() error {
 	r.mu.Lock()
-	f, err := ioutil.TempFile("/tmp", "resetfrozen-*-receipt.json")
-	if err != nil {
-		return "", err
+	if r.Manifest.Has("frozen_in_cluster") {
+		r.Manifest.SetString("frozen_in_cluster", "0")
 	}
-	newpath = f.Name()
-	scanner := func(buf []byte) {
-		matches := checkfrozen.FindSubmatch(buf)
-		if len(matches) == 2 {
-			newsetting := fmt.Sprintf(`"frozen_in_cluster":%s"0"`, matches[1])
-			buf = checkfrozen.ReplaceAll(buf, []byte(newsetting))
-		}
-
-		_, err := f.Write(buf)
-		if err != nil {
-			log.Printf("restore status=error: %v", err)
-		}
-	}
-	scan(r.Path, scanner)
-	f.Close()
 	r.mu.Unlock()
-	New(newpath).ResetContentHash(true)
-	if update {
-		err = r.replaceSelf(newpath)
-		if err != nil {
-			return "", err
-		}
-		return r.Path, nil
-	}
-	return newpath, nil
+	return r.ResetContentHash()
 }
 
-// ResetContentHash updates the content_hash field. Returns path to receipt file which can be moved.
-func (r *ReceiptJson) ResetContentHash(update bool) (string, error) {
-	var newpath string
+// FreezeInCluster sets the value frozen_in_cluster to 1 and resets the content_hash
+func (r *ReceiptJson) FreezeInCluster() error {
 	r.mu.Lock()
-	f, err := ioutil.TempFile("/tmp", "fixup-*-receipt.json")
-	if err != nil {
-		return "", err
-	}
-	newpath = f.Name()
-	rplc1 := []byte(fmt.Sprintf(`"content_hash":"%s",`, r.CalculatedHash))
-	rplc2 := []byte(fmt.Sprintf(`,"content_hash":"%s"`, r.CalculatedHash))
-	replaced := false
-	scanner := func(buf []byte) {
-		if replaced {
-			f.Write(buf)
-			return
-		}
-		if r.ContentHash != "" {
-			match1 := chash1.FindSubmatch(buf)
-			if len(match1) >= 2 {
-				buf = chash1.ReplaceAll(buf, rplc1)
-				replaced = true
-			}
-
-			match2 := chash2.FindSubmatch(buf)
-			if len(match2) >= 2 {
-				buf = chash2.ReplaceAll(buf, rplc2)
-				replaced = true
-			}
-		} else {
-			match3 := nochash1.FindSubmatch(buf)
-			if r.ContentHash == "" && len(match3) >= 3 {
-				newhash := append(match3[1], rplc2...)
-				newhash = append(newhash, match3[2]...)
-				buf = nochash1.ReplaceAll(buf, newhash)
-				replaced = true
-			}
-		}
-		f.Write(buf)
-	}
-	scan(r.Path, scanner)
-	f.Close()
+	r.addSection(keyManifest)
+	r.Manifest.SetString("frozen_in_cluster", "1")
 	r.mu.Unlock()
-	if update {
-		err = r.replaceSelf(newpath)
-		if err != nil {
-			return "", err
-		}
-		return r.Path, nil
-	}
-	return newpath, nil
+	return r.ResetContentHash()
 }
 
-// replaceSelf Replace the current Path with contents of fpath and recalculates the hashes
-func (r *ReceiptJson) replaceSelf(fpath string) error {
+// ResetContentHash updates the content_hash field
+func (r *ReceiptJson) ResetContentHash() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	n := New(fpath)
-	r.ContentHash = n.ContentHash
-	r.CalculatedHash = n.CalculatedHash
-	r.matched = n.matched
-	return os.Rename(fpath, r.Path)
+	r.addSection(keyUserData)
+	r.UserData.SetString(keyContentHash, r.Receipt.CalculateHash())
+	r.refresh()
+	return nil
 }
 
-func scan(fpath string, fn func([]byte)) {
-	reader, err := os.Open(fpath)
-	defer reader.Close()
-	if err != nil {
-		panic(err)
-	}
-	scanner := bufio.NewScanner(reader)
-	err = scanner.Err()
-	if err != nil {
-		panic(err)
-	}
-
-	for scanner.Scan() {
-		buf := scanner.Bytes()
-		fn(buf)
-	}
-}
-
-// setHash scans fpath as a "receipt.json" and updates receipt.
-func sethash(receipt *ReceiptJson, fpath string) {
-	contentH, calcHash, matched := checkHash(fpath)
-	receipt.Path = fpath
-	receipt.ContentHash = contentH
-	receipt.CalculatedHash = calcHash
-	receipt.matched = matched
+// refresh recalculates the hashes after the receipt has been edited
+func (r *ReceiptJson) refresh() {
+	r.ContentHash = r.UserData.ContentHash()
+	r.CalculatedHash = r.Receipt.CalculateHash()
+	r.matched = r.ContentHash == r.CalculatedHash
 }
 
-// checkHash checks receipt.json content_hash for a match
-// contentHash is the hash contained in the receipt.json
-// calculatedHash is the hash contained in the receipt.json
-// matched is true if the hash sum matches
-func checkHash(fpath string) (contentHash string, calculatedHash string, matched bool) {
-	var curSha256hex []byte
-	hash := sha256.New()
-	scanner := func(buf []byte) {
-		match1 := chash1.FindSubmatch(buf)
-		if len(match1) >= 2 {
-			curSha256hex = match1[1]
-			buf = chash1.ReplaceAll(buf, []byte{})
-		}
-
-		if len(curSha256hex) == 0 {
-			match2 := chash2.FindSubmatch(buf)
-			if len(match2) >= 2 {
-				curSha256hex = match2[1]
-				buf = chash2.ReplaceAll(buf, []byte{})
-			}
-		}
-
-		_, err := hash.Write(buf)
-		if err != nil {
-			log.Printf("restore component=checkhash status=failure")
-		}
+// Clone returns an independent copy of the receipt
+func (r *ReceiptJson) Clone() (*ReceiptJson, error) {
+	c, err := NewBytes(r.Bytes())
+	if err != nil {
+		return nil, err
 	}
-	scan(fpath, scanner)
-
-	sum := hash.Sum(nil)
-	hex := strings.ToUpper(fmt.Sprintf("%x", sum))
-	calcSha256Hex := []byte(hex)
-
-	match := bytes.Compare(curSha256hex, calcSha256Hex) == 0
-	return string(curSha256hex), string(calcSha256Hex), match
+	c.Path = r.Path
+	return c, nil
 }
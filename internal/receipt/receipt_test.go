@@ -1,6 +1,9 @@
 package receipt
 
 import (
+	"bytes"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"runtime"
 	"testing"
@@ -14,10 +17,26 @@ func getPath(path string) string {
 	return fp
 }
 
+func mustNew(t *testing.T, fp string) *ReceiptJson {
+	r, err := New(fp)
+	if err != nil {
+		t.Fatalf("Can not read %s: %v", fp, err)
+	}
+	return r
+}
+
+func mustBytes(t *testing.T, content []byte) *ReceiptJson {
+	r, err := NewBytes(content)
+	if err != nil {
+		t.Fatalf("Can not parse receipt: %v", err)
+	}
+	return r
+}
+
 func TestReceiptJson_Matched(t *testing.T) {
 	fp := getPath("../../test/fixtures/testdata/receipt.json-ok")
 
-	r := New(fp)
+	r := mustNew(t, fp)
 	if !r.HashesMatch() {
 		t.Errorf("File: %s content \"%s\" & calculated \"%s\" hashes do not match", fp, r.ContentHash, r.CalculatedHash)
 	}
@@ -26,7 +45,7 @@ func TestReceiptJson_Matched(t *testing.T) {
 func TestReceiptJson_Matched2(t *testing.T) {
 	for _, p := range []string{"receipt.json-invalidhash", "receipt.json-nohash"} {
 		fp := getPath(filepath.Join("../../test/fixtures/testdata/", p))
-		r := New(fp)
+		r := mustNew(t, fp)
 		if r.HashesMatch() {
 			t.Errorf("Path %s content_hash and calculated hash was expected not to match", r.Path)
 		}
@@ -36,19 +55,19 @@ func TestReceiptJson_Matched2(t *testing.T) {
 func TestReceiptJson_ResetContentHash(t *testing.T) {
 	for _, p := range []string{"receipt.json-invalidhash", "receipt.json-nohash"} {
 		fp := getPath(filepath.Join("../../test/fixtures/testdata/", p))
-		orig := New(fp)
+		orig := mustNew(t, fp)
 		if orig.HashesMatch() {
 			t.Errorf("Path %s content_hash and calculated hash was expected not to match", orig.Path)
 		}
 
-		fpnew, err := orig.ResetContentHash(false)
+		err := orig.ResetContentHash()
 		if err != nil {
 			t.Errorf("Error resetting hash: %v", err)
 		}
-		n := New(fpnew)
+		n := mustBytes(t, orig.Bytes())
 
 		if !n.HashesMatch() {
-			t.Errorf("Path %s content_hash and calculated hash was expected match. Original file %s", n.Path, orig.Path)
+			t.Errorf("Reset content_hash and calculated hash was expected match. Original file %s", fp)
 		}
 	}
 }
@@ -56,21 +75,67 @@ func TestReceiptJson_ResetContentHash(t *testing.T) {
 func TestReceiptJson_ZeroFrozenInCluster(t *testing.T) {
 	for _, p := range []string{"receipt.json-ok", "receipt.json-invalidhash", "receipt.json-nohash"} {
 		fp := getPath(filepath.Join("../../test/fixtures/testdata/", p))
-		orig := New(fp)
+		orig := mustNew(t, fp)
+		zeroed := mustNew(t, fp)
 
-		fpnew, err := orig.ZeroFrozenInCluster(false)
+		err := zeroed.ZeroFrozenInCluster()
 		if err != nil {
 			t.Errorf("Error zeroing frozen_in_cluster: %v", err)
 		}
-		new := New(fpnew)
+		new := mustBytes(t, zeroed.Bytes())
 
 		if !new.HashesMatch() {
-			t.Errorf("Zeroed out file does not have matching content & calculated hashes: Original file: %s, Zeroed file: %s", fp, fpnew)
+			t.Errorf("Zeroed out file does not have matching content & calculated hashes: Original file: %s", fp)
+		}
+
+		if new.CheckFrozenInCluster() {
+			t.Errorf("Expected frozen_in_cluster to be 0: Original file: %s", fp)
 		}
 
 		if orig.CalculatedHash == new.CalculatedHash {
-			t.Errorf("Expected original and zeroed hashes to be different. original: %s \"%s\", zeroed: %s \"%s\"", fp, orig.CalculatedHash, fpnew, new.CalculatedHash)
+			t.Errorf("Expected original and zeroed hashes to be different. original: %s \"%s\", zeroed: \"%s\"", fp, orig.CalculatedHash, new.CalculatedHash)
 		}
+	}
+}
+
+func TestReceiptJson_FreezeInCluster(t *testing.T) {
+	fp := getPath("../../test/fixtures/testdata/receipt.json-ok")
+	r := mustNew(t, fp)
+	if err := r.ZeroFrozenInCluster(); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.FreezeInCluster(); err != nil {
+		t.Fatal(err)
+	}
+	frozen := mustBytes(t, r.Bytes())
+	if !frozen.HashesMatch() || !frozen.CheckFrozenInCluster() {
+		t.Errorf("expected a frozen receipt with a valid content_hash")
+	}
+	if string(frozen.Bytes()) != string(mustNew(t, fp).Bytes()) {
+		t.Errorf("unfreezing and freezing again should restore the original receipt")
+	}
+}
 
+func TestReceiptJson_ReadWriteFile(t *testing.T) {
+	fp := getPath("../../test/fixtures/testdata/receipt.json-ok")
+	content, err := ioutil.ReadFile(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := Read(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "receipt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "receipt.json")
+	if err := r.WriteFile(out); err != nil {
+		t.Fatal(err)
+	}
+	if !mustNew(t, out).HashesMatch() {
+		t.Errorf("written receipt %s does not match its content_hash", out)
 	}
 }
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/crosseyed/splunks3restore/internal/receipt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const receiptFile = "receipt.json"
+
+// runReceipt checks and fixes local receipt.json files. No AWS credentials are needed.
+func (r *Runner) runReceipt(force bool) {
+	if !r.Config.Receipt && !force {
+		return
+	}
+	problems := 0
+	for _, root := range r.Config.ReceiptPaths {
+		files, err := findReceipts(root)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can not read %s: %v\n", root, err)
+			problems++
+			continue
+		}
+		for _, fpath := range files {
+			if !r.receiptFile(os.Stdout, fpath) {
+				problems++
+			}
+		}
+	}
+	if problems > 0 {
+		Exit(1)
+	}
+	Exit(0)
+}
+
+// receiptFile checks, fixes or unfreezes a single receipt. Returns false if the receipt has problems.
+func (r *Runner) receiptFile(out io.Writer, fpath string) bool {
+	rcpt, err := receipt.New(fpath)
+	if err != nil {
+		fmt.Fprintf(out, "file=%s status=unparsable err=\"%v\"\n", fpath, err)
+		return false
+	}
+	report := receiptReport(rcpt)
+	ok := rcpt.HashesMatch()
+	changed := false
+	switch r.Config.ReceiptAction {
+	case "fix":
+		if !rcpt.HashesMatch() {
+			changed = true
+			err = rcpt.ResetContentHash()
+		}
+	case "unfreeze":
+		if rcpt.CheckFrozenInCluster() {
+			changed = true
+			err = rcpt.ZeroFrozenInCluster()
+		}
+	case "set":
+		changed, err = rcpt.Apply(r.Config.Edits)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "file=%s action=%s status=error %s err=\"%v\"\n", fpath, r.Config.ReceiptAction, report, err)
+		return false
+	}
+	if r.Config.ReceiptAction == "check" {
+		fmt.Fprintf(out, "file=%s action=check %s\n", fpath, report)
+		return ok
+	}
+	line := fmt.Sprintf("file=%s action=%s changed=%t %s", fpath, r.Config.ReceiptAction, changed, report)
+	if changed {
+		line += " new_content_hash=" + rcpt.ContentHash
+	}
+	if changed && r.Config.OutDir != "" {
+		dest, err := writeReceiptCopy(r.Config.OutDir, fpath, rcpt)
+		if err != nil {
+			fmt.Fprintf(out, "%s status=error err=\"%v\"\n", line, err)
+			return false
+		}
+		line += " output=" + dest
+	}
+	fmt.Fprintln(out, line)
+	return true
+}
+
+// receiptReport describes the hash state, frozen state and manifest ID of a receipt
+func receiptReport(rcpt *receipt.ReceiptJson) string {
+	hash := "ok"
+	switch {
+	case rcpt.ContentHash == "":
+		hash = "missing"
+	case !rcpt.HashesMatch():
+		hash = "invalid"
+	}
+	return fmt.Sprintf("hash=%s content_hash=%s calculated_hash=%s frozen_in_cluster=%s manifest_id=%s",
+		hash, rcpt.ContentHash, rcpt.CalculatedHash, rcpt.Manifest.FrozenInCluster(), rcpt.Manifest.ID())
+}
+
+// findReceipts returns root if it is a file or all receipt.json files found under root if it is a directory
+func findReceipts(root string) ([]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{root}, nil
+	}
+	files := []string{}
+	err = filepath.Walk(root, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && info.Name() == receiptFile {
+			files = append(files, fpath)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// writeReceiptCopy writes rcpt to the absolute path of fpath mirrored inside outdir
+func writeReceiptCopy(outdir, fpath string, rcpt *receipt.ReceiptJson) (string, error) {
+	abs, err := filepath.Abs(fpath)
+	if err != nil {
+		return "", err
+	}
+	rel := strings.TrimPrefix(abs, filepath.VolumeName(abs))
+	dest := filepath.Join(outdir, rel)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	return dest, rcpt.WriteFile(dest)
+}
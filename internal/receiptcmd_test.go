@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunner_receiptFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splunks3restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bucket := filepath.Join(dir, "db_1519706363_1519700702_275_609B1724-5A77-4C70-81DC-8444B5014D0D")
+	if err := os.MkdirAll(bucket, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Copy("../test/fixtures/testdata/receipt.json-invalidhash", filepath.Join(bucket, receiptFile)); err != nil {
+		t.Fatal(err)
+	}
+	files, err := findReceipts(dir)
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected to find one receipt got %v: %v", files, err)
+	}
+
+	out := &bytes.Buffer{}
+	r := &Runner{Config: &ConfigType{ReceiptAction: "check"}}
+	if r.receiptFile(out, files[0]) {
+		t.Errorf("expected check to fail on an invalid hash")
+	}
+	if !strings.Contains(out.String(), "hash=invalid") || !strings.Contains(out.String(), "manifest_id=_internal~275~609B1724-5A77-4C70-81DC-8444B5014D0D") {
+		t.Errorf("unexpected report %s", out.String())
+	}
+
+	out.Reset()
+	outdir := filepath.Join(dir, "out")
+	r.Config = &ConfigType{ReceiptAction: "fix", OutDir: outdir}
+	if !r.receiptFile(out, files[0]) || !strings.Contains(out.String(), "changed=true") {
+		t.Fatalf("expected the receipt to be fixed: %s", out.String())
+	}
+	fixed, err := findReceipts(outdir)
+	if err != nil || len(fixed) != 1 {
+		t.Fatalf("expected a fixed copy in %s: %v", outdir, err)
+	}
+	out.Reset()
+	r.Config = &ConfigType{ReceiptAction: "check"}
+	if !r.receiptFile(out, fixed[0]) {
+		t.Errorf("fixed copy does not validate: %s", out.String())
+	}
+}
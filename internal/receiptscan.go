@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/receipt"
+	"github.com/crosseyed/splunks3restore/internal/routines"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Receipt problems found by receipt-scan
+const (
+	problemHashInvalid = "hash_invalid"
+	problemHashMissing = "hash_missing"
+	problemFrozen      = "frozen"
+	problemUnparsable  = "unparsable"
+	problemIDMismatch  = "id_mismatch"
+	problemError       = "error"
+)
+
+var scanProblems = []string{problemHashInvalid, problemHashMissing, problemFrozen, problemUnparsable, problemIDMismatch, problemError}
+
+// scanReport collects receipt-scan results per index
+type scanReport struct {
+	mu       sync.Mutex
+	receipts map[string]int
+	problems map[string]map[string]int
+	bids     map[string]bool
+}
+
+func newScanReport() *scanReport {
+	return &scanReport{
+		receipts: map[string]int{},
+		problems: map[string]map[string]int{},
+		bids:     map[string]bool{},
+	}
+}
+
+// Add records the problems of a receipt of bid in index
+func (r *scanReport) Add(index, bid string, problems []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.receipts[index]++
+	if len(problems) == 0 {
+		return
+	}
+	if r.problems[index] == nil {
+		r.problems[index] = map[string]int{}
+	}
+	for _, problem := range problems {
+		r.problems[index][problem]++
+		if problem != problemError {
+			r.bids[bid] = true
+		}
+	}
+}
+
+// Lines returns a summary line per index
+func (r *scanReport) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var indexes []string
+	for index := range r.receipts {
+		indexes = append(indexes, index)
+	}
+	sort.Strings(indexes)
+	var lines []string
+	for _, index := range indexes {
+		line := fmt.Sprintf("index=%s receipts=%d", index, r.receipts[index])
+		for _, problem := range scanProblems {
+			line += fmt.Sprintf(" %s=%d", problem, r.problems[index][problem])
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Bids returns the sorted bucket ids which need fixing. Receipts which could not be downloaded are not included.
+func (r *scanReport) Bids() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var bids []string
+	for bid := range r.bids {
+		bids = append(bids, bid)
+	}
+	sort.Strings(bids)
+	return bids
+}
+
+// WriteBidFile writes the bucket ids which need fixing to fpath, one per line as read by --bucketids
+func (r *scanReport) WriteBidFile(fpath string) error {
+	fh, err := os.Create(fpath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(fh)
+	for _, bid := range r.Bids() {
+		fmt.Fprintln(w, bid)
+	}
+	if err := w.Flush(); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// receiptProblems checks a receipt of the bucket bid without modifying it
+func receiptProblems(bid string, rcpt *receipt.ReceiptJson) []string {
+	var problems []string
+	switch {
+	case rcpt.ContentHash == "":
+		problems = append(problems, problemHashMissing)
+	case !rcpt.HashesMatch():
+		problems = append(problems, problemHashInvalid)
+	}
+	if rcpt.CheckFrozenInCluster() {
+		problems = append(problems, problemFrozen)
+	}
+	if rcpt.Manifest.ID() != bid {
+		problems = append(problems, problemIDMismatch)
+	}
+	return problems
+}
+
+// indexPrefix returns the S3 prefix of the buckets of index in the db, dma or summary tree
+func indexPrefix(pth, index, bucketType string) string {
+	return strings.TrimPrefix(path.Join(pth, index, bucketType), "/") + "/"
+}
+
+// actionReceiptScan downloads receipts and records their problems in memory. Nothing is written.
+func (s *S3) actionReceiptScan() func(id *routines.Id, batch []interface{}) {
+	svc := s.GetClient()
+	scanFunc := func(id *routines.Id, batch []interface{}) {
+		for _, item := range batch {
+			key, ok := item.(string)
+			if !ok {
+				log.Printf("ERROR: Expecting a key of type string, skipping")
+				continue
+			}
+			if path.Base(key) != receiptFile {
+				continue
+			}
+			b, err := ParseBucketKey(s.Config.Path, key)
+			if err != nil || path.Dir(key) != b.PrefixIn(s.Config.Path) {
+				if s.Config.Verbose {
+					log.Printf("restore action=receipt-scan pid=%d status=skip msg=\"not a bucket receipt\" key=%s", s.State.Pid(), key)
+				}
+				continue
+			}
+			problems := s.scanReceipt(svc, key, b.String())
+			s.scanReport.Add(b.Index(), b.String(), problems)
+			if len(problems) > 0 {
+				log.Printf("restore action=receipt-scan pid=%d status=problem key=%s bid=%s problems=%s", s.State.Pid(), key, b, strings.Join(problems, ","))
+			}
+		}
+	}
+	return scanFunc
+}
+
+// scanReceipt downloads a receipt.json and returns its problems
+func (s *S3) scanReceipt(svc *s3.S3, key, bid string) []string {
+	output, err := svc.GetObject(s.getObjectInput(key, ""))
+	if err != nil {
+		log.Printf("restore action=receipt-scan pid=%d status=error msg=\"download error\" key=%s err=\"%v\"", s.State.Pid(), key, err)
+		return []string{problemError}
+	}
+	defer output.Body.Close()
+	rcpt, err := receipt.Read(output.Body)
+	if err != nil {
+		log.Printf("restore action=receipt-scan pid=%d status=error msg=\"can not parse receipt\" key=%s err=\"%v\"", s.State.Pid(), key, err)
+		return []string{problemUnparsable}
+	}
+	return receiptProblems(bid, rcpt)
+}
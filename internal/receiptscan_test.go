@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"github.com/crosseyed/splunks3restore/internal/receipt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIndexPrefix(t *testing.T) {
+	if p := indexPrefix("", "main", BucketTypeDB); p != "main/db/" {
+		t.Errorf("unexpected prefix %s", p)
+	}
+	if p := indexPrefix("/s3/path", "main", BucketTypeDMA); p != "s3/path/main/dma/" {
+		t.Errorf("unexpected prefix %s", p)
+	}
+}
+
+func TestReceiptProblems(t *testing.T) {
+	rcpt, err := receipt.New("../test/fixtures/testdata/receipt.json-ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := receiptProblems("_internal~275~609B1724-5A77-4C70-81DC-8444B5014D0D", rcpt)
+	if !reflect.DeepEqual(problems, []string{problemFrozen}) {
+		t.Errorf("unexpected problems %v", problems)
+	}
+	problems = receiptProblems("main~275~609B1724-5A77-4C70-81DC-8444B5014D0D", rcpt)
+	if !reflect.DeepEqual(problems, []string{problemFrozen, problemIDMismatch}) {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
+
+func TestScanReport(t *testing.T) {
+	report := newScanReport()
+	report.Add("main", "main~2~GUID", nil)
+	report.Add("main", "main~1~GUID", []string{problemHashInvalid, problemFrozen})
+	report.Add("_internal", "_internal~1~GUID", []string{problemError})
+	lines := report.Lines()
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "index=main receipts=2 hash_invalid=1 hash_missing=0 frozen=1") {
+		t.Errorf("unexpected summary %v", lines)
+	}
+	dir, err := ioutil.TempDir("", "receiptscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bidfile := filepath.Join(dir, "bids.txt")
+	if err := report.WriteBidFile(bidfile); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadFile(bidfile)
+	if string(content) != "main~1~GUID\n" {
+		t.Errorf("unexpected bidfile %q", content)
+	}
+}
+
+func TestGetUsage_receiptScan(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"receipt-scan", "--s3bucket", "splunks3restore", "--region", "us-west-2", "--bidfile", "bids.txt", "--index", "main", "--index", "_internal"}
+	opts := GetUsage(args, "1.0.0")
+	if !opts.Config.ReceiptScan || opts.Config.BidFile != "bids.txt" || !reflect.DeepEqual(opts.Config.Indexes, []string{"main", "_internal"}) {
+		t.Errorf("unexpected receipt-scan config %+v", opts.Config)
+	}
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/receipt"
+	"log"
+	"path"
+	"sort"
+	"sync/atomic"
+)
+
+// repairReceipt reverts a receipt.json with an invalid content_hash to its most recent version which has a valid
+// hash and whose objects are all in S3 with the recorded sizes. current is the version id of the corrupt receipt,
+// empty for the latest version.
+// Returns true if the receipt was reverted to a good version, or would be by a dry run.
+func (s *S3) repairReceipt(svc *s3.S3, key, current string) bool {
+	versions, err := s.receiptVersions(svc, key)
+	if err != nil {
+		log.Printf("restore action=repair pid=%d status=error msg=\"can not list receipt versions\" key=%s err=\"%v\"", s.State.Pid(), key, err)
+		return false
+	}
+	objects, err := s.bucketObjects(svc, key)
+	if err != nil {
+		log.Printf("restore action=repair pid=%d status=error msg=\"can not list bucket objects\" key=%s err=\"%v\"", s.State.Pid(), key, err)
+		return false
+	}
+
+	// A receipt which could not be downloaded has no version id, it is the latest version
+	if current == "" && len(versions) > 0 {
+		current = aws.StringValue(versions[0].VersionId)
+	}
+	for _, ver := range versions {
+		versionId := aws.StringValue(ver.VersionId)
+		if versionId == current {
+			continue
+		}
+		rcpt, attrs, err := s.downloadReceipt(svc, key, versionId)
+		if err != nil {
+			log.Printf("restore action=repair pid=%d status=error msg=\"download error\" key=%s version=%s err=\"%v\"", s.State.Pid(), key, versionId, err)
+			continue
+		}
+		if !rcpt.HashesMatch() {
+			if s.Config.Verbose {
+				log.Printf("restore action=repair pid=%d status=skip hash=invalid key=%s version=%s", s.State.Pid(), key, versionId)
+			}
+			continue
+		}
+		if err := objectsMatch(path.Dir(key), rcpt, objects); err != nil {
+			if s.Config.Verbose {
+				log.Printf("restore action=repair pid=%d status=skip key=%s version=%s msg=\"%v\"", s.State.Pid(), key, versionId, err)
+			}
+			continue
+		}
+
+		if s.Config.DryRun {
+			atomic.AddInt64(&s.stats.changed, 1)
+			log.Printf("restore action=repair status=dryrun pid=%d key=%s version=%s lastmodified=\"%s\" msg=\"would revert to version\"",
+				s.State.Pid(), key, versionId, aws.TimeValue(ver.LastModified))
+			return true
+		}
+		err = s.revertReceipt(svc, key, versionId, attrs)
+		if err != nil {
+			log.Printf("restore action=repair pid=%d status=error msg=\"can not revert receipt\" key=%s version=%s err=\"%v\"", s.State.Pid(), key, versionId, err)
+			return false
+		}
+		atomic.AddInt64(&s.stats.changed, 1)
+		log.Printf("restore action=repair pid=%d status=ok msg=\"reverted to version\" key=%s version=%s replaced=%s", s.State.Pid(), key, versionId, current)
+		return true
+	}
+	log.Printf("restore action=repair pid=%d status=error msg=\"no version with a valid hash and matching objects\" key=%s versions=%d", s.State.Pid(), key, len(versions))
+	return false
+}
+
+// revertReceipt copies versionId of key on top as the latest version. The replaced version is kept by versioning.
+func (s *S3) revertReceipt(svc *s3.S3, key, versionId string, attrs *objectAttrs) error {
+	input := s.copyObjectInput(key, key, attrs)
+	input.CopySource = aws.String(copySource(s.Config.S3bucket, key, versionId))
+	_, err := svc.CopyObject(input)
+	return err
+}
+
+// receiptVersions lists the versions of key, newest first
+func (s *S3) receiptVersions(svc *s3.S3, key string) ([]*s3.ObjectVersion, error) {
+	var versions []*s3.ObjectVersion
+	err := svc.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.Config.S3bucket),
+		Prefix: aws.String(key),
+	}, func(output *s3.ListObjectVersionsOutput, last bool) bool {
+		for _, ver := range output.Versions {
+			if aws.StringValue(ver.Key) == key {
+				versions = append(versions, ver)
+			}
+		}
+		return true
+	})
+	sortVersions(versions)
+	return versions, err
+}
+
+// sortVersions sorts object versions newest first
+func sortVersions(versions []*s3.ObjectVersion) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return aws.TimeValue(versions[i].LastModified).After(aws.TimeValue(versions[j].LastModified))
+	})
+}
+
+// bucketObjects returns the sizes of the current objects of the Splunk bucket holding the receipt.json key
+func (s *S3) bucketObjects(svc *s3.S3, key string) (map[string]int64, error) {
+	objects := map[string]int64{}
+	err := svc.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(s.Config.S3bucket),
+		Prefix: aws.String(path.Dir(key) + "/"),
+	}, func(output *s3.ListObjectsOutput, last bool) bool {
+		for _, obj := range output.Contents {
+			objects[aws.StringValue(obj.Key)] = aws.Int64Value(obj.Size)
+		}
+		return true
+	})
+	return objects, err
+}
+
+// objectsMatch returns an error describing the first receipt object which is missing from objects or has a
+// different size. Object names are relative to dir.
+func objectsMatch(dir string, rcpt *receipt.ReceiptJson, objects map[string]int64) error {
+	for _, obj := range rcpt.Objects {
+		key := path.Join(dir, obj.Name)
+		size, ok := objects[key]
+		if !ok {
+			return fmt.Errorf("object %s is not in s3", key)
+		}
+		if size != obj.Size {
+			return fmt.Errorf("object %s has size %d in s3, the receipt has %d", key, size, obj.Size)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/receipt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObjectsMatch(t *testing.T) {
+	rcpt, err := receipt.NewBytes([]byte(`{"objects":[{"name":"./guidSplunk-GUID/bloomfilter","size":10},{"name":"./guidSplunk-GUID/rawdata/journal.gz","size":20}],"manifest":{"id":"1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := "main/db/AB/CD/1~GUID"
+	objects := map[string]int64{
+		dir + "/guidSplunk-GUID/bloomfilter":        10,
+		dir + "/guidSplunk-GUID/rawdata/journal.gz": 20,
+		dir + "/receipt.json":                       100,
+	}
+	if err := objectsMatch(dir, rcpt, objects); err != nil {
+		t.Errorf("expected objects to match: %v", err)
+	}
+	objects[dir+"/guidSplunk-GUID/rawdata/journal.gz"] = 19
+	if err := objectsMatch(dir, rcpt, objects); err == nil {
+		t.Errorf("expected a size mismatch")
+	}
+	delete(objects, dir+"/guidSplunk-GUID/bloomfilter")
+	if err := objectsMatch(dir, rcpt, objects); err == nil {
+		t.Errorf("expected a missing object")
+	}
+}
+
+func TestSortVersions(t *testing.T) {
+	now := time.Now()
+	versions := []*s3.ObjectVersion{
+		{VersionId: aws.String("old"), LastModified: aws.Time(now.Add(-2 * time.Hour))},
+		{VersionId: aws.String("new"), LastModified: aws.Time(now)},
+		{VersionId: aws.String("mid"), LastModified: aws.Time(now.Add(-time.Hour))},
+	}
+	sortVersions(versions)
+	for i, want := range []string{"new", "mid", "old"} {
+		if got := aws.StringValue(versions[i].VersionId); got != want {
+			t.Errorf("versions[%d] = %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestS3_repairReceipt_revertFails(t *testing.T) {
+	dir := "main/db/AB/CD/1~GUID"
+	good, err := receipt.NewBytes([]byte(`{"objects":[{"name":"./guidSplunk-GUID/bloomfilter","size":10}],"manifest":{"id":"1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	good.ResetContentHash()
+	var copies int
+	svc := stubS3Client(t, func(r *request.Request) (int, string) {
+		switch r.Operation.Name {
+		case "ListObjectVersions":
+			return 200, "<ListVersionsResult><IsTruncated>false</IsTruncated>" +
+				"<Version><Key>" + dir + "/receipt.json</Key><VersionId>bad</VersionId><LastModified>2020-01-02T00:00:00.000Z</LastModified></Version>" +
+				"<Version><Key>" + dir + "/receipt.json</Key><VersionId>good</VersionId><LastModified>2020-01-01T00:00:00.000Z</LastModified></Version>" +
+				"</ListVersionsResult>"
+		case "ListObjects":
+			return 200, "<ListBucketResult><IsTruncated>false</IsTruncated>" +
+				"<Contents><Key>" + dir + "/guidSplunk-GUID/bloomfilter</Key><Size>10</Size></Contents></ListBucketResult>"
+		case "GetObject":
+			return 200, string(good.Bytes())
+		case "CopyObject":
+			copies++
+			return 500, "<Error><Code>InternalError</Code><Message>We encountered an internal error</Message></Error>"
+		}
+		t.Errorf("unexpected %s request", r.Operation.Name)
+		return 500, ""
+	})
+	s := &S3{Config: &ConfigType{S3bucket: "bucket"}, State: &State, stats: &fixupStats{}}
+	if s.repairReceipt(svc, dir+"/receipt.json", "bad") {
+		t.Errorf("expected a failed revert not to count as a repair so --rehash can run")
+	}
+	if copies != 1 || s.stats.changed != 0 {
+		t.Errorf("expected one failed revert and no change, got %d copies and %d changes", copies, s.stats.changed)
+	}
+}
+
+func TestS3_actionFixUp_repairUnparsable(t *testing.T) {
+	dir := "main/db/AB/CD/1~GUID"
+	good, err := receipt.NewBytes([]byte(`{"objects":[{"name":"./guidSplunk-GUID/bloomfilter","size":10}],"manifest":{"id":"1"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	good.ResetContentHash()
+	var copySource string
+	sess := stubSession(t, func(r *request.Request) (int, string) {
+		switch r.Operation.Name {
+		case "ListObjectVersions":
+			return 200, "<ListVersionsResult><IsTruncated>false</IsTruncated>" +
+				"<Version><Key>" + dir + "/receipt.json</Key><VersionId>bad</VersionId><LastModified>2020-01-02T00:00:00.000Z</LastModified></Version>" +
+				"<Version><Key>" + dir + "/receipt.json</Key><VersionId>good</VersionId><LastModified>2020-01-01T00:00:00.000Z</LastModified></Version>" +
+				"</ListVersionsResult>"
+		case "ListObjects":
+			return 200, "<ListBucketResult><IsTruncated>false</IsTruncated>" +
+				"<Contents><Key>" + dir + "/guidSplunk-GUID/bloomfilter</Key><Size>10</Size></Contents></ListBucketResult>"
+		case "GetObject":
+			if aws.StringValue(r.Params.(*s3.GetObjectInput).VersionId) == "good" {
+				return 200, string(good.Bytes())
+			}
+			// the latest version was truncated while it was uploaded
+			return 200, `{"objects":[{"name":"./guidSplunk-GUID/bloom`
+		case "CopyObject":
+			copySource = aws.StringValue(r.Params.(*s3.CopyObjectInput).CopySource)
+			return 200, "<CopyObjectResult><ETag>\"good\"</ETag></CopyObjectResult>"
+		}
+		t.Errorf("unexpected %s request", r.Operation.Name)
+		return 500, ""
+	})
+	s := &S3{Config: &ConfigType{S3bucket: "bucket", Repair: true}, State: &State, stats: &fixupStats{}, sess: sess, sessOnce: &sync.Once{}}
+	s.sessOnce.Do(func() {})
+	s.actionFixUp()(nil, []interface{}{dir + "/receipt.json"})
+	if !strings.HasSuffix(copySource, "versionId=good") || s.stats.changed != 1 {
+		t.Errorf("expected the unparsable receipt to be reverted to the good version, copied %q", copySource)
+	}
+}
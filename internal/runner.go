@@ -3,36 +3,130 @@ package internal
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"os"
-	"path"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Runner struct {
-	Config   *ConfigType
-	State    *StateStruct
-	sync     *sync.Mutex
-	sigTrap  *os.Signal
-	s3Client *S3
+	Config    *ConfigType
+	State     *StateStruct
+	sync      *sync.Mutex
+	sigTrap   *os.Signal
+	s3Client  *S3
+	s3Clients map[string]*S3
 }
 
 func (r *Runner) Run(trapC <-chan os.Signal) {
 	r.Setup()
 	r.runDatehelp(false)
+	r.runReceipt(false)
 
 	r.SetupLogging()
 	r.installSigHandlers(trapC)
 
 	r.runList(false)
+	r.runTimeline(false)
 	r.runRecovery(false)
+	r.runFixup(false)
+	r.runReceiptScan(false)
+	r.runBackups(false)
+	r.runArchiveWait(false)
 }
 
 func (r *Runner) Setup() {
 	SetupAWSRateLimit(AWSDefaultRate)
 	r.sync = &sync.Mutex{}
 	r.s3Client = NewS3client(&Config, &State)
+	r.setupLocationClients()
+}
+
+// setupLocationClients creates an S3 client for each index location of --splunk-conf. The clients share the fixup
+// statistics and receipt scan report of the default client.
+func (r *Runner) setupLocationClients() {
+	if r.Config.IndexLocations == nil {
+		return
+	}
+	r.s3Clients = map[string]*S3{}
+	for _, location := range r.Config.IndexLocations {
+		if _, ok := r.s3Clients[location.Key()]; ok {
+			continue
+		}
+		config := *r.Config
+		config.S3bucket = location.S3bucket
+		config.Path = location.Path
+		config.PathStyle = r.Config.PathStyle || location.PathStyle
+		config.bucketRegion = ""
+		if location.Endpoint != "" {
+			config.Endpoint = location.Endpoint
+		}
+		if location.Region != "" {
+			config.Region = location.Region
+		}
+		client := NewS3client(&config, r.State)
+		client.stats = r.s3Client.stats
+		client.scanReport = r.s3Client.scanReport
+		client.timeline = r.s3Client.timeline
+		client.restores = r.s3Client.restores
+		client.counts = r.s3Client.counts
+		client.archive = r.s3Client.archive
+		r.s3Clients[location.Key()] = client
+	}
+}
+
+// clients returns the S3 clients which run workers, one per index location with --splunk-conf
+func (r *Runner) clients() []*S3 {
+	if r.s3Clients == nil {
+		return []*S3{r.s3Client}
+	}
+	var keys []string
+	for key := range r.s3Clients {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var clients []*S3
+	for _, key := range keys {
+		clients = append(clients, r.s3Clients[key])
+	}
+	return clients
+}
+
+// clientFor returns the S3 client holding the buckets of index, nil if --splunk-conf has no location for it
+func (r *Runner) clientFor(index string) *S3 {
+	if r.s3Clients == nil {
+		return r.s3Client
+	}
+	location, ok := r.Config.IndexLocations[index]
+	if !ok {
+		return nil
+	}
+	return r.s3Clients[location.Key()]
+}
+
+func (r *Runner) startWorkers() {
+	var indexes []string
+	for index := range r.Config.IndexLocations {
+		indexes = append(indexes, index)
+	}
+	sort.Strings(indexes)
+	for _, index := range indexes {
+		l := r.Config.IndexLocations[index]
+		log.Printf("restore action=splunk-conf status=info pid=%d index=%s volume=%s s3bucket=%s path=%s endpoint=%s region=%s\n",
+			r.State.Pid(), l.Index, l.Volume, l.S3bucket, l.Path, l.Endpoint, l.Region)
+	}
+	for _, client := range r.clients() {
+		client.StartWorkers()
+	}
+}
+
+func (r *Runner) shutdown() {
+	for _, client := range r.clients() {
+		client.Shutdown()
+	}
 }
 
 func (r *Runner) installSigHandlers(trapC <-chan os.Signal) {
@@ -41,7 +135,9 @@ func (r *Runner) installSigHandlers(trapC <-chan os.Signal) {
 		log.Printf("restore pid=%d msg=\"received %s signal, shutting down\"\n", r.State.Pid(), sig.String())
 		r.sync.Lock()
 		defer r.sync.Unlock()
-		r.s3Client.GracefulShutdown()
+		for _, client := range r.clients() {
+			client.GracefulShutdown()
+		}
 		r.sigTrap = &sig
 	}()
 }
@@ -57,52 +153,189 @@ func (r *Runner) SetupLogging() {
 	}
 }
 
+// dateExamples are the --start and --end formats shown by --dateformat
+var dateExamples = []string{
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"01/02/2006:15:04:05",
+	"15:04",
+	"1600000000",
+	"now",
+	"now-1h",
+	"now-2d-1h-3m",
+	"-300m",
+	"-7d@d",
+	"-1d@d+8h",
+	"@w1",
+	"-1mon@mon",
+	"@q",
+}
+
 func (r *Runner) runDatehelp(force bool) {
 	if !r.Config.DateHelp && !force {
 		return
 	}
-	fmt.Print(`Format examples:
-2006-01-02T15:04:05-0700
-2006-01-02T15:04:05
-2006-01-02
-15:04:05
-15:04
-now
-now-1h
-now-2d-1h-3m
--300m
--20d
--1s
-`)
+	r.writeDatehelp(os.Stdout, time.Now())
 	Exit(0)
 }
 
+// writeDatehelp prints the accepted date formats resolved against now and the resolved --start and --end window
+func (r *Runner) writeDatehelp(out io.Writer, now time.Time) {
+	fmt.Fprintf(out, "Format examples, resolved in %s:\n", r.Config.Location)
+	for _, example := range dateExamples {
+		t, err := ParseTimeIn(example, now, r.Config.Location)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(out, "%-26s %s\n", example, t.Format(time.RFC3339))
+	}
+	fmt.Fprintf(out, `
+Relative times are Splunk time modifiers: [+|-]<n><unit> offsets and @<unit> snaps,
+applied left to right. Units are s, m, h, d, w, mon, q and y. @w0 to @w6 snap to
+the most recent Sunday to Saturday.
+`)
+	if !r.Config.FromDate.IsZero() {
+		fmt.Fprintf(out, "\nWindow: %s\n", r.Config.Window())
+	}
+}
+
 func (r *Runner) runList(force bool) {
 	if !r.Config.ListVer && !force {
 		return
 	}
-	log.Printf("restore status=start pid=%d cli=\"%s\"\n", r.State.Pid(), Cli2Sting())
-	r.s3Client.StartWorkers()
+	log.Printf("restore status=start pid=%d %s cli=\"%s\"\n", r.State.Pid(), r.Config.Window(), Cli2Sting())
+	r.startWorkers()
 	r.iterMain()
-	r.s3Client.Shutdown()
+	r.shutdown()
 	log.Printf("restore status=end pid=%d\n", r.State.Pid())
 	Exit(0)
 }
 
+func (r *Runner) runTimeline(force bool) {
+	if !r.Config.Timeline && !force {
+		return
+	}
+	action := "timeline"
+	log.Printf("restore action=%s status=start pid=%d %s resolution=%s cli=\"%s\"\n", action, r.State.Pid(), r.Config.Window(), r.Config.Resolution, Cli2Sting())
+	r.startWorkers()
+	r.iterMain()
+	r.shutdown()
+	r.s3Client.timeline.WriteReport(os.Stdout, r.Config.BurstFactor)
+	log.Printf("restore action=%s status=end pid=%d\n", action, r.State.Pid())
+	Exit(0)
+}
+
 func (r *Runner) runRecovery(force bool) {
 	if !r.Config.Restore && !force {
 		return
 	}
 	action := "recover"
+	log.Printf("restore action=%s status=start pid=%d %s cli=\"%s\"\n", action, r.State.Pid(), r.Config.Window(), Cli2Sting())
+	if r.Config.FromTrail != "" {
+		r.loadTrail()
+	}
+	if !r.Config.DryRun {
+		r.preScan(action)
+	}
+	r.startWorkers()
+	r.iterMain()
+	r.shutdown()
+	if !r.Config.DryRun {
+		r.s3Client.LogRestoreSummary(action)
+	}
+	if r.Config.ZeroFrozen {
+		r.s3Client.LogFixupSummary(action)
+	}
+	if r.Config.ArchiveTier != "" {
+		log.Printf("restore action=%s status=info pid=%d msg=\"pending archive restores are recorded in %s, run archivewait to wait for them\"\n", action, r.State.Pid(), r.Config.ArchiveState)
+	}
+
+	log.Printf("restore action=%s status=end pid=%d\n", action, r.State.Pid())
+	Exit(0)
+}
+
+func (r *Runner) runFixup(force bool) {
+	if !r.Config.Fixup && !force {
+		return
+	}
+	action := "fixup"
+	switch {
+	case r.Config.Rebuild:
+		action = "rebuild"
+	case r.Config.Freeze:
+		action = "freeze"
+	}
+	log.Printf("restore action=%s status=start pid=%d cli=\"%s\"\n", action, r.State.Pid(), Cli2Sting())
+	r.startWorkers()
+	r.iterMain()
+	r.shutdown()
+	r.s3Client.LogFixupSummary(action)
+
+	log.Printf("restore action=%s status=end pid=%d\n", action, r.State.Pid())
+	Exit(0)
+}
+
+func (r *Runner) runReceiptScan(force bool) {
+	if !r.Config.ReceiptScan && !force {
+		return
+	}
+	action := "receipt-scan"
 	log.Printf("restore action=%s status=start pid=%d cli=\"%s\"\n", action, r.State.Pid(), Cli2Sting())
-	r.s3Client.StartWorkers()
+	r.startWorkers()
 	r.iterMain()
-	r.s3Client.Shutdown()
+	r.shutdown()
+	for _, line := range r.s3Client.scanReport.Lines() {
+		log.Printf("restore action=%s status=summary pid=%d %s\n", action, r.State.Pid(), line)
+	}
+	if r.Config.BidFile != "" {
+		if err := r.s3Client.scanReport.WriteBidFile(r.Config.BidFile); err != nil {
+			log.Printf("restore action=%s status=error pid=%d msg=\"can not write bidfile\" file=%s err=\"%v\"\n", action, r.State.Pid(), r.Config.BidFile, err)
+			Exit(1)
+		}
+		log.Printf("restore action=%s status=info pid=%d msg=\"bucket ids which need fixing written\" file=%s bids=%d\n", action, r.State.Pid(), r.Config.BidFile, len(r.s3Client.scanReport.Bids()))
+	}
+
+	log.Printf("restore action=%s status=end pid=%d\n", action, r.State.Pid())
+	Exit(0)
+}
+
+func (r *Runner) runBackups(force bool) {
+	if !r.Config.Backups && !force {
+		return
+	}
+	action := "backups"
+	log.Printf("restore action=%s status=start pid=%d cli=\"%s\"\n", action, r.State.Pid(), Cli2Sting())
+	r.startWorkers()
+	r.iterMain()
+	r.shutdown()
+	if r.Config.BackupAction != "list" {
+		r.s3Client.LogFixupSummary(r.Config.BackupAction)
+	}
 
 	log.Printf("restore action=%s status=end pid=%d\n", action, r.State.Pid())
 	Exit(0)
 }
 
+func (r *Runner) runArchiveWait(force bool) {
+	if !r.Config.ArchiveWait && !force {
+		return
+	}
+	action := "archivewait"
+	log.Printf("restore action=%s status=start pid=%d cli=\"%s\"\n", action, r.State.Pid(), Cli2Sting())
+	err := r.s3Client.WaitArchive(func() bool {
+		r.sync.Lock()
+		defer r.sync.Unlock()
+		return r.sigTrap != nil
+	})
+	if err != nil {
+		log.Printf("restore action=%s status=error pid=%d err=\"%v\"\n", action, r.State.Pid(), err)
+		Exit(-1)
+	}
+	log.Printf("restore action=%s status=end pid=%d\n", action, r.State.Pid())
+	Exit(0)
+}
+
 func (r *Runner) prefixReader() *bufio.Reader {
 	file, err := os.Open(r.Config.BucketIdsFile)
 	if err != nil {
@@ -115,36 +348,117 @@ func (r *Runner) prefixReader() *bufio.Reader {
 
 func (r *Runner) iterMain() {
 	switch {
+	case r.Config.FromTrail != "":
+		r.iterTrail()
 	case r.Config.BucketIdsFile != "":
 		r.iterFile()
 	case len(r.Config.BucketIds) > 0:
 		r.iterList()
+	case len(r.Config.Indexes) > 0:
+		r.iterIndexes()
 	}
 }
 
-func bid2prefix(pth string, bid string) (string, error) {
-	itm, err := bid2path(bid)
+// loadTrail reads --from-trail and hands the selected deletes to the S3 client of their bucket. Deletes done by
+// Splunk itself, unless --include-splunk-deletes is given, outside a given --start and --end or in other buckets are
+// skipped.
+func (r *Runner) loadTrail() {
+	events, err := ReadTrail(r.Config.FromTrail)
 	if err != nil {
-		return "", err
+		log.Printf("restore action=trail status=error pid=%d msg=\"can not read trail\" dir=%s err=\"%v\"\n", r.State.Pid(), r.Config.FromTrail, err)
+		Exit(-1)
 	}
-	prefix := strings.Join([]string{pth, itm}, "/")
-	prefix = path.Clean(prefix)
-	return prefix, nil
+	var selected, splunk, outside, unmatched int
+	for _, event := range events {
+		switch {
+		case !r.Config.TrailFilter.Match(event):
+			unmatched++
+			continue
+		case !r.Config.SplunkDeletes && isSplunkDelete(event):
+			splunk++
+			continue
+		case !r.Config.FromDate.IsZero() && (event.Time.Before(r.Config.FromDate) || event.Time.After(r.Config.ToDate)):
+			unmatched++
+			continue
+		}
+		client := r.clientForKey(event.Bucket, event.Key)
+		if client == nil {
+			outside++
+			continue
+		}
+		if client.trail == nil {
+			client.trail = trailIndex{}
+		}
+		client.trail[event.Key] = append(client.trail[event.Key], event)
+		selected++
+	}
+	log.Printf("restore action=trail status=info pid=%d deletes=%d selected=%d filtered=%d splunk=%d other_bucket=%d\n",
+		r.State.Pid(), len(events), selected, unmatched, splunk, outside)
 }
 
-func (r *Runner) iterList() {
-	for _, bid := range r.Config.BucketIds {
+// clientForKey returns the S3 client of bucket whose path key is below, nil if there is none. Access logs and
+// CloudTrail always record the bucket.
+func (r *Runner) clientForKey(bucket, key string) *S3 {
+	for _, client := range r.clients() {
+		pth := strings.Trim(client.Config.Path, "/")
+		if client.Config.S3bucket == bucket && (pth == "" || strings.HasPrefix(key, pth+"/")) {
+			return client
+		}
+	}
+	return nil
+}
+
+// iterTrail scans the bucket directories of the selected trail deletes so each bucket is restored as a whole
+func (r *Runner) iterTrail() {
+	for _, client := range r.clients() {
+		dirs := map[string]bool{}
+		var prefixes []string
+		for key := range client.trail {
+			dir := bucketDir(client.Config.Path, key)
+			if !dirs[dir] {
+				dirs[dir] = true
+				prefixes = append(prefixes, dir)
+			}
+		}
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			if r.sigTrap != nil {
+				return
+			}
+			if err := client.ScanPrefix(prefix); err != nil {
+				log.Printf("exiting error recieved: %v", err)
+			}
+		}
+	}
+}
+
+func (r *Runner) iterIndexes() {
+	for _, index := range r.Config.Indexes {
 		if r.sigTrap != nil {
 			break
 		}
-		prefix, err := bid2prefix(r.Config.Path, bid)
-		if err != nil {
-			log.Printf("Bucket ID format error: '%v' skipping '%s'", bid, err)
+		if !r.Config.IndexSelected(index) {
 			continue
 		}
-		if err := r.s3Client.ScanPrefix(prefix); err != nil {
-			log.Printf("exiting error recieved: %v", err)
+		client := r.clientFor(index)
+		if client == nil {
+			log.Printf("restore action=skip pid=%d index=%s msg=\"index has no SmartStore location in --splunk-conf\"\n", r.State.Pid(), index)
+			continue
+		}
+		for _, bucketType := range r.Config.BucketTypes {
+			if err := client.ScanPrefix(indexPrefix(client.Config.Path, index, bucketType)); err != nil {
+				log.Printf("exiting error recieved: %v", err)
+			}
+		}
+	}
+}
+
+func (r *Runner) iterList() {
+	for _, bid := range r.Config.BucketIds {
+		if r.sigTrap != nil {
+			break
 		}
+		r.scanBucket(bid)
 	}
 }
 
@@ -155,22 +469,41 @@ func (r *Runner) iterFile() {
 			break
 		}
 		bid, err := ioreader.ReadString('\n')
-		bid = strings.Trim(bid, "\n")
-		if err != nil && err.Error() == "EOF" {
-			break
-		} else if err != nil {
-			log.Printf("ERROR: %v", err)
+		if err != nil && (err != io.EOF || bid == "") {
+			if err != io.EOF {
+				log.Printf("ERROR: %v", err)
+			}
 			break
 		}
-		prefix, err := bid2prefix(r.Config.Path, bid)
-		if err != nil {
-			log.Printf("Bucket ID format error: '%v' skipping '%s'", bid, err)
+		bid = strings.TrimSpace(bid)
+		if bid == "" || strings.HasPrefix(bid, "#") {
 			continue
 		}
+		r.scanBucket(bid)
+	}
+}
+
+// scanBucket scans the prefixes of the bucket id in each of the selected bucket types
+func (r *Runner) scanBucket(bid string) {
+	b, err := ParseBucketID(bid)
+	if err != nil {
+		log.Printf("Bucket ID format error: '%v' skipping '%s'", err, bid)
+		return
+	}
+	if !r.Config.IndexSelected(b.Index()) {
+		log.Printf("restore action=skip pid=%d bid=%s msg=\"index excluded by --include-index/--exclude-index\"\n", r.State.Pid(), bid)
+		return
+	}
+	client := r.clientFor(b.Index())
+	if client == nil {
+		log.Printf("restore action=skip pid=%d bid=%s msg=\"index has no SmartStore location in --splunk-conf\"\n", r.State.Pid(), bid)
+		return
+	}
+	for _, prefix := range b.PrefixesIn(client.Config.Path, r.Config.BucketTypes) {
 		if r.Config.Verbose {
-			log.Printf("restore scanning bid=%s prefix=%s pid=%d\n", bid, prefix, r.State.Pid())
+			log.Printf("restore scanning bid=%s s3bucket=%s prefix=%s pid=%d\n", bid, client.Config.S3bucket, prefix, r.State.Pid())
 		}
-		if err := r.s3Client.ScanPrefix(prefix); err != nil {
+		if err := client.ScanPrefix(prefix); err != nil {
 			log.Printf("exiting error recieved: %v", err)
 		}
 	}
@@ -9,12 +9,12 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/crosseyed/splunks3restore/internal/receipt"
 	"github.com/crosseyed/splunks3restore/internal/routines"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,21 +25,51 @@ type S3 struct {
 	rtInput      *routines.Routines
 	rtRestore    *routines.Routines
 	rtFixup      *routines.Routines
+	rtArchive    *routines.Routines
 	wg           *sync.WaitGroup
+	sess         *session.Session
+	sessOnce     *sync.Once
+	stats        *fixupStats
+	scanReport   *scanReport
+	timeline     *timeline
+	trail        trailIndex
+	restores     *restoreStats
+	counts       *restoreCounts
+	prescan      bool
+	archive      *archiveState
+}
+
+// fixupStats counts receipts checked and changed by fixups
+type fixupStats struct {
+	receipts int64
+	changed  int64
 }
 
 func NewS3client(config *ConfigType, state *StateStruct) *S3 {
 	s := &S3{
-		Config:    config,
-		State:     state,
-		rtInput:   routines.New("input", 64, 20, 2048),
-		rtRestore: routines.New("restore", 64, 256, 2048),
-		rtFixup:   routines.New("fixup", 32, 4, 2048),
-		wg:        &sync.WaitGroup{},
+		Config:     config,
+		State:      state,
+		wg:         &sync.WaitGroup{},
+		sessOnce:   &sync.Once{},
+		stats:      &fixupStats{},
+		restores:   &restoreStats{},
+		counts:     newRestoreCounts(),
+		scanReport: newScanReport(),
+		timeline:   newTimeline(config.Resolution, config.Location),
+		archive:    newArchiveState(config.ArchiveState),
 	}
+	s.newRoutines()
 	return s
 }
 
+// newRoutines creates the worker pools. Pools can only be started once, so a client scanning twice needs new ones.
+func (s *S3) newRoutines() {
+	s.rtInput = routines.New("input", 64, 20, 2048)
+	s.rtRestore = routines.New("restore", 64, 1, 2048)
+	s.rtFixup = routines.New("fixup", 32, 4, 2048)
+	s.rtArchive = routines.New("archive", 32, 16, 2048)
+}
+
 func (s *S3) ScanPrefix(prefix string) error {
 	if s.gracefuldown {
 		return nil
@@ -51,6 +81,7 @@ func (s *S3) ScanPrefix(prefix string) error {
 func (s *S3) Kill() {
 	s.rtInput.Kill(false)
 	s.rtFixup.Kill(false)
+	s.rtArchive.Kill(false)
 	s.Shutdown()
 }
 
@@ -64,6 +95,9 @@ func (s *S3) Shutdown() {
 	s.rtFixup.WaitChan()
 	s.rtFixup.Close()
 	s.rtFixup.Wait()
+	s.rtArchive.WaitChan()
+	s.rtArchive.Close()
+	s.rtArchive.Wait()
 	s.wg.Wait()
 }
 
@@ -71,12 +105,36 @@ func (s *S3) StartWorkers() {
 	var scanFunc routines.ActionFuncBatch
 	var restoreFunc routines.ActionFuncBatch
 	var fixupFunc routines.ActionFuncBatch
+	var archiveFunc routines.ActionFuncBatch
 
 	switch {
+	case s.prescan:
+		scanFunc = s.scanCountFunc()
+	case s.Config.Restore && s.Config.FromTrail != "":
+		scanFunc = s.scanTrailFunc()
+		if s.Config.ZeroFrozen {
+			fixupFunc = s.actionFixUp()
+		}
+		if !s.Config.DryRun {
+			restoreFunc = s.actionRmDm()
+			if s.Config.ArchiveTier != "" {
+				archiveFunc = s.actionArchive()
+			}
+		}
 	case s.Config.Restore && s.Config.DryRun:
 		scanFunc = s.scanDryFunc()
+		if s.Config.ZeroFrozen {
+			fixupFunc = s.actionFixUp()
+		}
 	case s.Config.ListVer:
 		scanFunc = s.scanListVer()
+	case s.Config.Timeline:
+		scanFunc = s.scanTimelineFunc()
+	case s.Config.Backups:
+		scanFunc = s.scanBackupsFunc()
+	case s.Config.ReceiptScan:
+		scanFunc = s.scanFixupFunc()
+		fixupFunc = s.actionReceiptScan()
 	case s.Config.Fixup:
 		scanFunc = s.scanFixupFunc()
 		fixupFunc = s.actionFixUp()
@@ -86,6 +144,9 @@ func (s *S3) StartWorkers() {
 			fixupFunc = s.actionFixUp()
 		}
 		restoreFunc = s.actionRmDm()
+		if s.Config.ArchiveTier != "" {
+			archiveFunc = s.actionArchive()
+		}
 	default:
 
 	}
@@ -105,6 +166,11 @@ func (s *S3) StartWorkers() {
 			log.Panicf("can not start fixup function err=\"%v\"", err)
 		}
 	}
+	if archiveFunc != nil {
+		if err := s.rtArchive.Start(archiveFunc); err != nil {
+			log.Panicf("can not start archive function err=\"%v\"", err)
+		}
+	}
 }
 
 //
@@ -136,79 +202,19 @@ func (s *S3) standardPrefixScan(s3PageFunc func(output *s3.ListObjectVersionsOut
 	return scanPrefixFunc
 }
 
+// scanPrefixFunc queues the selected delete markers to rtRestore grouped by Splunk bucket
 func (s *S3) scanPrefixFunc() func(id *routines.Id, batch []interface{}) {
-	s3PageFunc := func(output *s3.ListObjectVersionsOutput, run bool) bool {
-		var buf []interface{}
-		logEntries := []*LogVersionEntry{}
-		for _, marker := range output.DeleteMarkers {
-			if !(s.Config.FromDate.Before(*marker.LastModified) && s.Config.ToDate.After(*marker.LastModified) && *marker.IsLatest) {
-				if s.Config.Verbose {
-					logEntries = AppendDeleteMarkerEntries("skip", logEntries, []*s3.DeleteMarkerEntry{marker})
-				}
-				continue
-			}
-
-			buf = append(buf, marker)
-			if s.Config.Verbose {
-				logEntries = AppendDeleteMarkerEntries("submit", logEntries, []*s3.DeleteMarkerEntry{marker})
-			}
-			if len(buf) >= 24 {
-				s.rtRestore.AddJob(buf)
-				if s.Config.Verbose {
-					LogVersions(logEntries, s.wg)
-					logEntries = []*LogVersionEntry{}
-				}
-				buf = []interface{}{}
+	return s.bucketPrefixScan(func(marker *s3.DeleteMarkerEntry, hidden *s3.ObjectVersion) bool {
+		selected := s.selectVersion(marker, hidden)
+		if s.Config.Verbose {
+			status := "skip"
+			if selected {
+				status = "submit"
 			}
-
-		}
-		if len(buf) > 0 {
-			s.rtRestore.AddJob(buf)
+			LogVersions(AppendDeleteMarkerEntries(status, nil, []*s3.DeleteMarkerEntry{marker}), s.wg)
 		}
-		return true
-	}
-	scanPrefixFunc := s.standardPrefixScan(s3PageFunc)
-	return scanPrefixFunc
-}
-
-func (s *S3) actionRmDm() func(id *routines.Id, batch []interface{}) {
-	client := s.GetClient()
-	removeDmFunc := func(id *routines.Id, batch []interface{}) {
-		batchid := Genuuid()
-		restoreList := []*s3.ObjectIdentifier{}
-		for _, item := range batch {
-			if len(batch) == 0 {
-				return
-			}
-			marker, ok := item.(*s3.DeleteMarkerEntry)
-			if !ok {
-				log.Printf("ERROR: Expecting type *s3.DeleteMarkerEntry, skipping")
-				continue
-			}
-			obj := s3.ObjectIdentifier{
-				Key:       marker.Key,
-				VersionId: marker.VersionId,
-			}
-			restoreList = append(restoreList, &obj)
-		}
-		deleteOutputs, err := client.DeleteObjects(&s3.DeleteObjectsInput{
-			Bucket: &s.Config.S3bucket,
-			Delete: &s3.Delete{
-				Objects: restoreList,
-				Quiet:   aws.Bool(false),
-			},
-		})
-		s.logRestoreResults(err, batchid, deleteOutputs)
-		// Reset frozen_in_cluster to 0
-		if s.Config.ZeroFrozen {
-			for _, obj := range deleteOutputs.Deleted {
-				if strings.HasSuffix(*obj.Key, "receipt.json") {
-					s.rtFixup.AddJob(*obj.Key)
-				}
-			}
-		}
-	}
-	return removeDmFunc
+		return selected
+	})
 }
 
 //
@@ -253,14 +259,26 @@ func (s *S3) scanFixupFunc() func(id *routines.Id, batch []interface{}) {
 
 func (s *S3) actionFixUp() func(id *routines.Id, batch []interface{}) {
 	svc := s.GetClient()
-	savedir := "/tmp/splunks3restore/fixups"
 	bkupprefix := time.Now().Format("20060102150405")
+	fixer := s.receiptFixer()
 
 	fixupFunc := func(id *routines.Id, batch []interface{}) {
 		for _, item := range batch {
-			key, ok := item.(string)
-			if !ok {
-				log.Printf("ERROR: Expecting type *s3.ObjectIndentifier, skipping")
+			var key, versionId string
+			switch v := item.(type) {
+			case string:
+				key = v
+			case *s3.DeleteMarkerEntry:
+				// A receipt which is still deleted, fix the version a restore would surface
+				key = *v.Key
+				surfaced, err := s.surfacedVersion(svc, v)
+				if err != nil {
+					log.Printf("restore action=fixup pid=%d status=error msg=\"can not find the version behind the delete marker\" key=%s err=\"%v\"", s.State.Pid(), key, err)
+					continue
+				}
+				versionId = surfaced
+			default:
+				log.Printf("ERROR: Expecting a key of type string or *s3.DeleteMarkerEntry, skipping")
 				continue
 			}
 			if !strings.HasSuffix(key, "/receipt.json") {
@@ -268,106 +286,238 @@ func (s *S3) actionFixUp() func(id *routines.Id, batch []interface{}) {
 				continue
 			}
 
-			// Download File
-			fpath := filepath.Join(savedir, key)
-			dpath := filepath.Dir(fpath)
-			err := os.MkdirAll(dpath, os.ModePerm)
-			ChkErr(err, Epanicf)
-			fh, err := os.OpenFile(fpath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, os.ModePerm)
-			ChkErr(err, Epanicf)
-
-			objInput := &s3.GetObjectInput{
-				Bucket: aws.String(s.Config.S3bucket),
-				Key:    aws.String(key),
-			}
-			output, err := svc.GetObject(objInput)
+			// Download
+			rcpt, attrs, err := s.downloadReceipt(svc, key, versionId)
 			if err != nil {
-				log.Printf("restore action=fixup pid=%d status=error msg=\"download error\" err=\"%s\"\n", s.State.Pid(), err.Error())
+				log.Printf("restore action=fixup pid=%d status=error msg=\"download error\" key=%s err=\"%s\"\n", s.State.Pid(), key, err.Error())
+				// A truncated or corrupt receipt does not parse, revert it to an earlier version
+				if s.Config.Repair {
+					s.repairReceipt(svc, key, versionId)
+				}
 				continue
 			}
-
-			buf := []byte{}
-			for {
-				b := make([]byte, 4096)
-				n, err := output.Body.Read(b)
-				buf = append(buf, b[0:n]...)
-				if err == io.EOF {
-					break
+			s.saveLocalCopy(key, "", rcpt)
+			atomic.AddInt64(&s.stats.receipts, 1)
+			var orig *receipt.ReceiptJson
+			if s.Config.DryRun {
+				orig, err = rcpt.Clone()
+				if err != nil {
+					log.Printf("restore action=fixup pid=%d status=error key=%s err=\"%v\"", s.State.Pid(), key, err)
+					continue
 				}
 			}
-			output.Body.Close()
 
-			_, err = fh.Write(buf)
-			if err != nil {
-				fh.Close()
-				log.Printf("restore action=fixup pid=%d status=error msg=\"file error\" err=\"%s\"\n", s.State.Pid(), err.Error())
-				continue
+			if s.Config.Repair && !rcpt.HashesMatch() {
+				if s.repairReceipt(svc, key, aws.StringValue(attrs.VersionId)) {
+					continue
+				}
+				if !s.Config.Rehash {
+					log.Printf("restore action=repair pid=%d status=skip msg=\"use --rehash to recompute content_hash\" key=%s", s.State.Pid(), key)
+					continue
+				}
 			}
 
-			err = fh.Close()
+			// Fix receipt
+			fixed, err := fixer(key, rcpt)
 			if err != nil {
-				log.Printf("restore action=fixup pid=%d status=error msg=\"file error\" err=\"%s\"\n", s.State.Pid(), err.Error())
+				log.Printf("restore action=fixup pid=%d status=err msg=\"error fixing receipt\" key=%s err=\"%v\"", s.State.Pid(), key, err)
 				continue
 			}
-
-			// Fix file
-			var fixed bool
-			if s.Config.ZeroFrozen {
-				fixed, err = s.ResetFrozenInCluster(fpath)
-			} else {
-				fixed, err = s.FixupReceiptJsonHash(fpath)
-			}
-			if err != nil {
-				log.Printf("restore action=fixup pid=%d status=err msg=\"error reseting frozen in cluster\"", s.State.Pid())
+			if !fixed {
 				continue
 			}
+			atomic.AddInt64(&s.stats.changed, 1)
 
 			// Upload
-			if fixed {
-				backup := strings.Join([]string{key, bkupprefix}, ".")
-				log.Printf("restore action=fixup pid=%d status=info msg=\"creating a remote backup\" backup=%s", s.State.Pid(), backup)
-				err := s.BackUpKeyS3(svc, key, backup)
-				if err != nil {
-					log.Printf("restore action=fixup pid=%d status=error msg=\"can not create a backup of %s, skipping restore\": %v", s.State.Pid(), key, err)
-					continue
-				}
-				err = s.UploadToS3(svc, fpath, key)
-				if err == nil {
-					log.Printf("restore action=fixup pid=%d status=ok msg=\"uploaded to s3\" key=%s file=%s", s.State.Pid(), key, fpath)
-				} else {
-					log.Printf("restore action=fixup pid=%d status=error msg=\"error uploading to s3\" err=\"%s\" key=%s file=%s", s.State.Pid(), err.Error(), key, fpath)
+			s.saveLocalCopy(key, ".fixed", rcpt)
+			if s.Config.DryRun {
+				for _, change := range receipt.Diff(orig.Receipt, rcpt.Receipt) {
+					log.Printf("restore action=fixup status=dryrun pid=%d key=%s %s", s.State.Pid(), key, change)
 				}
+				continue
 			}
+			s.uploadReceipt(svc, key, bkupprefix, rcpt, attrs)
 		}
 	}
 	return fixupFunc
 }
 
-func (s *S3) ResetFrozenInCluster(fpath string) (bool, error) {
-	rcpt := receipt.New(fpath)
+// surfacedVersion returns the version id of the newest object version older than a delete marker
+func (s *S3) surfacedVersion(svc *s3.S3, marker *s3.DeleteMarkerEntry) (string, error) {
+	found, err := s.hiddenVersion(svc, marker)
+	if err != nil {
+		return "", err
+	}
+	return *found.VersionId, nil
+}
+
+// hiddenVersion lists the versions of a delete marker's key and returns the newest object version older than it
+func (s *S3) hiddenVersion(svc *s3.S3, marker *s3.DeleteMarkerEntry) (*s3.ObjectVersion, error) {
+	var found *s3.ObjectVersion
+	err := svc.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(s.Config.S3bucket),
+		Prefix: marker.Key,
+	}, func(output *s3.ListObjectVersionsOutput, last bool) bool {
+		if ver := newPageVersions(output).hidden(marker); ver != nil && (found == nil || ver.LastModified.After(*found.LastModified)) {
+			found = ver
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no object version older than delete marker %s", *marker.VersionId)
+	}
+	return found, nil
+}
+
+// LogFixupSummary logs the number of receipts which were fixed or would be fixed by a dry run
+func (s *S3) LogFixupSummary(action string) {
+	changed := "changed"
+	if s.Config.DryRun {
+		changed = "would_change"
+	}
+	log.Printf("restore action=%s status=summary pid=%d dryrun=%t receipts=%d %s=%d\n",
+		action, s.State.Pid(), s.Config.DryRun, atomic.LoadInt64(&s.stats.receipts), changed, atomic.LoadInt64(&s.stats.changed))
+}
+
+// downloadReceipt reads a receipt.json from S3 into memory along with the attributes needed to re-upload it
+func (s *S3) downloadReceipt(svc *s3.S3, key, versionId string) (*receipt.ReceiptJson, *objectAttrs, error) {
+	output, err := svc.GetObject(s.getObjectInput(key, versionId))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer output.Body.Close()
+	attrs, err := s.getObjectAttrs(svc, key, output)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not read object tags: %v", err)
+	}
+	rcpt, err := receipt.Read(output.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rcpt, attrs, nil
+}
+
+// uploadReceipt creates a remote backup of key and replaces it with rcpt.
+// Both steps only succeed if key has not changed since it was downloaded.
+func (s *S3) uploadReceipt(svc *s3.S3, key, bkupprefix string, rcpt *receipt.ReceiptJson, attrs *objectAttrs) bool {
+	backup := s.backupKey(key, bkupprefix)
+	log.Printf("restore action=fixup pid=%d status=info msg=\"creating a remote backup\" backup=%s", s.State.Pid(), backup)
+	err := s.BackUpKeyS3(svc, key, backup, attrs)
+	if isPreconditionFailed(err) {
+		log.Printf("restore action=fixup pid=%d status=skip msg=\"receipt changed since download\" key=%s etag=%s", s.State.Pid(), key, aws.StringValue(attrs.ETag))
+		return false
+	}
+	if err != nil {
+		log.Printf("restore action=fixup pid=%d status=error msg=\"can not create a backup of %s, skipping restore\": %v", s.State.Pid(), key, err)
+		return false
+	}
+	err = s.UploadToS3(svc, rcpt.Bytes(), key, attrs)
+	switch {
+	case err == nil:
+		log.Printf("restore action=fixup pid=%d status=ok msg=\"uploaded to s3\" key=%s", s.State.Pid(), key)
+		return true
+	case isPreconditionFailed(err):
+		log.Printf("restore action=fixup pid=%d status=skip msg=\"receipt changed since download\" key=%s etag=%s", s.State.Pid(), key, aws.StringValue(attrs.ETag))
+	default:
+		log.Printf("restore action=fixup pid=%d status=error msg=\"error uploading to s3\" err=\"%s\" key=%s", s.State.Pid(), err.Error(), key)
+	}
+	return false
+}
+
+// saveLocalCopy writes rcpt to the run directory inside --workdir. Nothing is written unless --workdir is set.
+func (s *S3) saveLocalCopy(key, suffix string, rcpt *receipt.ReceiptJson) {
+	if s.Config.WorkDir == "" {
+		return
+	}
+	rundir, err := s.State.RunDir(s.Config.WorkDir)
+	if err != nil {
+		log.Printf("restore action=fixup pid=%d status=error msg=\"can not create work directory\" err=\"%v\"", s.State.Pid(), err)
+		return
+	}
+	fpath := filepath.Join(rundir, filepath.FromSlash(key)+suffix)
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		log.Printf("restore action=fixup pid=%d status=error msg=\"file error\" err=\"%v\"", s.State.Pid(), err)
+		return
+	}
+	if err := rcpt.WriteFile(fpath); err != nil {
+		log.Printf("restore action=fixup pid=%d status=error msg=\"file error\" err=\"%v\"", s.State.Pid(), err)
+		return
+	}
+	if s.Config.Verbose {
+		log.Printf("restore action=fixup pid=%d status=info msg=\"saved local copy\" key=%s file=%s", s.State.Pid(), key, fpath)
+	}
+}
+
+// receiptFixer edits a receipt in memory and returns true if it has to be uploaded
+type receiptFixer func(key string, rcpt *receipt.ReceiptJson) (bool, error)
+
+// receiptFixer returns the fixer of the configured fixup mode
+func (s *S3) receiptFixer() receiptFixer {
+	switch {
+	case s.Config.Rebuild:
+		return s.rebuildFixer()
+	case s.Config.Freeze:
+		return s.FreezeReceipt
+	case len(s.Config.Edits) > 0:
+		return s.EditReceipt
+	case s.Config.ZeroFrozen:
+		return s.ResetFrozenInCluster
+	}
+	return s.FixupReceiptJsonHash
+}
+
+// EditReceipt applies the --set and --remove-object edits
+func (s *S3) EditReceipt(key string, rcpt *receipt.ReceiptJson) (bool, error) {
+	changed, err := rcpt.Apply(s.Config.Edits)
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		log.Printf("restore action=edit pid=%d msg=\"edited receipt\" key=%s content_hash=%s", s.State.Pid(), key, rcpt.ContentHash)
+	}
+	return changed, nil
+}
+
+// FreezeReceipt sets frozen_in_cluster to 1 so SmartStore treats the bucket as frozen
+func (s *S3) FreezeReceipt(key string, rcpt *receipt.ReceiptJson) (bool, error) {
 	if rcpt.CheckFrozenInCluster() {
-		_, err := rcpt.ZeroFrozenInCluster(true)
+		return false, nil
+	}
+	err := rcpt.FreezeInCluster()
+	if err != nil {
+		log.Printf("restore action=freeze pid=%d msg=\"error setting frozen_in_cluster to 1\" key=%s: %v", s.State.Pid(), key, err)
+		return false, err
+	}
+	log.Printf("restore action=freeze pid=%d msg=\"set frozen_in_cluster to 1\" key=%s", s.State.Pid(), key)
+	return true, nil
+}
+
+func (s *S3) ResetFrozenInCluster(key string, rcpt *receipt.ReceiptJson) (bool, error) {
+	if rcpt.CheckFrozenInCluster() {
+		err := rcpt.ZeroFrozenInCluster()
 		if err != nil {
-			log.Printf("restore action=resetfrozenincluster pid=%d msg=\"error setting frozen_in_cluster to 0\": %v", s.State.Pid(), err)
+			log.Printf("restore action=resetfrozenincluster pid=%d msg=\"error setting frozen_in_cluster to 0\" key=%s: %v", s.State.Pid(), key, err)
 			return false, err
 		}
-		log.Printf("restore action=resetfrozenincluster pid=%d msg=\"reset frozen_in_cluster to 0\"", s.State.Pid())
+		log.Printf("restore action=resetfrozenincluster pid=%d msg=\"reset frozen_in_cluster to 0\" key=%s", s.State.Pid(), key)
 		return true, nil
 	}
 	return false, nil
 }
 
-func (s *S3) FixupReceiptJsonHash(fpath string) (bool, error) {
+func (s *S3) FixupReceiptJsonHash(key string, rcpt *receipt.ReceiptJson) (bool, error) {
 	fixed := false
-	rcpt := receipt.New(fpath)
 	if !rcpt.HashesMatch() {
-		log.Printf("restore action=fixup pid=%d hash=invalid msg=\"invalid hash, fixing\" file=%s", s.State.Pid(), fpath)
-		_, err := rcpt.ZeroFrozenInCluster(true)
+		log.Printf("restore action=fixup pid=%d hash=invalid msg=\"invalid hash, fixing\" key=%s", s.State.Pid(), key)
+		err := rcpt.ZeroFrozenInCluster()
 		if err != nil {
 			return fixed, err
 		} else {
 			fixed = true
-			log.Printf("restore action=fixup pid=%d hash=fixed msg=\"staging fixed hash file\" file=%s", s.State.Pid(), fpath)
+			log.Printf("restore action=fixup pid=%d hash=fixed msg=\"staging fixed hash file\" key=%s", s.State.Pid(), key)
 			return fixed, nil
 		}
 	}
@@ -381,14 +531,18 @@ func (s *S3) FixupReceiptJsonHash(fpath string) (bool, error) {
 func (s *S3) scanDryFunc() func(id *routines.Id, batch []interface{}) {
 	s3PageFunc := func(output *s3.ListObjectVersionsOutput, run bool) bool {
 		batchid := Genuuid()
+		versions := newPageVersions(output)
 		for _, marker := range output.DeleteMarkers {
-			if !(s.Config.FromDate.Before(*marker.LastModified) && s.Config.ToDate.After(*marker.LastModified) && *marker.IsLatest) {
+			if !s.selectVersion(marker, versions.hidden(marker)) {
 				continue
 			}
 			log.Printf(
 				"restore action=dryrun status=ok batchid=%s pid=%d key=%s version=%s lastmodified=\"%s\"\n",
 				batchid, State.Pid(), *marker.Key, *marker.VersionId, *marker.LastModified,
 			)
+			if s.Config.ZeroFrozen && strings.HasSuffix(*marker.Key, "/receipt.json") {
+				s.rtFixup.AddJob(marker)
+			}
 		}
 		return true
 	}
@@ -407,7 +561,7 @@ func (s *S3) scanListVer() func(id *routines.Id, batch []interface{}) {
 		muList.Lock()
 		defer muList.Unlock()
 		for _, ver := range output.Versions {
-			if !(s.Config.FromDate.Before(*ver.LastModified) && s.Config.ToDate.After(*ver.LastModified) && *ver.IsLatest) {
+			if !s.selectVersion(ver, nil) {
 				continue
 			}
 			output := fmt.Sprintf("key=%s version=%s latest=%t deletemarker=false", *ver.Key, *ver.VersionId, *ver.IsLatest)
@@ -417,8 +571,9 @@ func (s *S3) scanListVer() func(id *routines.Id, batch []interface{}) {
 				os.Stdout.WriteString(output + "\n")
 			}
 		}
+		versions := newPageVersions(output)
 		for _, dm := range output.DeleteMarkers {
-			if !(s.Config.FromDate.Before(*dm.LastModified) && s.Config.ToDate.After(*dm.LastModified) && *dm.IsLatest) {
+			if !s.selectVersion(dm, versions.hidden(dm)) {
 				continue
 			}
 			output := fmt.Sprintf("key=%s version=%s latest=%t deletemarker=true", *dm.Key, *dm.VersionId, *dm.IsLatest)
@@ -438,39 +593,28 @@ func (s *S3) scanListVer() func(id *routines.Id, batch []interface{}) {
 // Fixup
 //
 
-//
-// Audit functions
-//
-
-func (s *S3) scanAuditFunc() func(id *routines.Id, batch []interface{}) {
-	s3AuditPageFunc := func(output *s3.ListObjectVersionsOutput, run bool) bool {
-		entries := []*LogVersionEntry{}
-		entries = AppendObjectVersionEntries("audit", entries, output.Versions)
-		entries = AppendDeleteMarkerEntries("audit", entries, output.DeleteMarkers)
-		LogVersions(entries, s.wg)
-		return true
-	}
-	scanPrefixFunc := s.standardPrefixScan(s3AuditPageFunc)
-	return scanPrefixFunc
-}
-
 //
 // S3 Client/Session
 //
 
+// Session returns the AWS session shared by all clients so assumed role credentials are cached and refreshed once
 func (s *S3) Session() *session.Session {
-	region := s.Config.GetBucketRegion()
-	config := &aws.Config{
-		Region: aws.String(region),
-	}
-	sess, _ := session.NewSession(config)
-	return sess
+	s.sessOnce.Do(func() {
+		region := s.Config.GetBucketRegion()
+		sess, err := s.Config.NewSession(region)
+		if err != nil {
+			log.Printf("restore status=error pid=%d msg=\"can not create AWS session\" err=\"%v\"", s.State.Pid(), err)
+			Exit(-1)
+		}
+		s.sess = sess
+	})
+	return s.sess
 }
 
 func (s *S3) GetClient() *s3.S3 {
 	svc := s3.New(s.Session())
 	svc.Handlers.Send.PushBack(func(r *request.Request) {
-		AWSRateLimit()
+		AWSRateLimit(r)
 	})
 	return svc
 }
@@ -504,39 +648,22 @@ func (s *S3) logRestoreResults(err error, batchid string, deleteOutputs *s3.Dele
 	}()
 }
 
-func (s *S3) BackUpKeyS3(svc *s3.S3, src, backup string) error {
-	copysrc := filepath.Join("/", s.Config.S3bucket, src)
-	input := &s3.CopyObjectInput{
-		Bucket:     aws.String(s.Config.S3bucket),
-		CopySource: aws.String(copysrc),
-		Key:        aws.String(backup),
-	}
-	_, err := svc.CopyObject(input)
+// BackUpKeyS3 copies src to backup provided src has not changed since it was downloaded
+func (s *S3) BackUpKeyS3(svc *s3.S3, src, backup string, attrs *objectAttrs) error {
+	_, err := svc.CopyObject(s.copyObjectInput(src, backup, attrs))
 	return err
 }
 
-// UploadToS3 will upload a single file to S3, it will require a pre-built aws session
-// and will set file info like content type and encryption on the uploaded file.
-func (s *S3) UploadToS3(svc *s3.S3, fileDir, key string) error {
-	// Open the file for use
-	file, err := os.Open(fileDir)
-	if err != nil {
-		return err
+// UploadToS3 will upload content to key, it will require a pre-built aws session
+// and will set file info like content type, metadata, tags and encryption on the uploaded object.
+//
+// The upload only succeeds if the object still has the ETag in attrs.
+func (s *S3) UploadToS3(svc *s3.S3, content []byte, key string, attrs *objectAttrs) error {
+	input := s.putObjectInput(key, attrs)
+	input.Body = bytes.NewReader(content)
+	req, _ := svc.PutObjectRequest(input)
+	if attrs.ETag != nil {
+		req.HTTPRequest.Header.Set("If-Match", *attrs.ETag)
 	}
-	defer file.Close()
-
-	// Get file size and read the file content into a buffer
-	fileInfo, _ := file.Stat()
-	var size int64 = fileInfo.Size()
-	buffer := make([]byte, size)
-	file.Read(buffer)
-
-	// Config settings: this is where you choose the bucket, filename, content-type etc.
-	// of the file you're uploading.
-	_, err = svc.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(s.Config.S3bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader(buffer),
-	})
-	return err
+	return req.Send()
 }
@@ -0,0 +1,75 @@
+package internal
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/receipt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// stubSession returns a session whose requests are answered by respond instead of being sent
+func stubSession(t *testing.T, respond func(r *request.Request) (int, string)) *session.Session {
+	sess, err := session.NewSession(&aws.Config{
+		Region:           aws.String("us-east-1"),
+		Endpoint:         aws.String("https://s3.stub"),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.Handlers.Send.Clear()
+	sess.Handlers.Send.PushBack(func(r *request.Request) {
+		status, body := respond(r)
+		r.HTTPResponse = &http.Response{
+			StatusCode: status,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(body)),
+		}
+	})
+	return sess
+}
+
+// stubS3Client returns an S3 client whose requests are answered by respond instead of being sent
+func stubS3Client(t *testing.T, respond func(r *request.Request) (int, string)) *s3.S3 {
+	return s3.New(stubSession(t, respond))
+}
+
+func TestS3_UploadToS3_ifMatch(t *testing.T) {
+	s := &S3{Config: &ConfigType{S3bucket: "bucket"}, State: &State}
+	var ifMatch []string
+	svc := stubS3Client(t, func(r *request.Request) (int, string) {
+		switch r.Operation.Name {
+		case "CopyObject":
+			return 200, "<CopyObjectResult><ETag>\"backup\"</ETag></CopyObjectResult>"
+		case "PutObject":
+			ifMatch = append(ifMatch, r.HTTPRequest.Header.Get("If-Match"))
+			return 412, "<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>"
+		}
+		t.Errorf("unexpected %s request", r.Operation.Name)
+		return 500, ""
+	})
+	attrs := &objectAttrs{ETag: aws.String(`"abc"`)}
+
+	err := s.UploadToS3(svc, []byte("{}"), "idx/db/receipt.json", attrs)
+	if !isPreconditionFailed(err) {
+		t.Errorf("expected a precondition failure, got %v", err)
+	}
+	rcpt, err := receipt.NewBytes([]byte(`{"manifest": {"id": "bucket"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.uploadReceipt(svc, "idx/db/receipt.json", "", rcpt, attrs) {
+		t.Errorf("expected a receipt changed since download not to be uploaded")
+	}
+	if len(ifMatch) != 2 || ifMatch[0] != `"abc"` || ifMatch[1] != `"abc"` {
+		t.Errorf("expected uploads to be conditional on the downloaded ETag, got %v", ifMatch)
+	}
+}
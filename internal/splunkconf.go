@@ -0,0 +1,243 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// confStanzas are the settings of a Splunk .conf file, stanza name to key to value
+type confStanzas map[string]map[string]string
+
+// IndexLocation is where the SmartStore buckets of an index live. Path is the prefix the index directory is in, so
+// keys are <Path>/<Index>/db/XX/YY/<localid>~<guid>/... like with --path.
+type IndexLocation struct {
+	Index     string
+	Volume    string
+	S3bucket  string
+	Path      string
+	Endpoint  string
+	Region    string
+	PathStyle bool
+}
+
+// Key identifies the S3 client needed for the location
+func (l IndexLocation) Key() string {
+	return strings.Join([]string{l.S3bucket, l.Path, l.Endpoint, l.Region, fmt.Sprint(l.PathStyle)}, "|")
+}
+
+var awsEndpointRe = regexp.MustCompile(`^(?:https?://)?s3[.-]([a-z0-9-]+)\.amazonaws\.com`)
+
+// readConf parses a Splunk .conf file. Settings before the first stanza belong to [default], lines ending in a
+// backslash are continued on the next line.
+func readConf(file string) (confStanzas, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf := confStanzas{}
+	stanza := "default"
+	scanner := bufio.NewScanner(f)
+	line := ""
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		if strings.HasSuffix(text, "\\") {
+			line += strings.TrimSuffix(text, "\\")
+			continue
+		}
+		line += text
+		text, line = strings.TrimSpace(line), ""
+		switch {
+		case text == "" || strings.HasPrefix(text, "#"):
+		case strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]"):
+			stanza = strings.TrimSpace(text[1 : len(text)-1])
+			if conf[stanza] == nil {
+				conf[stanza] = map[string]string{}
+			}
+		default:
+			i := strings.Index(text, "=")
+			if i < 0 {
+				return nil, fmt.Errorf("%s:%d: expecting key = value", file, n)
+			}
+			if conf[stanza] == nil {
+				conf[stanza] = map[string]string{}
+			}
+			conf[stanza][strings.TrimSpace(text[:i])] = strings.TrimSpace(text[i+1:])
+		}
+	}
+	return conf, scanner.Err()
+}
+
+// merge layers higher over c, settings of higher win
+func (c confStanzas) merge(higher confStanzas) {
+	for stanza, settings := range higher {
+		if c[stanza] == nil {
+			c[stanza] = map[string]string{}
+		}
+		for k, v := range settings {
+			c[stanza][k] = v
+		}
+	}
+}
+
+// get returns a setting of stanza, falling back to [default]
+func (c confStanzas) get(stanza, key string) string {
+	if v, ok := c[stanza][key]; ok {
+		return v
+	}
+	return c["default"][key]
+}
+
+// indexesConfFiles returns the indexes.conf files below dir, lowest precedence first. dir may be $SPLUNK_HOME,
+// $SPLUNK_HOME/etc, an app directory with default and local directories or an indexes.conf file. The etc layering
+// follows btool: system default, app default, peer app default, app local, system local and peer app local, with
+// apps earlier in ASCII order winning over later ones.
+func indexesConfFiles(dir string) ([]string, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{dir}, nil
+	}
+	if isDir(filepath.Join(dir, "etc")) {
+		dir = filepath.Join(dir, "etc")
+	}
+	var files []string
+	if !isDir(filepath.Join(dir, "system")) && !isDir(filepath.Join(dir, "apps")) {
+		files = []string{filepath.Join(dir, "default", "indexes.conf"), filepath.Join(dir, "local", "indexes.conf")}
+	} else {
+		files = append(files, filepath.Join(dir, "system", "default", "indexes.conf"))
+		files = append(files, appConfFiles(dir, []string{"apps"}, "default")...)
+		files = append(files, appConfFiles(dir, []string{"slave-apps", "peer-apps"}, "default")...)
+		files = append(files, appConfFiles(dir, []string{"apps"}, "local")...)
+		files = append(files, filepath.Join(dir, "system", "local", "indexes.conf"))
+		files = append(files, appConfFiles(dir, []string{"slave-apps", "peer-apps"}, "local")...)
+	}
+	var existing []string
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			existing = append(existing, file)
+		}
+	}
+	if len(existing) == 0 {
+		return nil, fmt.Errorf("no indexes.conf found in %s", dir)
+	}
+	return existing, nil
+}
+
+// appConfFiles returns <dir>/<appsDir>/*/<layer>/indexes.conf in reverse ASCII order of the apps so earlier apps win
+func appConfFiles(dir string, appsDirs []string, layer string) []string {
+	var files []string
+	for _, appsDir := range appsDirs {
+		matches, _ := filepath.Glob(filepath.Join(dir, appsDir, "*", layer, "indexes.conf"))
+		sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+		files = append(files, matches...)
+	}
+	return files
+}
+
+func isDir(dir string) bool {
+	info, err := os.Stat(dir)
+	return err == nil && info.IsDir()
+}
+
+// LoadIndexesConf layers the indexes.conf files found in dir
+func LoadIndexesConf(dir string) (confStanzas, error) {
+	files, err := indexesConfFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	conf := confStanzas{}
+	for _, file := range files {
+		layer, err := readConf(file)
+		if err != nil {
+			return nil, err
+		}
+		conf.merge(layer)
+	}
+	return conf, nil
+}
+
+// IndexLocations resolves the remotePath of each index stanza. Indexes without a remotePath are not SmartStore
+// indexes and are left out, indexes whose remotePath can not be resolved are returned as errors.
+func (c confStanzas) IndexLocations() (map[string]IndexLocation, []error) {
+	locations := map[string]IndexLocation{}
+	var errs []error
+	var indexes []string
+	for stanza := range c {
+		if stanza == "default" || strings.HasPrefix(stanza, "volume:") || strings.HasPrefix(stanza, "provider") {
+			continue
+		}
+		indexes = append(indexes, stanza)
+	}
+	sort.Strings(indexes)
+	for _, index := range indexes {
+		remotePath := c.get(index, "remotePath")
+		if remotePath == "" {
+			continue
+		}
+		location, err := c.indexLocation(index, remotePath)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("index %s: %v", index, err))
+			continue
+		}
+		locations[index] = location
+	}
+	return locations, errs
+}
+
+// indexLocation resolves remotePath = volume:<volume>/<path> against the [volume:<volume>] stanza
+func (c confStanzas) indexLocation(index, remotePath string) (IndexLocation, error) {
+	remotePath = strings.Replace(remotePath, "$_index_name", index, -1)
+	if !strings.HasPrefix(remotePath, "volume:") {
+		return IndexLocation{}, fmt.Errorf("remotePath %s does not reference a volume", remotePath)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(remotePath, "volume:"), "/", 2)
+	volume := parts[0]
+	settings, ok := c["volume:"+volume]
+	if !ok {
+		return IndexLocation{}, fmt.Errorf("volume %s is not defined", volume)
+	}
+	if t := settings["storageType"]; t != "" && t != "remote" {
+		return IndexLocation{}, fmt.Errorf("volume %s has storageType %s, expecting remote", volume, t)
+	}
+	volumePath := settings["path"]
+	if !strings.HasPrefix(volumePath, "s3://") {
+		return IndexLocation{}, fmt.Errorf("volume %s path %q is not an s3:// path", volume, volumePath)
+	}
+	bucketPath := strings.SplitN(strings.TrimPrefix(volumePath, "s3://"), "/", 2)
+	rel := ""
+	if len(parts) == 2 {
+		rel = parts[1]
+	}
+	if len(bucketPath) == 2 {
+		rel = path.Join(bucketPath[1], rel)
+	}
+	rel = strings.Trim(rel, "/")
+	if path.Base(rel) != index {
+		return IndexLocation{}, fmt.Errorf("remotePath %s must end with the index name", remotePath)
+	}
+	location := IndexLocation{
+		Index:    index,
+		Volume:   volume,
+		S3bucket: bucketPath[0],
+		Path:     strings.TrimSuffix(strings.TrimSuffix(rel, index), "/"),
+		Endpoint: settings["remote.s3.endpoint"],
+		Region:   settings["remote.s3.auth_region"],
+	}
+	if m := awsEndpointRe.FindStringSubmatch(location.Endpoint); m != nil && location.Region == "" && m[1] != "external-1" {
+		location.Region = m[1]
+	}
+	// Splunk defaults to path-style v1 URLs, AWS endpoints also accept virtual hosted-style
+	if location.Endpoint != "" && !strings.Contains(location.Endpoint, "amazonaws.com") {
+		location.PathStyle = settings["remote.s3.url_version"] != "v2"
+	}
+	return location, nil
+}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConf(t *testing.T, file, content string) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadIndexesConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splunks3restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeConf(t, filepath.Join(dir, "etc/system/default/indexes.conf"), `
+[default]
+remotePath =
+
+[_internal]
+homePath = $SPLUNK_DB/_internaldb/db
+`)
+	writeConf(t, filepath.Join(dir, "etc/apps/a_smartstore/default/indexes.conf"), `
+[default]
+remotePath = volume:remote_store/$_index_name
+
+[volume:remote_store]
+storageType = remote
+path = s3://smartstore/old
+`)
+	writeConf(t, filepath.Join(dir, "etc/apps/z_smartstore/local/indexes.conf"), `
+# overridden by the app which sorts first
+[volume:remote_store]
+path = s3://zzz
+
+[volume:minio]
+storageType = remote
+path = s3://archive/splunk/
+remote.s3.endpoint = http://minio:9000
+`)
+	writeConf(t, filepath.Join(dir, "etc/apps/a_smartstore/local/indexes.conf"), `
+[volume:remote_store]
+path = s3://smartstore/prod
+remote.s3.endpoint = https://s3.us-west-2.amazonaws.com
+
+[main]
+
+[web]
+remotePath = volume:minio/\
+$_index_name
+
+[broken]
+remotePath = volume:missing/$_index_name
+
+[elsewhere]
+remotePath = volume:remote_store/other
+`)
+	conf, err := LoadIndexesConf(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locations, errs := conf.IndexLocations()
+	if len(errs) != 2 {
+		t.Errorf("expected broken and elsewhere to fail, got %v", errs)
+	}
+	for index, want := range map[string]IndexLocation{
+		"_internal": {Index: "_internal", Volume: "remote_store", S3bucket: "smartstore", Path: "prod", Endpoint: "https://s3.us-west-2.amazonaws.com", Region: "us-west-2"},
+		"main":      {Index: "main", Volume: "remote_store", S3bucket: "smartstore", Path: "prod", Endpoint: "https://s3.us-west-2.amazonaws.com", Region: "us-west-2"},
+		"web":       {Index: "web", Volume: "minio", S3bucket: "archive", Path: "splunk", Endpoint: "http://minio:9000", PathStyle: true},
+	} {
+		if got := locations[index]; got != want {
+			t.Errorf("%s: expected %+v, got %+v", index, want, got)
+		}
+	}
+	if len(locations) != 3 {
+		t.Errorf("unexpected locations %v", locations)
+	}
+	if locations["main"].Key() != locations["_internal"].Key() || locations["main"].Key() == locations["web"].Key() {
+		t.Errorf("expected indexes on the same volume to share a client")
+	}
+}
+
+func TestRunner_clientFor(t *testing.T) {
+	config := &ConfigType{S3bucket: "", IndexLocations: map[string]IndexLocation{
+		"main": {Index: "main", S3bucket: "smartstore", Path: "prod", Region: "us-west-2"},
+		"web":  {Index: "web", S3bucket: "archive", Path: "splunk", Endpoint: "http://minio:9000", PathStyle: true},
+	}}
+	r := &Runner{Config: config, State: &State}
+	r.s3Client = NewS3client(config, r.State)
+	r.setupLocationClients()
+	if len(r.clients()) != 2 {
+		t.Fatalf("expected a client per location, got %d", len(r.clients()))
+	}
+	web := r.clientFor("web")
+	if web == nil || web.Config.S3bucket != "archive" || web.Config.Path != "splunk" || !web.Config.PathStyle || web.stats != r.s3Client.stats {
+		t.Errorf("unexpected client for web %+v", web)
+	}
+	if main := r.clientFor("main"); main == nil || main.Config.Region != "us-west-2" || main.Config.Endpoint != "" {
+		t.Errorf("unexpected client for main")
+	}
+	if r.clientFor("unknown") != nil {
+		t.Errorf("expected no client for an index without a location")
+	}
+}
+
+func TestGetUsage_splunkConf(t *testing.T) {
+	defer withTestingMode()()
+	dir, err := ioutil.TempDir("", "splunks3restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "indexes.conf")
+	writeConf(t, file, "[volume:rs]\npath = s3://smartstore\n\n[main]\nremotePath = volume:rs/$_index_name\n")
+	opts := GetUsage([]string{"restore", "--start", "-1d", "--splunk-conf", file, "main~1~609B1724-5A77-4C70-81DC-8444B5014D0D"}, "1.0.0")
+	if l, ok := opts.Config.IndexLocations["main"]; !ok || l.S3bucket != "smartstore" || l.Path != "" {
+		t.Errorf("unexpected locations %v", opts.Config.IndexLocations)
+	}
+	opts = GetUsage([]string{"listver", "--start", "-1d", "--s3bucket", "splunks3restore", "index~ID1"}, "1.0.0")
+	if opts.Config.IndexLocations != nil {
+		t.Errorf("expected no locations without --splunk-conf")
+	}
+}
@@ -0,0 +1,308 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/routines"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	timelineDefaultResolution  = time.Hour
+	timelineDefaultBurstFactor = 5
+	timelineBarWidth           = 50
+	timelineMaxSlots           = 100000
+)
+
+var resolutionRe = regexp.MustCompile(`^([0-9]*)([a-z]+)$`)
+
+// parseResolution parses a --resolution such as 15m, 1h or 1d. Months and longer have no fixed length and are
+// rejected.
+func parseResolution(value string) (time.Duration, error) {
+	if value == "" {
+		return timelineDefaultResolution, nil
+	}
+	m := resolutionRe.FindStringSubmatch(strings.ToLower(strings.TrimSpace(value)))
+	if m == nil {
+		return 0, fmt.Errorf("expecting <n><unit>, e.g. 15m, 1h or 1d")
+	}
+	n := 1
+	if m[1] != "" {
+		n, _ = strconv.Atoi(m[1])
+	}
+	unit, err := timeUnit(m[2])
+	if err != nil {
+		return 0, err
+	}
+	var d time.Duration
+	switch unit {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	case "d":
+		d = 24 * time.Hour
+	case "w":
+		d = 7 * 24 * time.Hour
+	default:
+		return 0, fmt.Errorf("unit %s has no fixed length, use d or w", m[2])
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("resolution must be positive")
+	}
+	return time.Duration(n) * d, nil
+}
+
+// timeline is a histogram of delete marker timestamps per index
+type timeline struct {
+	mu         sync.Mutex
+	resolution time.Duration
+	loc        *time.Location
+	slots      map[int64]map[string]int64
+}
+
+// timelineBurst is a run of consecutive anomalous slots
+type timelineBurst struct {
+	Start   time.Time
+	End     time.Time
+	Total   int64
+	Peak    int64
+	Indexes map[string]int64
+}
+
+func newTimeline(resolution time.Duration, loc *time.Location) *timeline {
+	if resolution <= 0 {
+		resolution = timelineDefaultResolution
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	return &timeline{resolution: resolution, loc: loc, slots: map[int64]map[string]int64{}}
+}
+
+// slot returns the start of the slot t is in. Slots are aligned in the timeline location, slots of whole days
+// follow its calendar so they start at midnight.
+func (tl *timeline) slot(t time.Time) time.Time {
+	t = t.In(tl.loc)
+	if days := tl.days(); days > 0 {
+		y, m, d := t.Date()
+		n := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+		return time.Date(y, m, d-n%days, 0, 0, 0, 0, tl.loc)
+	}
+	_, offset := t.Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(tl.resolution).Add(-shift).In(tl.loc)
+}
+
+// next returns the start of the slot after start
+func (tl *timeline) next(start time.Time) time.Time {
+	if days := tl.days(); days > 0 {
+		return start.AddDate(0, 0, days)
+	}
+	next := tl.slot(start.Add(tl.resolution))
+	if !next.After(start) {
+		next = tl.slot(start.Add(tl.resolution + time.Hour))
+	}
+	return next
+}
+
+// days returns the resolution in days, 0 if it is not a whole number of days
+func (tl *timeline) days() int {
+	if tl.resolution%(24*time.Hour) != 0 {
+		return 0
+	}
+	return int(tl.resolution / (24 * time.Hour))
+}
+
+// Add counts a delete marker of index modified at t
+func (tl *timeline) Add(t time.Time, index string) {
+	start := tl.slot(t).Unix()
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.slots[start] == nil {
+		tl.slots[start] = map[string]int64{}
+	}
+	tl.slots[start][index]++
+}
+
+// histogram returns the slot starts from the first to the last marker, including empty slots, and their totals
+func (tl *timeline) histogram() ([]time.Time, []int64) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if len(tl.slots) == 0 {
+		return nil, nil
+	}
+	first, last := int64(1<<62), int64(-1<<62)
+	for start := range tl.slots {
+		if start < first {
+			first = start
+		}
+		if start > last {
+			last = start
+		}
+	}
+	var starts []time.Time
+	var totals []int64
+	for t := time.Unix(first, 0).In(tl.loc); t.Unix() <= last; t = tl.next(t) {
+		var total int64
+		for _, n := range tl.slots[t.Unix()] {
+			total += n
+		}
+		starts = append(starts, t)
+		totals = append(totals, total)
+	}
+	return starts, totals
+}
+
+// threshold returns the count above which a slot is anomalous: the median plus factor median absolute deviations of
+// the non-empty slots. Empty slots are left out so sparse retention deletes do not pull the baseline to 0. The
+// deviation is at least 1 so a flat timeline does not flag every slot.
+func threshold(totals []int64, factor float64) float64 {
+	var counts []int64
+	for _, total := range totals {
+		if total > 0 {
+			counts = append(counts, total)
+		}
+	}
+	median := medianOf(counts)
+	deviations := make([]int64, len(counts))
+	for i, total := range counts {
+		d := float64(total) - median
+		if d < 0 {
+			d = -d
+		}
+		deviations[i] = int64(d)
+	}
+	mad := medianOf(deviations)
+	if mad < 1 {
+		mad = 1
+	}
+	return median + factor*mad
+}
+
+func medianOf(values []int64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]int64{}, values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return float64(sorted[mid-1]+sorted[mid]) / 2
+	}
+	return float64(sorted[mid])
+}
+
+// Bursts merges consecutive slots above the threshold into bursts
+func (tl *timeline) Bursts(factor float64) []timelineBurst {
+	starts, totals := tl.histogram()
+	limit := threshold(totals, factor)
+	var bursts []timelineBurst
+	var current *timelineBurst
+	for i, start := range starts {
+		if float64(totals[i]) <= limit {
+			current = nil
+			continue
+		}
+		if current == nil {
+			bursts = append(bursts, timelineBurst{Start: start, Indexes: map[string]int64{}})
+			current = &bursts[len(bursts)-1]
+		}
+		current.End = tl.next(start)
+		current.Total += totals[i]
+		if totals[i] > current.Peak {
+			current.Peak = totals[i]
+		}
+		tl.mu.Lock()
+		for index, n := range tl.slots[start.Unix()] {
+			current.Indexes[index] += n
+		}
+		tl.mu.Unlock()
+	}
+	return bursts
+}
+
+// WriteReport prints the histogram, the bursts and --start/--end suggestions for restore
+func (tl *timeline) WriteReport(out io.Writer, factor float64) {
+	starts, totals := tl.histogram()
+	if len(starts) == 0 {
+		fmt.Fprintf(out, "No delete markers found\n")
+		return
+	}
+	var peak int64
+	for _, total := range totals {
+		if total > peak {
+			peak = total
+		}
+	}
+	limit := threshold(totals, factor)
+	fmt.Fprintf(out, "Delete markers per %s, slots above %.0f are bursts (*):\n", tl.resolution, limit)
+	for i, start := range starts {
+		flag := " "
+		if float64(totals[i]) > limit {
+			flag = "*"
+		}
+		bar := strings.Repeat("#", int(totals[i]*timelineBarWidth/peak))
+		if bar == "" && totals[i] > 0 {
+			bar = "."
+		}
+		fmt.Fprintf(out, "%s %-25s %10d %s\n", flag, start.Format(time.RFC3339), totals[i], bar)
+	}
+	bursts := tl.Bursts(factor)
+	if len(bursts) == 0 {
+		fmt.Fprintf(out, "\nNo bursts found\n")
+		return
+	}
+	for i, burst := range bursts {
+		fmt.Fprintf(out, "\nBurst %d: %s to %s, %d delete markers, peak %d per %s\n",
+			i+1, burst.Start.Format(time.RFC3339), burst.End.Format(time.RFC3339), burst.Total, burst.Peak, tl.resolution)
+		var indexes []string
+		for index := range burst.Indexes {
+			indexes = append(indexes, index)
+		}
+		sort.Strings(indexes)
+		for _, index := range indexes {
+			fmt.Fprintf(out, "    index=%s markers=%d\n", index, burst.Indexes[index])
+		}
+		// restore selects markers strictly after --start and strictly before --end
+		fmt.Fprintf(out, "    restore --start=%s --end=%s\n",
+			burst.Start.Add(-time.Second).Format(time.RFC3339), burst.End.Format(time.RFC3339))
+	}
+}
+
+//
+// Timeline functions
+//
+
+// scanTimelineFunc counts every delete marker inside the --start and --end window matching the --include/--exclude
+// globs and --where, latest or not
+func (s *S3) scanTimelineFunc() func(id *routines.Id, batch []interface{}) {
+	s3PageFunc := func(output *s3.ListObjectVersionsOutput, run bool) bool {
+		versions := newPageVersions(output)
+		for _, marker := range output.DeleteMarkers {
+			lastModified := aws.TimeValue(marker.LastModified)
+			if !s.Config.FromDate.IsZero() && !s.Config.FromDate.Before(lastModified) || !s.Config.ToDate.After(lastModified) {
+				continue
+			}
+			if !s.matchVersion(marker, versions.hidden(marker)) {
+				continue
+			}
+			index := "-"
+			if bid, err := ParseBucketKey(s.Config.Path, aws.StringValue(marker.Key)); err == nil {
+				index = bid.Index()
+			}
+			s.timeline.Add(lastModified, index)
+		}
+		return true
+	}
+	return s.standardPrefixScan(s3PageFunc)
+}
@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResolution(t *testing.T) {
+	for value, want := range map[string]time.Duration{
+		"":    time.Hour,
+		"15m": 15 * time.Minute,
+		"h":   time.Hour,
+		"1d":  24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+	} {
+		if got, err := parseResolution(value); err != nil || got != want {
+			t.Errorf("%s: expected %s, got %s %v", value, want, got, err)
+		}
+	}
+	for _, invalid := range []string{"0h", "1mon", "1x", "-1h", "h1"} {
+		if _, err := parseResolution(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestTimeline_Bursts(t *testing.T) {
+	tl := newTimeline(time.Hour, time.UTC)
+	start := time.Date(2020, time.May, 13, 0, 0, 0, 0, time.UTC)
+	// a trickle of retention deletes every hour for two days
+	for h := 0; h < 48; h++ {
+		for i := 0; i < 3+h%2; i++ {
+			tl.Add(start.Add(time.Duration(h)*time.Hour+time.Duration(i)*time.Minute), "main")
+		}
+	}
+	// a mass delete from 10:00 to 11:59 on the second day
+	burst := start.Add(34 * time.Hour)
+	for i := 0; i < 120; i++ {
+		tl.Add(burst.Add(time.Duration(i)*time.Minute), "main")
+		tl.Add(burst.Add(time.Duration(i)*time.Minute+time.Second), "_internal")
+	}
+	bursts := tl.Bursts(5)
+	if len(bursts) != 1 {
+		t.Fatalf("expected one burst, got %v", bursts)
+	}
+	b := bursts[0]
+	if !b.Start.Equal(burst) || !b.End.Equal(burst.Add(2*time.Hour)) || b.Indexes["_internal"] != 120 || b.Indexes["main"] != 127 {
+		t.Errorf("unexpected burst %+v", b)
+	}
+	out := &bytes.Buffer{}
+	tl.WriteReport(out, 5)
+	if !strings.Contains(out.String(), "restore --start=2020-05-14T09:59:59Z --end=2020-05-14T12:00:00Z") {
+		t.Errorf("unexpected report:\n%s", out)
+	}
+}
+
+func TestTimeline_Bursts_sparse(t *testing.T) {
+	tl := newTimeline(time.Hour, time.UTC)
+	start := time.Date(2020, time.May, 1, 0, 0, 0, 0, time.UTC)
+	// retention deletes of 6 buckets every 6 hours for two weeks, most slots are empty
+	for h := 0; h < 14*24; h += 6 {
+		for i := 0; i < 6; i++ {
+			tl.Add(start.Add(time.Duration(h)*time.Hour+time.Duration(i)*time.Minute), "main")
+		}
+	}
+	burst := start.Add(200*time.Hour + 30*time.Minute)
+	for i := 0; i < 20; i++ {
+		tl.Add(burst.Add(time.Duration(i)*time.Second), "main")
+	}
+	bursts := tl.Bursts(5)
+	if len(bursts) != 1 || !bursts[0].Start.Equal(start.Add(200*time.Hour)) || bursts[0].Total != 20 {
+		t.Errorf("expected only the mass delete to be a burst, got %+v", bursts)
+	}
+}
+
+func TestTimeline_slot(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no timezone database")
+	}
+	tl := newTimeline(24*time.Hour, ny)
+	// daylight saving time ends on 2020-11-01, the day is 25 hours long
+	day := time.Date(2020, time.November, 1, 0, 0, 0, 0, ny)
+	if got := tl.slot(day.Add(20 * time.Hour)); !got.Equal(day) {
+		t.Errorf("expected %s, got %s", day, got)
+	}
+	if got := tl.next(day); !got.Equal(time.Date(2020, time.November, 2, 0, 0, 0, 0, ny)) {
+		t.Errorf("unexpected next slot %s", got)
+	}
+	tl.Add(day.Add(time.Hour), "main")
+	tl.Add(day.AddDate(0, 0, 3), "main")
+	if starts, _ := tl.histogram(); len(starts) != 4 {
+		t.Errorf("expected 4 daily slots, got %v", starts)
+	}
+}
+
+func TestGetUsage_timeline(t *testing.T) {
+	defer withTestingMode()()
+	args := []string{"timeline", "--start", "-30d", "--resolution", "15m", "--burst-factor", "3", "--s3bucket", "splunks3restore", "--index", "main"}
+	opts := GetUsage(args, "1.0.0")
+	if !opts.Config.Timeline || opts.Config.Resolution != 15*time.Minute || opts.Config.BurstFactor != 3 || opts.Config.FromDate.IsZero() {
+		t.Errorf("unexpected timeline options %v %v", opts.Config.Resolution, opts.Config.BurstFactor)
+	}
+	for _, args := range [][]string{
+		{"timeline", "--s3bucket", "splunks3restore", "--index", "main"},
+		{"timeline", "--start", "-30d", "--resolution", "1s", "--s3bucket", "splunks3restore", "--index", "main"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected %v to be rejected", args)
+				}
+			}()
+			GetUsage(args, "1.0.0")
+		}()
+	}
+}
@@ -0,0 +1,403 @@
+package internal
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/crosseyed/splunks3restore/internal/routines"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trailSkew is how far the LastModified of a delete marker may be from the time a trail recorded the delete. Trails
+// record when the request was received with second precision, markers when the delete completed.
+const trailSkew = 5 * time.Second
+
+// accessLogTimeFormat is the time format of S3 server access logs, e.g. [06/Feb/2019:00:00:38 +0000]
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// splunkAgentRe matches the user agent of deletes done by Splunk itself, which are not restored unless
+// --include-splunk-deletes is given. Splunk sends Splunk/<version> first, other tools only mention it later.
+var splunkAgentRe = regexp.MustCompile(`^Splunk/`)
+
+// trailEvent is a delete recorded by CloudTrail or an S3 server access log. VersionID is the version of the delete
+// marker the delete created when the trail records it.
+type trailEvent struct {
+	Time      time.Time
+	Bucket    string
+	Key       string
+	VersionID string
+	Principal string
+	SourceIP  string
+	UserAgent string
+	RequestID string
+}
+
+// trailFilter selects trail events by principal, source IP, user agent and request ID. Empty lists match all.
+type trailFilter struct {
+	Principals []*regexp.Regexp
+	SourceNets []*net.IPNet
+	UserAgents []*regexp.Regexp
+	RequestIDs []*regexp.Regexp
+}
+
+// parseTrailFilter validates the --principal, --source-ip, --user-agent and --request-id values. Principals, user
+// agents and request IDs are wildcards where * matches any text, including /.
+func parseTrailFilter(principals, sourceIPs, userAgents, requestIDs []string) (trailFilter, error) {
+	f := trailFilter{
+		Principals: wildcards(principals),
+		UserAgents: wildcards(userAgents),
+		RequestIDs: wildcards(requestIDs),
+	}
+	seen := map[string]bool{}
+	for _, value := range sourceIPs {
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		cidr := value
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return f, fmt.Errorf("--source-ip %s is not an IP address or CIDR", value)
+		}
+		f.SourceNets = append(f.SourceNets, ipnet)
+	}
+	return f, nil
+}
+
+// wildcards compiles values with * and ? wildcards to anchored regular expressions, dropping duplicates
+func wildcards(values []string) []*regexp.Regexp {
+	var res []*regexp.Regexp
+	seen := map[string]bool{}
+	for _, value := range values {
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		quoted := regexp.QuoteMeta(value)
+		quoted = strings.Replace(quoted, `\*`, ".*", -1)
+		quoted = strings.Replace(quoted, `\?`, ".", -1)
+		res = append(res, regexp.MustCompile("^"+quoted+"$"))
+	}
+	return res
+}
+
+func anyMatch(res []*regexp.Regexp, value string) bool {
+	for _, re := range res {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether e passes every given filter
+func (f trailFilter) Match(e trailEvent) bool {
+	if len(f.Principals) > 0 && !anyMatch(f.Principals, e.Principal) {
+		return false
+	}
+	if len(f.UserAgents) > 0 && !anyMatch(f.UserAgents, e.UserAgent) {
+		return false
+	}
+	if len(f.RequestIDs) > 0 && !anyMatch(f.RequestIDs, e.RequestID) {
+		return false
+	}
+	if len(f.SourceNets) > 0 {
+		ip := net.ParseIP(e.SourceIP)
+		for _, ipnet := range f.SourceNets {
+			if ip != nil && ipnet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// isSplunkDelete reports whether the delete was done by Splunk itself, e.g. SmartStore eviction of frozen buckets
+func isSplunkDelete(e trailEvent) bool {
+	return splunkAgentRe.MatchString(e.UserAgent)
+}
+
+// ReadTrail reads the delete events of the CloudTrail JSON files (.json or .json.gz) and S3 server access log files
+// below dir. Lines and records which are not deletes are skipped.
+func ReadTrail(dir string) ([]trailEvent, error) {
+	var events []trailEvent
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var r io.Reader = f
+		name := file
+		if strings.HasSuffix(name, ".gz") {
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+			defer gz.Close()
+			r = gz
+			name = strings.TrimSuffix(name, ".gz")
+		}
+		var found []trailEvent
+		if strings.HasSuffix(name, ".json") {
+			found, err = readCloudTrail(r)
+		} else {
+			found, err = readAccessLog(r)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		events = append(events, found...)
+		return nil
+	})
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events, err
+}
+
+// cloudTrailRecord holds the fields of a CloudTrail S3 data event used to find deletes
+type cloudTrailRecord struct {
+	EventTime    time.Time `json:"eventTime"`
+	EventSource  string    `json:"eventSource"`
+	EventName    string    `json:"eventName"`
+	ErrorCode    string    `json:"errorCode"`
+	SourceIP     string    `json:"sourceIPAddress"`
+	UserAgent    string    `json:"userAgent"`
+	RequestID    string    `json:"requestID"`
+	UserIdentity struct {
+		Arn         string `json:"arn"`
+		PrincipalID string `json:"principalId"`
+	} `json:"userIdentity"`
+	RequestParameters struct {
+		BucketName string          `json:"bucketName"`
+		Key        string          `json:"key"`
+		VersionID  string          `json:"versionId"`
+		Delete     json.RawMessage `json:"delete"`
+	} `json:"requestParameters"`
+	ResponseElements map[string]interface{} `json:"responseElements"`
+}
+
+// cloudTrailObject is an object of a DeleteObjects request
+type cloudTrailObject struct {
+	Key       string `json:"Key"`
+	VersionID string `json:"VersionId"`
+}
+
+// readCloudTrail reads the DeleteObject and DeleteObjects events of a CloudTrail log file. Deletes of a specific
+// version create no delete marker and are left out.
+func readCloudTrail(r io.Reader) ([]trailEvent, error) {
+	var doc struct {
+		Records []cloudTrailRecord `json:"Records"`
+	}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var events []trailEvent
+	for _, rec := range doc.Records {
+		if rec.EventSource != "s3.amazonaws.com" || rec.ErrorCode != "" {
+			continue
+		}
+		event := trailEvent{
+			Time:      rec.EventTime,
+			Bucket:    rec.RequestParameters.BucketName,
+			Principal: rec.UserIdentity.Arn,
+			SourceIP:  rec.SourceIP,
+			UserAgent: rec.UserAgent,
+			RequestID: rec.RequestID,
+		}
+		if event.Principal == "" {
+			event.Principal = rec.UserIdentity.PrincipalID
+		}
+		switch rec.EventName {
+		case "DeleteObject":
+			if rec.RequestParameters.VersionID != "" {
+				continue
+			}
+			event.Key = rec.RequestParameters.Key
+			if v, ok := rec.ResponseElements["x-amz-version-id"].(string); ok {
+				event.VersionID = v
+			}
+			events = append(events, event)
+		case "DeleteObjects":
+			for _, obj := range deleteObjects(rec.RequestParameters.Delete) {
+				if obj.VersionID != "" {
+					continue
+				}
+				event.Key = obj.Key
+				events = append(events, event)
+			}
+		}
+	}
+	return events, nil
+}
+
+// deleteObjects decodes requestParameters.delete.Object, which CloudTrail records as an object or a list
+func deleteObjects(raw json.RawMessage) []cloudTrailObject {
+	var del struct {
+		Object json.RawMessage `json:"Object"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &del) != nil || len(del.Object) == 0 {
+		return nil
+	}
+	var objects []cloudTrailObject
+	if err := json.Unmarshal(del.Object, &objects); err == nil {
+		return objects
+	}
+	var obj cloudTrailObject
+	if err := json.Unmarshal(del.Object, &obj); err == nil {
+		return []cloudTrailObject{obj}
+	}
+	return nil
+}
+
+// readAccessLog reads the REST.DELETE.OBJECT and BATCH.DELETE.OBJECT lines of an S3 server access log, and the
+// S3.EXPIRE.OBJECT and S3.CREATE.DELETEMARKER lines of lifecycle expiry. Deletes of a specific version and failed
+// deletes are left out.
+func readAccessLog(r io.Reader) ([]trailEvent, error) {
+	var events []trailEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		fields := splitAccessLogLine(scanner.Text())
+		if len(fields) < 18 {
+			continue
+		}
+		switch fields[6] {
+		case "REST.DELETE.OBJECT", "BATCH.DELETE.OBJECT":
+			if !strings.HasPrefix(fields[9], "2") || fields[17] != "-" {
+				continue
+			}
+		case "S3.EXPIRE.OBJECT":
+			// lifecycle expiry of a version is permanent, only the expiry of the current object adds a marker
+			if fields[17] != "-" {
+				continue
+			}
+		case "S3.CREATE.DELETEMARKER":
+		default:
+			continue
+		}
+		t, err := time.Parse(accessLogTimeFormat, fields[2])
+		if err != nil {
+			continue
+		}
+		key, err := url.PathUnescape(fields[7])
+		if err != nil {
+			key = fields[7]
+		}
+		events = append(events, trailEvent{
+			Time:      t,
+			Bucket:    fields[1],
+			Key:       key,
+			Principal: fields[4],
+			SourceIP:  fields[3],
+			UserAgent: fields[16],
+			RequestID: fields[5],
+		})
+	}
+	return events, scanner.Err()
+}
+
+// splitAccessLogLine splits an access log line on spaces, keeping [bracketed] and "quoted" fields together
+func splitAccessLogLine(line string) []string {
+	var fields []string
+	for i := 0; i < len(line); {
+		switch line[i] {
+		case ' ':
+			i++
+		case '[', '"':
+			end := byte(']')
+			if line[i] == '"' {
+				end = '"'
+			}
+			j := strings.IndexByte(line[i+1:], end)
+			if j < 0 {
+				fields = append(fields, line[i+1:])
+				return fields
+			}
+			fields = append(fields, line[i+1:i+1+j])
+			i += j + 2
+		default:
+			j := strings.IndexByte(line[i:], ' ')
+			if j < 0 {
+				j = len(line) - i
+			}
+			fields = append(fields, line[i:i+j])
+			i += j
+		}
+	}
+	return fields
+}
+
+// trailIndex holds the selected trail events of a bucket by key
+type trailIndex map[string][]trailEvent
+
+// Match returns the trail event which created marker. Events with the version id of the marker match exactly,
+// others match markers of their key within trailSkew.
+func (t trailIndex) Match(marker *s3.DeleteMarkerEntry) (trailEvent, bool) {
+	lastModified := aws.TimeValue(marker.LastModified)
+	for _, event := range t[aws.StringValue(marker.Key)] {
+		if event.VersionID != "" {
+			if event.VersionID == aws.StringValue(marker.VersionId) {
+				return event, true
+			}
+			continue
+		}
+		d := lastModified.Sub(event.Time)
+		if d > -trailSkew && d < trailSkew {
+			return event, true
+		}
+	}
+	return trailEvent{}, false
+}
+
+//
+// Trail functions
+//
+
+// scanTrailFunc removes the delete markers created by the selected trail events, grouped by Splunk bucket. The
+// prefixes scanned are the bucket directories of the events.
+func (s *S3) scanTrailFunc() func(id *routines.Id, batch []interface{}) {
+	return s.bucketPrefixScan(func(marker *s3.DeleteMarkerEntry, hidden *s3.ObjectVersion) bool {
+		event, ok := s.trail.Match(marker)
+		if !ok || !s.matchVersion(marker, hidden) {
+			return false
+		}
+		status := "match"
+		if s.Config.DryRun {
+			status = "dryrun"
+		}
+		log.Printf(
+			"restore action=trail status=%s pid=%d key=%s version=%s lastmodified=\"%s\" principal=\"%s\" sourceip=%s requestid=%s\n",
+			status, State.Pid(), *marker.Key, *marker.VersionId, *marker.LastModified, event.Principal, event.SourceIP, event.RequestID,
+		)
+		if s.Config.DryRun {
+			if s.Config.ZeroFrozen && strings.HasSuffix(*marker.Key, "/receipt.json") {
+				s.rtFixup.AddJob(marker)
+			}
+			return false
+		}
+		return true
+	})
+}
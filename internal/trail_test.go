@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"compress/gzip"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testCloudTrail = `{"Records": [
+{"eventTime": "2019-02-06T00:00:38Z", "eventSource": "s3.amazonaws.com", "eventName": "DeleteObject",
+ "sourceIPAddress": "192.0.2.3", "userAgent": "aws-cli/1.16", "requestID": "REQ1",
+ "userIdentity": {"arn": "arn:aws:iam::123:user/bob"},
+ "requestParameters": {"bucketName": "splunks3restore", "key": "main/db/a"},
+ "responseElements": {"x-amz-version-id": "DM1", "x-amz-delete-marker": "true"}},
+{"eventTime": "2019-02-06T00:00:39Z", "eventSource": "s3.amazonaws.com", "eventName": "DeleteObject",
+ "sourceIPAddress": "192.0.2.3", "userAgent": "aws-cli/1.16", "requestID": "REQ2",
+ "userIdentity": {"arn": "arn:aws:iam::123:user/bob"},
+ "requestParameters": {"bucketName": "splunks3restore", "key": "main/db/b", "versionId": "V1"}},
+{"eventTime": "2019-02-06T00:00:40Z", "eventSource": "s3.amazonaws.com", "eventName": "DeleteObjects",
+ "sourceIPAddress": "10.1.2.3", "userAgent": "Splunk/8.0", "requestID": "REQ3",
+ "userIdentity": {"principalId": "AIDAEXAMPLE"},
+ "requestParameters": {"bucketName": "splunks3restore", "delete": {"Object": [{"Key": "main/db/c"}, {"Key": "main/db/d", "VersionId": "V2"}]}}},
+{"eventTime": "2019-02-06T00:00:41Z", "eventSource": "s3.amazonaws.com", "eventName": "GetObject",
+ "requestParameters": {"bucketName": "splunks3restore", "key": "main/db/e"}}
+]}`
+
+const testAccessLog = `owner splunks3restore [06/Feb/2019:00:00:42 +0000] 192.0.2.4 arn:aws:iam::123:user/eve REQ4 REST.DELETE.OBJECT main%2Fdb%2Ff "DELETE /splunks3restore/main/db/f HTTP/1.1" 204 - - - 10 - "-" "aws-cli/1.16" - HOSTID SigV4 ECDHE-RSA-AES128-GCM-SHA256 AuthHeader splunks3restore.s3.amazonaws.com TLSv1.2
+owner splunks3restore [06/Feb/2019:00:00:43 +0000] 192.0.2.4 arn:aws:iam::123:user/eve REQ5 REST.DELETE.OBJECT main/db/g "DELETE /splunks3restore/main/db/g?versionId=V3 HTTP/1.1" 204 - - - 10 - "-" "aws-cli/1.16" V3 HOSTID
+owner splunks3restore [06/Feb/2019:00:00:44 +0000] 192.0.2.4 arn:aws:iam::123:user/eve REQ6 REST.DELETE.OBJECT main/db/h "DELETE /splunks3restore/main/db/h HTTP/1.1" 403 AccessDenied - - 10 - "-" "aws-cli/1.16" - HOSTID
+owner splunks3restore [06/Feb/2019:00:00:45 +0000] 192.0.2.4 arn:aws:iam::123:user/eve REQ7 REST.GET.OBJECT main/db/i "GET /splunks3restore/main/db/i HTTP/1.1" 200 - 10 10 10 - "-" "aws-cli/1.16" - HOSTID
+owner splunks3restore [06/Feb/2019:00:00:46 +0000] AmazonS3 AmazonS3 REQ8 S3.CREATE.DELETEMARKER main/db/j - - - - - - - "-" "-" - HOSTID
+owner splunks3restore [06/Feb/2019:00:00:47 +0000] AmazonS3 AmazonS3 REQ9 S3.EXPIRE.OBJECT main/db/k - - - - - - - "-" "-" - HOSTID
+owner splunks3restore [06/Feb/2019:00:00:48 +0000] AmazonS3 AmazonS3 REQ10 S3.EXPIRE.OBJECT main/db/l - - - - - - - "-" "-" V4 HOSTID
+owner splunks3restore [06/Feb/2019:00:00:49 +0000] 192.0.2.4 arn:aws:iam::123:user/eve REQ11 REST.DELETE.OBJECT main/db/m "DELETE /splunks3restore/main/db/m HTTP/1.1" 204 - - - 10 - "-" "aws-cli/1.16 splunk-cleanup/1.0" - HOSTID
+`
+
+func TestReadTrail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splunks3restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeConf(t, filepath.Join(dir, "logs", "access.log"), testAccessLog)
+	if err := os.MkdirAll(filepath.Join(dir, "cloudtrail"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, "cloudtrail", "123_CloudTrail_us-west-2.json.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	w.Write([]byte(testCloudTrail))
+	w.Close()
+	f.Close()
+
+	events, err := ReadTrail(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, event := range events {
+		keys = append(keys, event.Key)
+	}
+	if strings.Join(keys, ",") != "main/db/a,main/db/c,main/db/f,main/db/j,main/db/k,main/db/m" {
+		t.Fatalf("unexpected deletes %v", keys)
+	}
+	a, c, f2, j, m := events[0], events[1], events[2], events[3], events[5]
+	if a.VersionID != "DM1" || a.Principal != "arn:aws:iam::123:user/bob" || a.SourceIP != "192.0.2.3" || a.RequestID != "REQ1" {
+		t.Errorf("unexpected DeleteObject event %+v", a)
+	}
+	if c.Principal != "AIDAEXAMPLE" || !isSplunkDelete(c) || isSplunkDelete(a) {
+		t.Errorf("unexpected DeleteObjects event %+v", c)
+	}
+	if f2.Bucket != "splunks3restore" || f2.UserAgent != "aws-cli/1.16" || !f2.Time.Equal(time.Date(2019, 2, 6, 0, 0, 42, 0, time.UTC)) {
+		t.Errorf("unexpected access log event %+v", f2)
+	}
+	if j.Principal != "AmazonS3" || j.VersionID != "" || isSplunkDelete(j) {
+		t.Errorf("unexpected lifecycle event %+v", j)
+	}
+	if isSplunkDelete(m) {
+		t.Errorf("expected only a Splunk/ user agent to be a Splunk delete: %s", m.UserAgent)
+	}
+}
+
+func TestTrailFilter_Match(t *testing.T) {
+	event := trailEvent{Principal: "arn:aws:iam::123:user/bob", SourceIP: "192.0.2.3", UserAgent: "aws-cli/1.16", RequestID: "REQ1"}
+	for _, tc := range []struct {
+		principals, ips, agents, ids []string
+		want                         bool
+	}{
+		{want: true},
+		{principals: []string{"*:user/bob"}, want: true},
+		{principals: []string{"*:user/eve"}, want: false},
+		{ips: []string{"192.0.2.0/24"}, want: true},
+		{ips: []string{"192.0.2.4", "10.0.0.0/8"}, want: false},
+		{agents: []string{"aws-cli/*"}, ids: []string{"REQ?"}, want: true},
+		{principals: []string{"*bob"}, ids: []string{"REQ2"}, want: false},
+	} {
+		f, err := parseTrailFilter(tc.principals, tc.ips, tc.agents, tc.ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Match(event); got != tc.want {
+			t.Errorf("%v %v %v %v: expected %v", tc.principals, tc.ips, tc.agents, tc.ids, tc.want)
+		}
+	}
+	if _, err := parseTrailFilter(nil, []string{"not-an-ip"}, nil, nil); err == nil {
+		t.Errorf("expected an invalid --source-ip to fail")
+	}
+}
+
+func TestTrailIndex_Match(t *testing.T) {
+	at := time.Date(2019, 2, 6, 0, 0, 38, 0, time.UTC)
+	index := trailIndex{
+		"main/db/a": {{Key: "main/db/a", VersionID: "DM1", Time: at}},
+		"main/db/f": {{Key: "main/db/f", Time: at}},
+	}
+	marker := func(key, version string, t time.Time) *s3.DeleteMarkerEntry {
+		return &s3.DeleteMarkerEntry{Key: aws.String(key), VersionId: aws.String(version), LastModified: aws.Time(t)}
+	}
+	for _, tc := range []struct {
+		marker *s3.DeleteMarkerEntry
+		want   bool
+	}{
+		{marker("main/db/a", "DM1", at.Add(time.Hour)), true},
+		{marker("main/db/a", "DM2", at), false},
+		{marker("main/db/f", "DM3", at.Add(2*time.Second)), true},
+		{marker("main/db/f", "DM4", at.Add(-time.Minute)), false},
+		{marker("main/db/x", "DM5", at), false},
+	} {
+		if _, got := index.Match(tc.marker); got != tc.want {
+			t.Errorf("%s %s: expected %v", aws.StringValue(tc.marker.Key), aws.StringValue(tc.marker.VersionId), tc.want)
+		}
+	}
+}
+
+func TestGetUsage_fromTrail(t *testing.T) {
+	defer withTestingMode()()
+	dir, err := ioutil.TempDir("", "splunks3restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := GetUsage([]string{"restore", "--s3bucket", "splunks3restore", "--from-trail", dir, "--principal", "*:user/bob", "--source-ip", "192.0.2.0/24"}, "1.0.0")
+	if opts.Config.FromTrail != dir || len(opts.Config.TrailFilter.Principals) != 1 || len(opts.Config.TrailFilter.SourceNets) != 1 {
+		t.Errorf("unexpected trail config %+v", opts.Config.TrailFilter)
+	}
+	if !opts.Config.FromDate.IsZero() || opts.Config.SplunkDeletes {
+		t.Errorf("expected no --start to select the whole trail, without Splunk deletes")
+	}
+	opts = GetUsage([]string{"restore", "--s3bucket", "splunks3restore", "--from-trail", dir, "--include-splunk-deletes"}, "1.0.0")
+	if !opts.Config.SplunkDeletes {
+		t.Errorf("expected --include-splunk-deletes to be set")
+	}
+}
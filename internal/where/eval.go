@@ -0,0 +1,217 @@
+package where
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// node is a type checked expression
+type node interface {
+	kind() Kind
+	eval(vars Vars) (interface{}, error)
+}
+
+type literal struct {
+	k Kind
+	v interface{}
+}
+
+func (l *literal) kind() Kind                     { return l.k }
+func (l *literal) eval(Vars) (interface{}, error) { return l.v, nil }
+
+type variable struct {
+	name string
+	k    Kind
+}
+
+func (v *variable) kind() Kind { return v.k }
+
+func (v *variable) eval(vars Vars) (interface{}, error) {
+	val, ok := vars[v.name]
+	if !ok {
+		return nil, fmt.Errorf("variable %s is not set", v.name)
+	}
+	switch val.(type) {
+	case string:
+		if v.k == String {
+			return val, nil
+		}
+	case int64:
+		if v.k == Int {
+			return val, nil
+		}
+	case bool:
+		if v.k == Bool {
+			return val, nil
+		}
+	case time.Time:
+		if v.k == Time {
+			return val, nil
+		}
+	}
+	return nil, fmt.Errorf("variable %s is a %T, expecting a %s", v.name, val, v.k)
+}
+
+type not struct {
+	x node
+}
+
+func (n *not) kind() Kind { return Bool }
+
+func (n *not) eval(vars Vars) (interface{}, error) {
+	v, err := n.x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return !v.(bool), nil
+}
+
+type logical struct {
+	and         bool
+	left, right node
+}
+
+func (l *logical) kind() Kind { return Bool }
+
+// eval short circuits like Go
+func (l *logical) eval(vars Vars) (interface{}, error) {
+	v, err := l.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	if v.(bool) != l.and {
+		return v, nil
+	}
+	return l.right.eval(vars)
+}
+
+type comparison struct {
+	op          string
+	left, right node
+}
+
+func (c *comparison) kind() Kind { return Bool }
+
+func (c *comparison) eval(vars Vars) (interface{}, error) {
+	a, err := c.left.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.right.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	cmp := 0
+	switch a := a.(type) {
+	case string:
+		cmp = strings.Compare(a, b.(string))
+	case int64:
+		switch b := b.(int64); {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	case time.Time:
+		switch b := b.(time.Time); {
+		case a.Before(b):
+			cmp = -1
+		case a.After(b):
+			cmp = 1
+		}
+	case bool:
+		if a != b.(bool) {
+			cmp = 1
+		}
+	}
+	switch c.op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+type match struct {
+	x      node
+	re     *regexp.Regexp
+	negate bool
+}
+
+func (m *match) kind() Kind { return Bool }
+
+func (m *match) eval(vars Vars) (interface{}, error) {
+	v, err := m.x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	return m.re.MatchString(v.(string)) != m.negate, nil
+}
+
+type in struct {
+	x     node
+	items []*literal
+}
+
+func (n *in) kind() Kind { return Bool }
+
+func (n *in) eval(vars Vars) (interface{}, error) {
+	v, err := n.x.eval(vars)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range n.items {
+		if t, ok := v.(time.Time); ok {
+			if t.Equal(item.v.(time.Time)) {
+				return true, nil
+			}
+			continue
+		}
+		if v == item.v {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// functions are the string functions, all take two strings and return a bool
+var functions = map[string]func(args []string) (bool, error){
+	"contains":   func(a []string) (bool, error) { return strings.Contains(a[0], a[1]), nil },
+	"startsWith": func(a []string) (bool, error) { return strings.HasPrefix(a[0], a[1]), nil },
+	"endsWith":   func(a []string) (bool, error) { return strings.HasSuffix(a[0], a[1]), nil },
+	"glob":       globMatch,
+}
+
+type call struct {
+	name string
+	fn   func([]string) (bool, error)
+	args []node
+}
+
+func (c *call) kind() Kind { return Bool }
+
+func (c *call) eval(vars Vars) (interface{}, error) {
+	args := make([]string, len(c.args))
+	for i, arg := range c.args {
+		v, err := arg.eval(vars)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v.(string)
+	}
+	return c.fn(args)
+}
+
+func globMatch(a []string) (bool, error) {
+	return path.Match(a[1], a[0])
+}
@@ -0,0 +1,136 @@
+package where
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type tokenType int
+
+const (
+	tokEOF tokenType = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	typ tokenType
+	val string
+	num int64
+	pos int
+}
+
+// operators ordered so that longer operators are matched first
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+// sizeSuffixes are the binary multipliers accepted after numbers, e.g. 10MB or 1GiB
+var sizeSuffixes = map[string]int64{
+	"":    1,
+	"k":   1 << 10,
+	"kb":  1 << 10,
+	"kib": 1 << 10,
+	"m":   1 << 20,
+	"mb":  1 << 20,
+	"mib": 1 << 20,
+	"g":   1 << 30,
+	"gb":  1 << 30,
+	"gib": 1 << 30,
+	"t":   1 << 40,
+	"tb":  1 << 40,
+	"tib": 1 << 40,
+}
+
+// lex splits src into tokens
+func lex(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			tok, n, err := lexString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, tok)
+			i += n
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+				i++
+			}
+			digits := src[start:i]
+			for i < len(src) && unicode.IsLetter(rune(src[i])) {
+				i++
+			}
+			mult, ok := sizeSuffixes[strings.ToLower(src[start+len(digits):i])]
+			if !ok {
+				return nil, fmt.Errorf("invalid number %q at %d", src[start:i], start)
+			}
+			n, err := strconv.ParseInt(digits, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at %d: %v", digits, start, err)
+			}
+			tokens = append(tokens, token{typ: tokNumber, val: src[start:i], num: n * mult, pos: start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(src) && (unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i])) || src[i] == '_') {
+				i++
+			}
+			tokens = append(tokens, token{typ: tokIdent, val: src[start:i], pos: start})
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, token{typ: tokOp, val: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{typ: tokEOF, pos: len(src)}), nil
+}
+
+// lexString reads a single or double quoted string starting at src[start]. \n, \t, \\ and escaped quotes are
+// unescaped, other backslashes are kept.
+func lexString(src string, start int) (token, int, error) {
+	quote := src[start]
+	var sb strings.Builder
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case quote:
+			return token{typ: tokString, val: sb.String(), pos: start}, i - start + 1, nil
+		case '\\':
+			i++
+			if i >= len(src) {
+				break
+			}
+			switch src[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case '\\', '"', '\'':
+				sb.WriteByte(src[i])
+			default:
+				// keep unknown escapes such as \. for regular expressions
+				sb.WriteByte('\\')
+				sb.WriteByte(src[i])
+			}
+		default:
+			sb.WriteByte(src[i])
+		}
+	}
+	return token{}, 0, fmt.Errorf("unterminated string at %d", start)
+}
@@ -0,0 +1,314 @@
+package where
+
+import (
+	"fmt"
+	"regexp"
+)
+
+type parser struct {
+	tokens []token
+	i      int
+	decls  Decls
+	opts   Options
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.i]
+	if tok.typ != tokEOF {
+		p.i++
+	}
+	return tok
+}
+
+func (p *parser) accept(op string) bool {
+	if tok := p.peek(); tok.typ == tokOp && tok.val == op {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(op string) error {
+	if !p.accept(op) {
+		tok := p.peek()
+		return fmt.Errorf("expecting %q at %d, found %q", op, tok.pos, tok.val)
+	}
+	return nil
+}
+
+// parseOr parses a || b
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBool("||", left, right); err != nil {
+			return nil, err
+		}
+		left = &logical{and: false, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseAnd parses a && b
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseCompare()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.parseCompare()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkBool("&&", left, right); err != nil {
+			return nil, err
+		}
+		left = &logical{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+// parseCompare parses comparisons, regular expression matches and in
+func (p *parser) parseCompare() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	switch {
+	case tok.typ == tokOp && (tok.val == "==" || tok.val == "!=" || tok.val == "<" || tok.val == "<=" || tok.val == ">" || tok.val == ">="):
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return p.compare(tok, left, right)
+	case tok.typ == tokOp && (tok.val == "=~" || tok.val == "!~"):
+		p.next()
+		pattern := p.next()
+		if pattern.typ != tokString {
+			return nil, fmt.Errorf("%s at %d needs a string regular expression", tok.val, tok.pos)
+		}
+		if left.kind() != String {
+			return nil, fmt.Errorf("%s at %d needs a string, found %s", tok.val, tok.pos, left.kind())
+		}
+		re, err := regexp.Compile(pattern.val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression at %d: %v", pattern.pos, err)
+		}
+		return &match{x: left, re: re, negate: tok.val == "!~"}, nil
+	case tok.typ == tokIdent && tok.val == "in":
+		p.next()
+		items, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			if item, err = p.convert(left.kind(), item); err != nil {
+				return nil, fmt.Errorf("in at %d: %v", tok.pos, err)
+			}
+			items[i] = item
+		}
+		return &in{x: left, items: items}, nil
+	}
+	return left, nil
+}
+
+// parseList parses a list of literals [a, b, ...]
+func (p *parser) parseList() ([]*literal, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	var items []*literal
+	for !p.accept("]") {
+		if len(items) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		tok := p.peek()
+		n, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		lit, ok := n.(*literal)
+		if !ok {
+			return nil, fmt.Errorf("list items must be literals at %d", tok.pos)
+		}
+		items = append(items, lit)
+	}
+	return items, nil
+}
+
+// parseUnary parses !x
+func (p *parser) parseUnary() (node, error) {
+	tok := p.peek()
+	if p.accept("!") {
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if x.kind() != Bool {
+			return nil, fmt.Errorf("! at %d needs a bool, found %s", tok.pos, x.kind())
+		}
+		return &not{x: x}, nil
+	}
+	return p.parsePostfix()
+}
+
+// parsePostfix parses method calls x.f(args)
+func (p *parser) parsePostfix() (node, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.accept(".") {
+		name := p.next()
+		if name.typ != tokIdent {
+			return nil, fmt.Errorf("expecting a function name at %d", name.pos)
+		}
+		args, err := p.parseArgs()
+		if err != nil {
+			return nil, err
+		}
+		if x, err = newCall(name, append([]node{x}, args...)); err != nil {
+			return nil, err
+		}
+	}
+	return x, nil
+}
+
+// parsePrimary parses literals, variables, function calls and parentheses
+func (p *parser) parsePrimary() (node, error) {
+	tok := p.next()
+	switch tok.typ {
+	case tokString:
+		return &literal{k: String, v: tok.val}, nil
+	case tokNumber:
+		return &literal{k: Int, v: tok.num}, nil
+	case tokIdent:
+		switch tok.val {
+		case "true", "false":
+			return &literal{k: Bool, v: tok.val == "true"}, nil
+		}
+		if _, ok := functions[tok.val]; ok && p.peek().typ == tokOp && p.peek().val == "(" {
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			return newCall(tok, args)
+		}
+		k, ok := p.decls[tok.val]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable %q at %d", tok.val, tok.pos)
+		}
+		return &variable{name: tok.val, k: k}, nil
+	case tokOp:
+		if tok.val == "(" {
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+	case tokEOF:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", tok.val, tok.pos)
+}
+
+// parseArgs parses (a, b, ...)
+func (p *parser) parseArgs() ([]node, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []node
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// compare type checks a comparison, string literals compared with times are parsed as times
+func (p *parser) compare(op token, left, right node) (node, error) {
+	var err error
+	if lit, ok := right.(*literal); ok && left.kind() != right.kind() {
+		right, err = p.convert(left.kind(), lit)
+	} else if lit, ok := left.(*literal); ok && left.kind() != right.kind() {
+		left, err = p.convert(right.kind(), lit)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %v", op.val, op.pos, err)
+	}
+	if left.kind() != right.kind() {
+		return nil, fmt.Errorf("%s at %d compares %s with %s", op.val, op.pos, left.kind(), right.kind())
+	}
+	if left.kind() == Bool && op.val != "==" && op.val != "!=" {
+		return nil, fmt.Errorf("%s at %d can not order bools", op.val, op.pos)
+	}
+	return &comparison{op: op.val, left: left, right: right}, nil
+}
+
+// convert returns lit as kind k, only string literals can be converted to times
+func (p *parser) convert(k Kind, lit *literal) (*literal, error) {
+	if lit.k == k {
+		return lit, nil
+	}
+	if k == Time && lit.k == String {
+		t, err := p.opts.ParseTime(lit.v.(string))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q: %v", lit.v, err)
+		}
+		return &literal{k: Time, v: t}, nil
+	}
+	return nil, fmt.Errorf("expecting a %s, found %s", k, lit.k)
+}
+
+func checkBool(op string, left, right node) error {
+	if left.kind() != Bool || right.kind() != Bool {
+		return fmt.Errorf("%s needs bools, found %s and %s", op, left.kind(), right.kind())
+	}
+	return nil
+}
+
+func newCall(name token, args []node) (node, error) {
+	fn, ok := functions[name.val]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", name.val, name.pos)
+	}
+	if len(args) != 2 {
+		return nil, fmt.Errorf("%s at %d takes 2 arguments, found %d", name.val, name.pos, len(args))
+	}
+	for _, arg := range args {
+		if arg.kind() != String {
+			return nil, fmt.Errorf("%s at %d takes strings, found %s", name.val, name.pos, arg.kind())
+		}
+	}
+	if name.val == "glob" {
+		if lit, ok := args[1].(*literal); ok {
+			if _, err := globMatch([]string{"", lit.v.(string)}); err != nil {
+				return nil, fmt.Errorf("invalid glob at %d: %v", name.pos, err)
+			}
+		}
+	}
+	return &call{name: name.val, fn: fn, args: args}, nil
+}
@@ -0,0 +1,104 @@
+// Package where implements the --where filter language, a small CEL-like expression language.
+//
+// Expressions compare declared variables with literals and combine the comparisons with &&, || and !, e.g.
+//
+//	name != "bloomfilter" && size > 0 && index in ["main", "_internal"]
+//
+// Supported are string, integer, bool and time values. Comparisons are ==, !=, <, <=, >, >=, the regular
+// expression matches =~ and !~ and in with a list of literals. Strings have the functions contains, startsWith,
+// endsWith and glob which may also be called as methods, e.g. key.endsWith("/receipt.json"). Integers accept
+// binary size suffixes such as 10MB or 1GiB. A string literal compared with a time variable is parsed as a time.
+package where
+
+import (
+	"fmt"
+	"time"
+)
+
+// Kind is the type of a value
+type Kind int
+
+const (
+	String Kind = iota + 1
+	Int
+	Bool
+	Time
+)
+
+func (k Kind) String() string {
+	switch k {
+	case String:
+		return "string"
+	case Int:
+		return "int"
+	case Bool:
+		return "bool"
+	case Time:
+		return "time"
+	}
+	return "unknown"
+}
+
+// Decls declares the variables an expression may use and their kinds
+type Decls map[string]Kind
+
+// Vars holds the values of the variables of an expression. Values are string, int64, bool or time.Time.
+type Vars map[string]interface{}
+
+// Options changes how expressions are compiled
+type Options struct {
+	// ParseTime converts string literals compared with time variables. Defaults to RFC3339.
+	ParseTime func(string) (time.Time, error)
+}
+
+// Expr is a compiled expression
+type Expr struct {
+	src  string
+	root node
+}
+
+// Compile parses and type checks src against decls
+func Compile(src string, decls Decls, opts Options) (*Expr, error) {
+	if opts.ParseTime == nil {
+		opts.ParseTime = func(s string) (time.Time, error) { return time.Parse(time.RFC3339, s) }
+	}
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens, decls: decls, opts: opts}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.typ != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at %d", tok.val, tok.pos)
+	}
+	if root.kind() != Bool {
+		return nil, fmt.Errorf("expression is of type %s, expecting a condition", root.kind())
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+// MustCompile is like Compile but panics on errors
+func MustCompile(src string, decls Decls, opts Options) *Expr {
+	e, err := Compile(src, decls, opts)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// Eval evaluates the expression with vars
+func (e *Expr) Eval(vars Vars) (bool, error) {
+	v, err := e.root.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// String returns the source of the expression
+func (e *Expr) String() string {
+	return e.src
+}
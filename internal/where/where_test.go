@@ -0,0 +1,110 @@
+package where
+
+import (
+	"testing"
+	"time"
+)
+
+var testDecls = Decls{
+	"key":              String,
+	"name":             String,
+	"index":            String,
+	"size":             Int,
+	"last_modified":    Time,
+	"is_latest":        Bool,
+	"is_delete_marker": Bool,
+}
+
+func testVars() Vars {
+	return Vars{
+		"key":              "frozen/main/db/0C/F7/275~609B1724-4D3E-4B1A-8A6E-5A0A2B2C8B1D/rawdata/journal.gz",
+		"name":             "journal.gz",
+		"index":            "main",
+		"size":             int64(3 << 20),
+		"last_modified":    time.Date(2020, time.May, 13, 15, 30, 0, 0, time.UTC),
+		"is_latest":        false,
+		"is_delete_marker": true,
+	}
+}
+
+func TestExpr_Eval(t *testing.T) {
+	for src, want := range map[string]bool{
+		`name != "bloomfilter" && size > 0`:                       true,
+		`name == "bloomfilter" || size > 0`:                       true,
+		`size > 3MB || size < 3MiB`:                               false,
+		`size >= 3MB && size <= 3mb`:                              true,
+		`!(size > 1GB)`:                                           true,
+		`is_delete_marker && !is_latest`:                          true,
+		`is_latest == false`:                                      true,
+		`index in ["main", "_internal"]`:                          true,
+		`index in ["_audit"]`:                                     false,
+		`size in [1, 3145728]`:                                    true,
+		`key =~ "/rawdata/journal\.(gz|zst)$"`:                    true,
+		`key !~ "^frozen/"`:                                       false,
+		`contains(key, "/db/")`:                                   true,
+		`key.startsWith("frozen/main/") && name.endsWith(".gz")`:  true,
+		`name.glob("*.tsidx")`:                                    false,
+		`glob(name, "journal.*")`:                                 true,
+		`last_modified > "2020-05-13T00:00:00Z"`:                  true,
+		`"2020-05-14T00:00:00Z" < last_modified`:                  false,
+		`last_modified in ["2020-05-13T15:30:00Z"]`:               true,
+		`name == 'journal.gz' && (size == 0 || is_delete_marker)`: true,
+	} {
+		e, err := Compile(src, testDecls, Options{})
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		got, err := e.Eval(testVars())
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: expected %v, got %v", src, want, got)
+		}
+	}
+}
+
+func TestCompile_invalid(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`size`,
+		`name`,
+		`size > "big"`,
+		`name > 1`,
+		`unknown == 1`,
+		`name == "a" &&`,
+		`(size > 1`,
+		`size > 1)`,
+		`is_latest < true`,
+		`size =~ "1"`,
+		`name =~ "("`,
+		`name.glob("[")`,
+		`size.contains("1")`,
+		`startsWith(name)`,
+		`last_modified > "yesterday"`,
+		`index in [name]`,
+		`name == "unterminated`,
+		`size > 10XB`,
+		`name # "a"`,
+	} {
+		if _, err := Compile(src, testDecls, Options{}); err == nil {
+			t.Errorf("expected %q to be rejected", src)
+		}
+	}
+}
+
+func TestExpr_Eval_missing(t *testing.T) {
+	e := MustCompile(`size > 0 || name == "x"`, testDecls, Options{})
+	if _, err := e.Eval(Vars{"name": "x"}); err == nil {
+		t.Error("expected an error for a missing variable")
+	}
+	if _, err := e.Eval(Vars{"size": 1}); err == nil {
+		t.Error("expected an error for a variable of the wrong type")
+	}
+	// || short circuits so name is never read
+	if ok, err := e.Eval(Vars{"size": int64(1)}); err != nil || !ok {
+		t.Errorf("expected true, got %v %v", ok, err)
+	}
+}